@@ -6,10 +6,52 @@ package annotations
 const (
 	// DrainSafeMaintenance key for maintenance
 	DrainSafeMaintenance string = "drainsafe.azure.com/maintenancestate"
+	// DrainSafeMaintenanceStateTime key for time the current maintenance state was entered, in RFC3339 format
+	DrainSafeMaintenanceStateTime string = "drainsafe.azure.com/maintenancestatetime"
 	// DrainSafeMaintenanceType key for maintenancetype
 	DrainSafeMaintenanceType string = "drainsafe.azure.com/maintenancetype"
 	// DrainSafeMaintenanceOwner key for specifying maintenance owner
 	DrainSafeMaintenanceOwner string = "drainsafe.azure.com/maintenanceowner"
+	// DrainSafeAllowUncordon key for break glass override, "true" allows uncordoning a node drainsafe keeps cordoned during maintenance
+	DrainSafeAllowUncordon string = "drainsafe.azure.com/allowuncordon"
+	// DrainSafeMaintenanceApprover key for who approved the maintenance, Drainsafe, Repairman or ExpressDrain
+	DrainSafeMaintenanceApprover string = "drainsafe.azure.com/maintenanceapprover"
+	// DrainSafeDrainResult key for outcome of the last drain
+	DrainSafeDrainResult string = "drainsafe.azure.com/drainresult"
+	// DrainSafeBlockedPods key for comma separated namespace/name of pods whose eviction is refused by pod disruption budgets
+	DrainSafeBlockedPods string = "drainsafe.azure.com/blockedpods"
+	// DrainSafeBlockingBudgets key for comma separated namespace/name of pod disruption budgets blocking the drain
+	DrainSafeBlockingBudgets string = "drainsafe.azure.com/blockingbudgets"
+	// DrainSafeEvictedPods key for comma separated namespace/name of pods evicted by the last drain
+	DrainSafeEvictedPods string = "drainsafe.azure.com/evictedpods"
+	// DrainSafeHookStatus key for json list of progress of hooks of the current hook state
+	DrainSafeHookStatus string = "drainsafe.azure.com/hookstatus"
+	// DrainSafeEvictedOwners key for json list of controllers of evicted pods verified to be rescheduled
+	DrainSafeEvictedOwners string = "drainsafe.azure.com/evictedowners"
+	// DrainSafeVerifyDeadline key for time after which verification gives up waiting for evicted pods, in RFC3339 format
+	DrainSafeVerifyDeadline string = "drainsafe.azure.com/verifydeadline"
+	// DrainSafeEventID key for scheduled event id
+	DrainSafeEventID string = "drainsafe.azure.com/eventid"
+	// DrainSafeNotBefore key for time after which azure may start the scheduled event, in RFC1123 format
+	DrainSafeNotBefore string = "drainsafe.azure.com/notbefore"
+	// DrainSafeResources key for comma separated virtual machines affected by the scheduled event
+	DrainSafeResources string = "drainsafe.azure.com/resources"
+	// DrainSafeEventSource key for scheduled event initiator, Platform or User
+	DrainSafeEventSource string = "drainsafe.azure.com/eventsource"
+	// DrainSafeDescription key for scheduled event description
+	DrainSafeDescription string = "drainsafe.azure.com/description"
+	// DrainSafeDuration key for expected scheduled event duration in seconds
+	DrainSafeDuration string = "drainsafe.azure.com/durationinseconds"
+	// DrainSafeEvents key for json list of all pending scheduled events on the virtual machine
+	DrainSafeEvents string = "drainsafe.azure.com/events"
+	// DrainSafePlatformFaultDomain key for the azure platformFaultDomain of the virtual machine
+	DrainSafePlatformFaultDomain string = "drainsafe.azure.com/platformfaultdomain"
+	// DrainSafePlatformUpdateDomain key for the azure platformUpdateDomain of the virtual machine
+	DrainSafePlatformUpdateDomain string = "drainsafe.azure.com/platformupdatedomain"
+	// DrainSafeDrainPolicy pod annotation key for how the pod is drained, first, last, never or delete
+	DrainSafeDrainPolicy string = "drainsafe.azure.com/drain-policy"
+	// DrainSafeDrainWave pod annotation key for the eviction wave of the pod, lower waves are evicted first
+	DrainSafeDrainWave string = "drainsafe.azure.com/drain-wave"
 	// Scheduled maintenance is scheduled  on virtual machine
 	Scheduled string = "MaintenanceScheduled"
 	// MaintenancePending gets maintenance approval from repairman to coordinate repairs
@@ -20,16 +62,30 @@ const (
 	Cordoning string = "NodeCordoning"
 	// Cordoned workload scheduling is disabled on virtual machine
 	Cordoned string = "NodeCordoned"
+	// PreDrain pre drain hooks are run before workload is drained on virtual machine
+	PreDrain string = "NodePreDrain"
 	// Draining workload will be drained on virtual machine
 	Draining string = "NodeDraining"
+	// ExpressDraining workload is being cordoned and drained right away by scheduled event controller
+	ExpressDraining string = "NodeExpressDraining"
+	// Verifying workload drained from virtual machine is verified to be running elsewhere
+	Verifying string = "NodeVerifying"
 	// Drained workload is drained on virtual machine
 	Drained string = "NodeDrained"
 	// Started maintenance is started on virtual machine
 	Started string = "MaintenanceStarted"
 	// Running maintenance is completed on virtual machine
 	Running string = "NodeRunning"
+	// PostMaintenance post maintenance hooks are run before workload scheduling is enabled on virtual machine
+	PostMaintenance string = "NodePostMaintenance"
 	// Uncordoned workload scheduling is enabled on virtual machine
 	Uncordoned string = "NodeUncordoned"
 	// Drainsafe marks if the current maintenance owner is drainsafe itself
 	Drainsafe string = "Drainsafe"
+	// Repairman marks maintenance approved by repairman
+	Repairman string = "Repairman"
+	// ExpressDrain marks maintenance approved by scheduled event controller express drain
+	ExpressDrain string = "ExpressDrain"
+	// DrainSucceeded drain result when all pods were evicted
+	DrainSucceeded string = "Succeeded"
 )
@@ -0,0 +1,264 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EventAction action taken for a scheduled event type
+// +kubebuilder:validation:Enum=Ignore;AnnotateOnly;CordonOnly;Drain;ExpressDrain
+type EventAction string
+
+// PodDrainPolicy how a pod is drained
+// +kubebuilder:validation:Enum=first;last;never;delete
+type PodDrainPolicy string
+
+// WaveOrder how pods are split into eviction waves
+// +kubebuilder:validation:Enum=PriorityClass;Annotation
+type WaveOrder string
+
+// DisruptionBudgetEscalation what is done when pod disruption budgets still block the drain
+// as the NotBefore of the scheduled event nears
+// +kubebuilder:validation:Enum=Wait;ForceDelete;AlertOnly
+type DisruptionBudgetEscalation string
+
+const (
+	// EscalationWait keeps retrying evictions, the maintenance is not approved while pods are blocked
+	EscalationWait DisruptionBudgetEscalation = "Wait"
+	// EscalationForceDelete deletes blocked pods without eviction and approves the maintenance
+	EscalationForceDelete DisruptionBudgetEscalation = "ForceDelete"
+	// EscalationAlertOnly raises a warning event and approves the maintenance leaving blocked pods running
+	EscalationAlertOnly DisruptionBudgetEscalation = "AlertOnly"
+)
+
+// PodPolicy applies drain policy to pods matching selector
+type PodPolicy struct {
+	// Selector of pods the policy applies to
+	Selector metav1.LabelSelector `json:"selector"`
+	// Policy first pods are evicted before others, last once all others are gone, never blocks
+	// the drain and approval of the maintenance, delete deletes the pod without eviction
+	Policy PodDrainPolicy `json:"policy"`
+}
+
+// DrainSpec flags used when draining a node
+type DrainSpec struct {
+	// IgnoreDaemonSets ignores daemonset managed pods, true if not set
+	// +optional
+	IgnoreDaemonSets *bool `json:"ignoreDaemonSets,omitempty"`
+	// Force deletes pods which are not managed by a controller, true if not set
+	// +optional
+	Force *bool `json:"force,omitempty"`
+	// DeleteLocalData deletes pods using emptyDir volumes, true if not set
+	// +optional
+	DeleteLocalData *bool `json:"deleteLocalData,omitempty"`
+	// PodPolicies drain policy of pods without drainsafe.azure.com/drain-policy annotation,
+	// the first policy whose selector matches the pod applies
+	// +optional
+	PodPolicies []PodPolicy `json:"podPolicies,omitempty"`
+	// WaveOrder splits pods of the same policy into eviction waves, PriorityClass evicts pods of
+	// lower priority first, Annotation evicts pods of lower drainsafe.azure.com/drain-wave first,
+	// pods are evicted in a single wave if not set
+	// +optional
+	WaveOrder WaveOrder `json:"waveOrder,omitempty"`
+	// WaveTimeout how long to wait for pods of a wave to be running elsewhere before the next
+	// wave is evicted anyway, 2m if not set
+	// +optional
+	WaveTimeout *metav1.Duration `json:"waveTimeout,omitempty"`
+	// VerifyReschedule waits for controllers of evicted pods to have all their replicas ready
+	// again before the node is drained and the maintenance approved, false if not set
+	// +optional
+	VerifyReschedule bool `json:"verifyReschedule,omitempty"`
+	// VerifyTimeout how long to wait for evicted pods to be rescheduled before the node is
+	// drained anyway, still bounded by the NotBefore of the scheduled event, 5m if not set
+	// +optional
+	VerifyTimeout *metav1.Duration `json:"verifyTimeout,omitempty"`
+	// DisruptionBudgetEscalation what is done when pod disruption budgets still block the drain
+	// EscalateBefore the NotBefore of the scheduled event, Wait if not set
+	// +optional
+	DisruptionBudgetEscalation DisruptionBudgetEscalation `json:"disruptionBudgetEscalation,omitempty"`
+	// EscalateBefore how long before the NotBefore of the scheduled event blocked drains are
+	// escalated, 2m if not set
+	// +optional
+	EscalateBefore *metav1.Duration `json:"escalateBefore,omitempty"`
+}
+
+// HookFailurePolicy what is done when a hook fails or times out
+// +kubebuilder:validation:Enum=Ignore;Fail
+type HookFailurePolicy string
+
+const (
+	// HookFailureIgnore maintenance proceeds once the hook failed
+	HookFailureIgnore HookFailurePolicy = "Ignore"
+	// HookFailureFail maintenance does not proceed, the node is kept in the hook state
+	HookFailureFail HookFailurePolicy = "Fail"
+)
+
+// WebhookHook webhook called with a POST of the node maintenance
+type WebhookHook struct {
+	// URL of the webhook, the hook succeeds on a 2xx response
+	URL string `json:"url"`
+}
+
+// JobHook kubernetes job run with NODE_NAME, MAINTENANCE_PHASE, MAINTENANCE_TYPE and EVENT_ID environment
+type JobHook struct {
+	// Namespace of the job, namespace of drainsafe if not set
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// Image of the job container
+	Image string `json:"image"`
+	// Command of the job container
+	// +optional
+	Command []string `json:"command,omitempty"`
+	// Args of the job container
+	// +optional
+	Args []string `json:"args,omitempty"`
+	// ServiceAccountName the job runs as
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+}
+
+// Hook action run around maintenance, exactly one of webhook or job is set
+type Hook struct {
+	// Name of the hook, unique within the phase
+	Name string `json:"name"`
+	// Webhook called with a POST of the node maintenance
+	// +optional
+	Webhook *WebhookHook `json:"webhook,omitempty"`
+	// Job run to completion
+	// +optional
+	Job *JobHook `json:"job,omitempty"`
+	// Timeout how long the hook may run including retries, 5m if not set
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// Retries how many times a failed hook is retried, 3 if not set
+	// +optional
+	Retries *int32 `json:"retries,omitempty"`
+	// FailurePolicy Ignore proceeds with maintenance once the hook failed or timed out, Fail keeps
+	// the node in the hook state, Ignore if not set
+	// +optional
+	FailurePolicy HookFailurePolicy `json:"failurePolicy,omitempty"`
+}
+
+// HooksSpec hooks run around maintenance
+type HooksSpec struct {
+	// PreDrain hooks run in order once the node is cordoned, before it is drained
+	// +optional
+	PreDrain []Hook `json:"preDrain,omitempty"`
+	// PostMaintenance hooks run in order once maintenance completed, before the node is uncordoned
+	// +optional
+	PostMaintenance []Hook `json:"postMaintenance,omitempty"`
+}
+
+// HealthGateSpec checks a node has to pass after maintenance before it is uncordoned
+type HealthGateSpec struct {
+	// Disabled uncordons nodes after maintenance without checking their health, false if not set
+	// +optional
+	Disabled bool `json:"disabled,omitempty"`
+	// Conditions node condition types which must not be True, checked in addition to Ready being
+	// True and MemoryPressure, DiskPressure, PIDPressure and NetworkUnavailable not being True,
+	// e.g. KernelDeadlock reported by node problem detector
+	// +optional
+	Conditions []corev1.NodeConditionType `json:"conditions,omitempty"`
+	// ProbeSelector selects pods of a probe daemonset, nodes are uncordoned only once a selected
+	// pod on the node is ready, not checked if not set
+	// +optional
+	ProbeSelector *metav1.LabelSelector `json:"probeSelector,omitempty"`
+	// ProbeNamespace namespace of probe pods, all namespaces if not set
+	// +optional
+	ProbeNamespace string `json:"probeNamespace,omitempty"`
+}
+
+// StuckStateRecovery what is done with nodes stuck in a maintenance state
+// +kubebuilder:validation:Enum=Reset;AlertOnly
+type StuckStateRecovery string
+
+const (
+	// StuckStateReset resets stuck nodes to MaintenanceScheduled if a scheduled event is still
+	// pending, NodeRunning otherwise, and raises a warning event
+	StuckStateReset StuckStateRecovery = "Reset"
+	// StuckStateAlertOnly raises a warning event leaving stuck nodes in their state
+	StuckStateAlertOnly StuckStateRecovery = "AlertOnly"
+)
+
+// StuckStateSpec detection and recovery of nodes stuck in a maintenance state
+type StuckStateSpec struct {
+	// Timeout how long a node may stay in a maintenance state other than MaintenanceScheduled,
+	// MaintenancePending, MaintenanceStarted, NodeRunning and NodePostMaintenance before it is
+	// stuck, 2h if not set
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// Recovery Reset resets stuck nodes to a safe state, AlertOnly only raises a warning event,
+	// Reset if not set
+	// +optional
+	Recovery StuckStateRecovery `json:"recovery,omitempty"`
+}
+
+// DrainSafePolicySpec defines tunables for nodes selected by the policy
+type DrainSafePolicySpec struct {
+	// NodeSelector selects nodes the policy applies to, all nodes if not set
+	// +optional
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+	// Priority of the policy, the highest priority policy selecting a node applies, ties are broken by name
+	// +optional
+	Priority int32 `json:"priority,omitempty"`
+	// EventActions action per scheduled event type, e.g. Freeze: CordonOnly, event types
+	// which are not specified keep the action from --event-policy
+	// +optional
+	EventActions map[string]EventAction `json:"eventActions,omitempty"`
+	// GracePeriodSeconds pod termination grace period per scheduled event type, e.g. Reboot: 840
+	// +optional
+	GracePeriodSeconds map[string]int32 `json:"gracePeriodSeconds,omitempty"`
+	// RequeueAfter how long the drainsafe controller waits before retrying a failed step
+	// or checking repairman approval again, 1m if not set
+	// +optional
+	RequeueAfter *metav1.Duration `json:"requeueAfter,omitempty"`
+	// ScheduledEventRequeueAfter how long the scheduled event controller waits before
+	// retrying approval of scheduled events, 30s if not set
+	// +optional
+	ScheduledEventRequeueAfter *metav1.Duration `json:"scheduledEventRequeueAfter,omitempty"`
+	// DrainTimeout how long a drain may run before it is aborted and retried, still bounded
+	// by the NotBefore of the scheduled event, 30m if not set
+	// +optional
+	DrainTimeout *metav1.Duration `json:"drainTimeout,omitempty"`
+	// Drain flags used when draining a node
+	// +optional
+	Drain DrainSpec `json:"drain,omitempty"`
+	// Hooks run around maintenance
+	// +optional
+	Hooks HooksSpec `json:"hooks,omitempty"`
+	// HealthGate checks nodes have to pass after maintenance before they are uncordoned
+	// +optional
+	HealthGate HealthGateSpec `json:"healthGate,omitempty"`
+	// StuckState detection and recovery of nodes stuck in a maintenance state
+	// +optional
+	StuckState StuckStateSpec `json:"stuckState,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster,shortName=dsp
+// +kubebuilder:printcolumn:name="Priority",type="integer",JSONPath=".spec.priority"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// DrainSafePolicy is the Schema for the drainsafepolicies API
+type DrainSafePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec DrainSafePolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// DrainSafePolicyList contains a list of DrainSafePolicy
+type DrainSafePolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DrainSafePolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DrainSafePolicy{}, &DrainSafePolicyList{})
+}
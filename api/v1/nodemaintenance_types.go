@@ -0,0 +1,189 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NodeMaintenanceConditionType condition reached during maintenance
+type NodeMaintenanceConditionType string
+
+const (
+	// MaintenanceApprovedCondition maintenance is approved by drainsafe or repairman
+	MaintenanceApprovedCondition NodeMaintenanceConditionType = "Approved"
+	// NodeCordonedCondition workload scheduling is disabled on node
+	NodeCordonedCondition NodeMaintenanceConditionType = "Cordoned"
+	// DisruptionBlockedCondition pod disruption budgets refuse eviction of pods on node
+	DisruptionBlockedCondition NodeMaintenanceConditionType = "DisruptionBlocked"
+	// NodeDrainedCondition workload is drained from node
+	NodeDrainedCondition NodeMaintenanceConditionType = "Drained"
+	// MaintenanceStartedCondition scheduled event is approved on azure
+	MaintenanceStartedCondition NodeMaintenanceConditionType = "Started"
+	// MaintenanceCompletedCondition node is running after maintenance
+	MaintenanceCompletedCondition NodeMaintenanceConditionType = "Completed"
+)
+
+// NodeMaintenanceSpec defines the scheduled maintenance of a node
+type NodeMaintenanceSpec struct {
+	// NodeName of the node under maintenance
+	NodeName string `json:"nodeName"`
+	// EventID of the azure scheduled event
+	// +optional
+	EventID string `json:"eventId,omitempty"`
+	// EventType of the azure scheduled event, e.g. Reboot, Redeploy
+	// +optional
+	EventType string `json:"eventType,omitempty"`
+	// Deadline after which azure starts the scheduled event, NotBefore of the scheduled event
+	// +optional
+	Deadline *metav1.Time `json:"deadline,omitempty"`
+}
+
+// NodeMaintenanceCondition describes a condition reached during maintenance
+type NodeMaintenanceCondition struct {
+	// Type of the condition
+	Type NodeMaintenanceConditionType `json:"type"`
+	// Status of the condition, one of True, False, Unknown
+	Status corev1.ConditionStatus `json:"status"`
+	// LastTransitionTime the condition changed status
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// Reason for the last transition
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// Message with details about the last transition
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// StateTransition records when a maintenance phase was entered
+type StateTransition struct {
+	// Phase entered, one of the drainsafe.azure.com/maintenancestate values
+	Phase string `json:"phase"`
+	// Time the phase was entered
+	Time metav1.Time `json:"time"`
+}
+
+// DrainResult describes the outcome of draining the node
+type DrainResult struct {
+	// StartTime of the drain
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// CompletionTime of the drain
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Succeeded is true if all pods were evicted
+	// +optional
+	Succeeded bool `json:"succeeded,omitempty"`
+	// Message with drain outcome or error
+	// +optional
+	Message string `json:"message,omitempty"`
+	// EvictedPods namespace/name of evicted pods
+	// +optional
+	EvictedPods []string `json:"evictedPods,omitempty"`
+}
+
+// MaintenanceRecord describes a past maintenance of the node
+type MaintenanceRecord struct {
+	// EventID of the azure scheduled event
+	// +optional
+	EventID string `json:"eventId,omitempty"`
+	// EventType of the azure scheduled event, e.g. Reboot, Redeploy
+	// +optional
+	EventType string `json:"eventType,omitempty"`
+	// Deadline after which azure started the scheduled event, NotBefore of the scheduled event
+	// +optional
+	Deadline *metav1.Time `json:"deadline,omitempty"`
+	// Approver of the maintenance, Drainsafe, Repairman or ExpressDrain
+	// +optional
+	Approver string `json:"approver,omitempty"`
+	// Phase last phase the maintenance reached
+	// +optional
+	Phase string `json:"phase,omitempty"`
+	// Transitions phases entered during the maintenance, oldest first
+	// +optional
+	Transitions []StateTransition `json:"transitions,omitempty"`
+	// Drain outcome of draining the node
+	// +optional
+	Drain *DrainResult `json:"drain,omitempty"`
+}
+
+// NodeMaintenanceStatus defines the observed state of maintenance
+type NodeMaintenanceStatus struct {
+	// Phase current maintenance phase, mirrors drainsafe.azure.com/maintenancestate node annotation
+	// +optional
+	Phase string `json:"phase,omitempty"`
+	// Approver of the maintenance, Drainsafe, Repairman or ExpressDrain
+	// +optional
+	Approver string `json:"approver,omitempty"`
+	// Conditions reached during maintenance
+	// +optional
+	Conditions []NodeMaintenanceCondition `json:"conditions,omitempty"`
+	// Transitions phases entered during maintenance, oldest first
+	// +optional
+	Transitions []StateTransition `json:"transitions,omitempty"`
+	// Drain outcome of draining the node
+	// +optional
+	Drain *DrainResult `json:"drain,omitempty"`
+	// History past maintenances of the node, oldest first, bounded in length
+	// +optional
+	History []MaintenanceRecord `json:"history,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster,shortName=nm
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase"
+// +kubebuilder:printcolumn:name="Type",type="string",JSONPath=".spec.eventType"
+// +kubebuilder:printcolumn:name="Deadline",type="date",JSONPath=".spec.deadline"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// NodeMaintenance is the Schema for the nodemaintenances API, named after the node. It is a
+// read only status mirror of the node maintenance annotations, edits are overwritten
+type NodeMaintenance struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NodeMaintenanceSpec   `json:"spec,omitempty"`
+	Status NodeMaintenanceStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// NodeMaintenanceList contains a list of NodeMaintenance
+type NodeMaintenanceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NodeMaintenance `json:"items"`
+}
+
+// GetCondition returns condition of type, nil if not set
+func (s *NodeMaintenanceStatus) GetCondition(conditionType NodeMaintenanceConditionType) *NodeMaintenanceCondition {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == conditionType {
+			return &s.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition sets condition, LastTransitionTime is only updated if status changed
+func (s *NodeMaintenanceStatus) SetCondition(condition NodeMaintenanceCondition) {
+	existing := s.GetCondition(condition.Type)
+	if existing == nil {
+		s.Conditions = append(s.Conditions, condition)
+		return
+	}
+	if existing.Status != condition.Status {
+		existing.LastTransitionTime = condition.LastTransitionTime
+	}
+	existing.Status = condition.Status
+	existing.Reason = condition.Reason
+	existing.Message = condition.Message
+}
+
+func init() {
+	SchemeBuilder.Register(&NodeMaintenance{}, &NodeMaintenanceList{})
+}
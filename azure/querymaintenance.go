@@ -6,10 +6,16 @@ package azure
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/awesomenix/drainsafe/metrics"
+	"github.com/awesomenix/drainsafe/policy"
 	"github.com/pkg/errors"
 
 	"github.com/go-logr/logr"
@@ -26,29 +32,108 @@ type Query interface {
 	Get(url string) (string, error)
 }
 
-type query struct{}
+const (
+	// DefaultEndpoint azure instance metadata service endpoint
+	DefaultEndpoint string = "http://169.254.169.254"
+	// DefaultAPIVersion scheduled events api version, the first one reporting DurationInSeconds
+	DefaultAPIVersion string = "2020-07-01"
+	// DefaultTimeout for each instance metadata service request
+	DefaultTimeout time.Duration = 10 * time.Second
+
+	instanceAPIVersion string = "2019-06-01"
+)
+
+type query struct {
+	client *http.Client
+}
 
 // Client query maintenance client
 type Client struct {
-	q Query
+	q          Query
+	endpoint   string
+	apiVersion string
+	timeout    time.Duration
+	transport  http.RoundTripper
+	policy     policy.EventPolicy
+
+	mu sync.Mutex
+	// incarnation DocumentIncarnation of the scheduled events document last returned by Changed
+	incarnation int
+}
+
+// Option configures query maintenance client
+type Option func(*Client)
+
+// WithEndpoint overrides instance metadata service endpoint, e.g. a local proxy or simulator
+func WithEndpoint(endpoint string) Option {
+	return func(c *Client) {
+		c.endpoint = strings.TrimSuffix(endpoint, "/")
+	}
+}
+
+// WithAPIVersion overrides scheduled events api version
+func WithAPIVersion(apiVersion string) Option {
+	return func(c *Client) {
+		c.apiVersion = apiVersion
+	}
+}
+
+// WithTimeout overrides timeout for each instance metadata service request
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithTransport overrides http transport used for instance metadata service requests
+func WithTransport(transport http.RoundTripper) Option {
+	return func(c *Client) {
+		c.transport = transport
+	}
+}
+
+// WithEventPolicy overrides which scheduled event types are tracked, event types mapped to Ignore are skipped
+func WithEventPolicy(p policy.EventPolicy) Option {
+	return func(c *Client) {
+		c.policy = p
+	}
 }
 
 // New create query maintenance client
-func New() *Client {
-	return &Client{
-		q: &query{},
+func New(opts ...Option) *Client {
+	c := newClient(opts...)
+	c.q = &query{
+		client: &http.Client{
+			Timeout:   c.timeout,
+			Transport: c.transport,
+		},
 	}
+	return c
 }
 
 // NewWithQuery create query maintenance client with query override
-func NewWithQuery(q Query) *Client {
-	return &Client{
-		q: q,
+func NewWithQuery(q Query, opts ...Option) *Client {
+	c := newClient(opts...)
+	c.q = q
+	return c
+}
+
+func newClient(opts ...Option) *Client {
+	c := &Client{
+		endpoint:   DefaultEndpoint,
+		apiVersion: DefaultAPIVersion,
+		timeout:    DefaultTimeout,
+		policy:     policy.DefaultEventPolicy(),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 // Post url with body
-func (c *query) Post(url string, body []byte) error {
+func (c *query) Post(url string, body []byte) (err error) {
+	defer observe(http.MethodPost, url, time.Now(), &err)
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
 	if err != nil {
 		return err
@@ -56,7 +141,7 @@ func (c *query) Post(url string, body []byte) error {
 	req.Header = http.Header{
 		"Metadata": {"true"},
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.client.Do(req)
 	if err != nil {
 		log.Error(err, "failed to vm instance name")
 		return err
@@ -71,7 +156,8 @@ func (c *query) Post(url string, body []byte) error {
 }
 
 // Get url
-func (c *query) Get(url string) (string, error) {
+func (c *query) Get(url string) (_ string, err error) {
+	defer observe(http.MethodGet, url, time.Now(), &err)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return "", err
@@ -79,7 +165,7 @@ func (c *query) Get(url string) (string, error) {
 	req.Header = http.Header{
 		"Metadata": {"true"},
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.client.Do(req)
 	if err != nil {
 		log.Error(err, "failed to vm instance name")
 		return "", err
@@ -100,10 +186,34 @@ func (c *query) Get(url string) (string, error) {
 	return string(body), nil
 }
 
+// observe records latency of an instance metadata service request and counts it as failed if err is set
+func observe(method, rawURL string, start time.Time, err *error) {
+	path := rawURL
+	if u, parseErr := url.Parse(rawURL); parseErr == nil {
+		path = u.Path
+	}
+	metrics.IMDSRequestDuration.WithLabelValues(method, path).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		metrics.IMDSRequestErrors.WithLabelValues(method, path).Inc()
+	}
+}
+
 // GetVMInstanceName gets current vmss/availability set instance name
 func (c *Client) GetVMInstanceName() (string, error) {
 	// curl -H Metadata:true "http://169.254.169.254/metadata/instance/compute/name?api-version=2019-06-01&format=text"
-	return c.q.Get("http://169.254.169.254/metadata/instance/compute/name?api-version=2019-06-01&format=text")
+	return c.q.Get(fmt.Sprintf("%s/metadata/instance/compute/name?api-version=%s&format=text", c.endpoint, instanceAPIVersion))
+}
+
+// GetPlatformFaultDomain gets fault domain the current vm runs in
+func (c *Client) GetPlatformFaultDomain() (string, error) {
+	// curl -H Metadata:true "http://169.254.169.254/metadata/instance/compute/platformFaultDomain?api-version=2019-06-01&format=text"
+	return c.q.Get(fmt.Sprintf("%s/metadata/instance/compute/platformFaultDomain?api-version=%s&format=text", c.endpoint, instanceAPIVersion))
+}
+
+// GetPlatformUpdateDomain gets update domain the current vm runs in
+func (c *Client) GetPlatformUpdateDomain() (string, error) {
+	// curl -H Metadata:true "http://169.254.169.254/metadata/instance/compute/platformUpdateDomain?api-version=2019-06-01&format=text"
+	return c.q.Get(fmt.Sprintf("%s/metadata/instance/compute/platformUpdateDomain?api-version=%s&format=text", c.endpoint, instanceAPIVersion))
 }
 
 // {
@@ -117,19 +227,25 @@ func (c *Client) GetVMInstanceName() (string, error) {
 //       "Resources": [
 //         "controlplane_0"
 //       ],
-//       "NotBefore": "Sun, 30 Jun 2019 16:22:03 GMT"
+//       "NotBefore": "Sun, 30 Jun 2019 16:22:03 GMT",
+//       "Description": "Host server is undergoing maintenance.",
+//       "EventSource": "Platform",
+//       "DurationInSeconds": 600
 //     }
 //   ]
 // }
 
 // ScheduledEvent signifies each scheduled event
 type ScheduledEvent struct {
-	EventId      string   `json:"EventId"`
-	EventStatus  string   `json:"EventStatus"`
-	EventType    string   `json:"EventType"`
-	ResourceType string   `json:"ResourceType"`
-	Resources    []string `json:"Resources"`
-	NotBefore    string   `json:"NotBefore"`
+	EventId           string   `json:"EventId"`
+	EventStatus       string   `json:"EventStatus"`
+	EventType         string   `json:"EventType"`
+	ResourceType      string   `json:"ResourceType"`
+	Resources         []string `json:"Resources"`
+	NotBefore         string   `json:"NotBefore"`
+	Description       string   `json:"Description,omitempty"`
+	EventSource       string   `json:"EventSource,omitempty"`
+	DurationInSeconds int      `json:"DurationInSeconds,omitempty"`
 }
 
 // ScheduledEventList list of scheduled events
@@ -138,9 +254,14 @@ type ScheduledEventList struct {
 	Events              []ScheduledEvent `json:"Events"`
 }
 
+// ParseNotBefore parses scheduled event NotBefore, which is in RFC1123 format
+func ParseNotBefore(notBefore string) (time.Time, error) {
+	return time.Parse(time.RFC1123, notBefore)
+}
+
 func (c *Client) getScheduledEventList() (*ScheduledEventList, error) {
-	// curl -H Metadata:true "http://169.254.169.254/metadata/scheduledevents?api-version=2019-08-01"
-	body, err := c.q.Get("http://169.254.169.254/metadata/scheduledevents?api-version=2019-08-01")
+	// curl -H Metadata:true "http://169.254.169.254/metadata/scheduledevents?api-version=2020-07-01"
+	body, err := c.q.Get(c.scheduledEventsURL())
 	if err != nil {
 		log.Error(err, "failed to get scheduled events")
 		return nil, err
@@ -151,54 +272,96 @@ func (c *Client) getScheduledEventList() (*ScheduledEventList, error) {
 		log.Error(err, "failed to unmarshal body")
 		return nil, err
 	}
-
 	return result, nil
 }
 
-// IsScheduledEvent check if event is scheduled and returns the scheduled event, else nil
-func (c *Client) IsScheduledEvent(vmInstanceName string) (string, error) {
+// EventPolicy returns event policy deciding which scheduled event types are tracked
+func (c *Client) EventPolicy() policy.EventPolicy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.policy
+}
+
+// SetEventPolicy replaces event policy, e.g. when the DrainSafePolicy of the node changed
+func (c *Client) SetEventPolicy(p policy.EventPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policy = p
+}
+
+// Changed returns the scheduled events document and whether its DocumentIncarnation changed
+// since the last call, the first call always reports a change
+func (c *Client) Changed() (*ScheduledEventList, bool, error) {
 	result, err := c.getScheduledEventList()
 	if err != nil {
-		return "", err
+		return nil, false, err
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := result.DocumentIncarnation != c.incarnation
+	c.incarnation = result.DocumentIncarnation
+	return result, changed, nil
+}
+
+// ScheduledEvents returns all events scheduled on the virtual machine which are not ignored by event policy
+func (c *Client) ScheduledEvents(vmInstanceName string) ([]ScheduledEvent, error) {
+	result, err := c.getScheduledEventList()
+	if err != nil {
+		return nil, err
+	}
+	return c.VMScheduledEvents(result, vmInstanceName), nil
+}
 
+// VMScheduledEvents returns events of result scheduled on the virtual machine which are not ignored by event policy
+func (c *Client) VMScheduledEvents(result *ScheduledEventList, vmInstanceName string) []ScheduledEvent {
+	eventPolicy := c.EventPolicy()
+	events := []ScheduledEvent{}
 	for _, event := range result.Events {
 		if isScheduled(&event) &&
-			isDisruptive(&event) &&
+			eventPolicy.ActionFor(event.EventType) != policy.Ignore &&
 			isVMScheduled(&event, vmInstanceName) {
-			return event.EventType, nil
+			events = append(events, event)
 		}
 	}
-
-	return "", nil
+	return events
 }
 
-// ApproveScheduledEvent approves scheduled event
-func (c *Client) ApproveScheduledEvent(vmInstanceName string) error {
-	result, err := c.getScheduledEventList()
+// IsScheduledEvent check if event is scheduled and returns the most disruptive scheduled event, else nil
+func (c *Client) IsScheduledEvent(vmInstanceName string) (*ScheduledEvent, error) {
+	events, err := c.ScheduledEvents(vmInstanceName)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return MostDisruptive(events), nil
+}
 
-	for _, event := range result.Events {
-		if isScheduled(&event) &&
-			isDisruptive(&event) &&
-			isVMScheduled(&event, vmInstanceName) {
-			return c.approveEvent(&event)
-		}
+// ApproveScheduledEvents approves all events scheduled on the virtual machine
+// in a single request and returns the approved events
+func (c *Client) ApproveScheduledEvents(vmInstanceName string) ([]ScheduledEvent, error) {
+	events, err := c.ScheduledEvents(vmInstanceName)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return events, nil
 	}
 
-	return nil
+	if err := c.approveEvents(events); err != nil {
+		return nil, err
+	}
+	return events, nil
 }
 
-func (c *Client) approveEvent(event *ScheduledEvent) error {
-	// curl -H Metadata:true -X POST -d '{"StartRequests": [{"EventId": "F3E6E2D2-E86A-47F0-AA8E-18918049A2B1"}]}' http://169.254.169.254/metadata/scheduledevents?api-version=2019-08-01
+func (c *Client) approveEvents(events []ScheduledEvent) error {
+	// curl -H Metadata:true -X POST -d '{"StartRequests": [{"EventId": "F3E6E2D2-E86A-47F0-AA8E-18918049A2B1"}]}' http://169.254.169.254/metadata/scheduledevents?api-version=2020-07-01
+	startRequests := []map[string]string{}
+	for _, event := range events {
+		startRequests = append(startRequests, map[string]string{
+			"EventId": event.EventId,
+		})
+	}
 	message := map[string]interface{}{
-		"StartRequests": []map[string]string{
-			{
-				"EventId": event.EventId,
-			},
-		},
+		"StartRequests": startRequests,
 	}
 
 	body, err := json.Marshal(message)
@@ -207,17 +370,72 @@ func (c *Client) approveEvent(event *ScheduledEvent) error {
 		return err
 	}
 
-	return c.q.Post("http://169.254.169.254/metadata/scheduledevents?api-version=2019-08-01", body)
+	return c.q.Post(c.scheduledEventsURL(), body)
+}
+
+func (c *Client) scheduledEventsURL() string {
+	return fmt.Sprintf("%s/metadata/scheduledevents?api-version=%s", c.endpoint, c.apiVersion)
 }
 
-func isDisruptive(event *ScheduledEvent) bool {
-	if strings.EqualFold(event.EventType, "Reboot") ||
-		strings.EqualFold(event.EventType, "Redeploy") ||
-		strings.EqualFold(event.EventType, "Preempt") ||
-		strings.EqualFold(event.EventType, "Terminate") {
-		return true
+// MostDisruptive returns the most disruptive event, the one with earliest NotBefore
+// if several are equally disruptive, nil if there are no events
+func MostDisruptive(events []ScheduledEvent) *ScheduledEvent {
+	var result *ScheduledEvent
+	for i := range events {
+		event := &events[i]
+		if result == nil {
+			result = event
+			continue
+		}
+		if disruption(event) != disruption(result) {
+			if disruption(event) > disruption(result) {
+				result = event
+			}
+			continue
+		}
+		notBefore, err := ParseNotBefore(event.NotBefore)
+		if err != nil {
+			continue
+		}
+		resultNotBefore, err := ParseNotBefore(result.NotBefore)
+		if err != nil || notBefore.Before(resultNotBefore) {
+			result = event
+		}
 	}
-	return false
+	return result
+}
+
+// EarliestNotBefore returns the earliest NotBefore among events, empty if none can be parsed
+func EarliestNotBefore(events []ScheduledEvent) string {
+	earliest := ""
+	var earliestTime time.Time
+	for _, event := range events {
+		notBefore, err := ParseNotBefore(event.NotBefore)
+		if err != nil {
+			continue
+		}
+		if earliest == "" || notBefore.Before(earliestTime) {
+			earliest = event.NotBefore
+			earliestTime = notBefore
+		}
+	}
+	return earliest
+}
+
+func disruption(event *ScheduledEvent) int {
+	switch strings.ToLower(event.EventType) {
+	case "terminate":
+		return 5
+	case "preempt":
+		return 4
+	case "redeploy":
+		return 3
+	case "reboot":
+		return 2
+	case "freeze":
+		return 1
+	}
+	return 0
 }
 
 func isScheduled(event *ScheduledEvent) bool {
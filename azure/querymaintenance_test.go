@@ -3,11 +3,17 @@
 package azure_test
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/awesomenix/drainsafe/azure"
+	"github.com/awesomenix/drainsafe/azure/simulator"
+	"github.com/awesomenix/drainsafe/policy"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -23,7 +29,10 @@ const (
 			"Resources": [
 				"controlplane_0"
 			],
-			"NotBefore": "Sun, 30 Jun 2019 16:22:03 GMT"
+			"NotBefore": "Sun, 30 Jun 2019 16:22:03 GMT",
+			"Description": "Host server is undergoing maintenance.",
+			"EventSource": "Platform",
+			"DurationInSeconds": 600
 			}
 		]
 	}`
@@ -33,13 +42,16 @@ type testQuery struct {
 	getErr  error
 	postErr error
 	get     string
+	urls    []string
 }
 
 func (q *testQuery) Post(url string, body []byte) error {
+	q.urls = append(q.urls, url)
 	return q.postErr
 }
 
 func (q *testQuery) Get(url string) (string, error) {
+	q.urls = append(q.urls, url)
 	return q.get, q.getErr
 }
 
@@ -62,25 +74,187 @@ func TestIsScheduledEvent(t *testing.T) {
 	c := azure.NewWithQuery(tQuery)
 
 	isScheduled, err := c.IsScheduledEvent("dummyinstancename")
-	assert.Empty(isScheduled)
+	assert.Nil(isScheduled)
 	assert.Nil(err)
 	isScheduled, err = c.IsScheduledEvent("controlplane_0")
-	assert.Equal(isScheduled, "Reboot")
 	assert.Nil(err)
+	assert.Equal(&azure.ScheduledEvent{
+		EventId:           "F3E6E2D2-E86A-47F0-AA8E-18918049A2B1",
+		EventStatus:       "Scheduled",
+		EventType:         "Reboot",
+		ResourceType:      "VirtualMachine",
+		Resources:         []string{"controlplane_0"},
+		NotBefore:         "Sun, 30 Jun 2019 16:22:03 GMT",
+		Description:       "Host server is undergoing maintenance.",
+		EventSource:       "Platform",
+		DurationInSeconds: 600,
+	}, isScheduled)
 
 	tQuery.get = "{malformedurl"
 	_, err = c.IsScheduledEvent("controlplane_0")
 	assert.NotNil(err)
 }
 
-func TestApproveScheduledEvent(t *testing.T) {
+func TestApproveScheduledEvents(t *testing.T) {
 	assert := assert.New(t)
 	tQuery := &testQuery{get: scheduledevent, postErr: errors.New("dummy")}
 	c := azure.NewWithQuery(tQuery)
 
-	err := c.ApproveScheduledEvent("dummyinstancename")
+	approved, err := c.ApproveScheduledEvents("dummyinstancename")
 	assert.Nil(err)
+	assert.Empty(approved)
 
-	err = c.ApproveScheduledEvent("controlplane_0")
+	_, err = c.ApproveScheduledEvents("controlplane_0")
 	assert.NotNil(err)
 }
+
+func TestMultipleScheduledEvents(t *testing.T) {
+	assert := assert.New(t)
+	s := simulator.New("controlplane_0")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	c := azure.New(azure.WithEndpoint(ts.URL))
+
+	reboot := s.AddEvent(azure.ScheduledEvent{EventType: "Reboot", NotBefore: "Sun, 30 Jun 2019 16:30:00 GMT"})
+	earlyReboot := s.AddEvent(azure.ScheduledEvent{EventType: "Reboot", NotBefore: "Sun, 30 Jun 2019 16:20:00 GMT"})
+	s.AddEvent(azure.ScheduledEvent{EventType: "Reboot", Resources: []string{"controlplane_1"}})
+
+	events, err := c.ScheduledEvents("controlplane_0")
+	assert.Nil(err)
+	assert.Len(events, 2)
+	assert.Equal(earlyReboot, azure.MostDisruptive(events).EventId)
+	assert.Nil(azure.MostDisruptive(nil))
+
+	redeploy := s.AddEvent(azure.ScheduledEvent{EventType: "Redeploy", NotBefore: "Sun, 30 Jun 2019 16:40:00 GMT"})
+	events, err = c.ScheduledEvents("controlplane_0")
+	assert.Nil(err)
+	assert.Len(events, 3)
+	assert.Equal(redeploy, azure.MostDisruptive(events).EventId)
+	assert.Equal("Sun, 30 Jun 2019 16:20:00 GMT", azure.EarliestNotBefore(events))
+
+	approved, err := c.ApproveScheduledEvents("controlplane_0")
+	assert.Nil(err)
+	assert.Len(approved, 3)
+	assert.Equal([]string{reboot, earlyReboot, redeploy}, s.Approved())
+	events, err = c.ScheduledEvents("controlplane_0")
+	assert.Nil(err)
+	assert.Empty(events)
+}
+
+func TestOptions(t *testing.T) {
+	assert := assert.New(t)
+	tQuery := &testQuery{get: scheduledevent}
+	c := azure.NewWithQuery(tQuery,
+		azure.WithEndpoint("http://127.0.0.1:8090/"),
+		azure.WithAPIVersion("2019-08-01"))
+
+	_, err := c.GetVMInstanceName()
+	assert.Nil(err)
+	_, err = c.ApproveScheduledEvents("controlplane_0")
+	assert.Nil(err)
+	assert.Equal([]string{
+		"http://127.0.0.1:8090/metadata/instance/compute/name?api-version=2019-06-01&format=text",
+		"http://127.0.0.1:8090/metadata/scheduledevents?api-version=2019-08-01",
+		"http://127.0.0.1:8090/metadata/scheduledevents?api-version=2019-08-01",
+	}, tQuery.urls)
+}
+
+func TestSimulator(t *testing.T) {
+	assert := assert.New(t)
+	s := simulator.New("controlplane_0")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	c := azure.New(azure.WithEndpoint(ts.URL))
+
+	vmName, err := c.GetVMInstanceName()
+	assert.Nil(err)
+	assert.Equal("controlplane_0", vmName)
+	faultDomain, err := c.GetPlatformFaultDomain()
+	assert.Nil(err)
+	assert.Equal("0", faultDomain)
+	s.SetPlatformDomains("0", "3")
+	updateDomain, err := c.GetPlatformUpdateDomain()
+	assert.Nil(err)
+	assert.Equal("3", updateDomain)
+
+	eventID := s.AddEvent(azure.ScheduledEvent{EventType: "Redeploy"})
+	event, err := c.IsScheduledEvent(vmName)
+	assert.Nil(err)
+	assert.Equal("Redeploy", event.EventType)
+	assert.Equal(eventID, event.EventId)
+
+	_, err = c.ApproveScheduledEvents(vmName)
+	assert.Nil(err)
+	assert.Equal([]string{eventID}, s.Approved())
+	event, err = c.IsScheduledEvent(vmName)
+	assert.Nil(err)
+	assert.Nil(event)
+}
+
+func TestTimeout(t *testing.T) {
+	assert := assert.New(t)
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	c := azure.New(azure.WithEndpoint(ts.URL), azure.WithTimeout(100*time.Millisecond))
+	_, err := c.GetVMInstanceName()
+	assert.NotNil(err)
+}
+
+func TestChanged(t *testing.T) {
+	assert := assert.New(t)
+	tQuery := &testQuery{get: scheduledevent}
+	c := azure.NewWithQuery(tQuery)
+
+	result, changed, err := c.Changed()
+	assert.Nil(err)
+	assert.True(changed)
+	assert.Equal(1, result.DocumentIncarnation)
+	events := c.VMScheduledEvents(result, "controlplane_0")
+	assert.Len(events, 1)
+	assert.Equal("F3E6E2D2-E86A-47F0-AA8E-18918049A2B1", events[0].EventId)
+	assert.Empty(c.VMScheduledEvents(result, "dummyinstancename"))
+
+	_, changed, err = c.Changed()
+	assert.Nil(err)
+	assert.False(changed)
+
+	// other requests of the document do not count as seen
+	_, err = c.ScheduledEvents("controlplane_0")
+	assert.Nil(err)
+	tQuery.get = strings.Replace(scheduledevent, `"DocumentIncarnation": 1`, `"DocumentIncarnation": 2`, 1)
+	_, err = c.ScheduledEvents("controlplane_0")
+	assert.Nil(err)
+	result, changed, err = c.Changed()
+	assert.Nil(err)
+	assert.True(changed)
+	assert.Equal(2, result.DocumentIncarnation)
+
+	tQuery.getErr = errors.New("dummyerror")
+	_, _, err = c.Changed()
+	assert.NotNil(err)
+}
+
+func TestEventPolicy(t *testing.T) {
+	assert := assert.New(t)
+	s := simulator.New("controlplane_0")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	s.AddEvent(azure.ScheduledEvent{EventType: "Freeze"})
+	c := azure.New(azure.WithEndpoint(ts.URL))
+	events, err := c.ScheduledEvents("controlplane_0")
+	assert.Nil(err)
+	assert.Empty(events)
+
+	p, err := policy.ParseEventPolicy("Freeze=CordonOnly")
+	assert.Nil(err)
+	c = azure.New(azure.WithEndpoint(ts.URL), azure.WithEventPolicy(p))
+	event, err := c.IsScheduledEvent("controlplane_0")
+	assert.Nil(err)
+	assert.Equal("Freeze", event.EventType)
+}
@@ -0,0 +1,368 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awesomenix/drainsafe/azure"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+var log logr.Logger = ctrl.Log.WithName("simulator")
+
+const (
+	// ComputeNamePath instance metadata path returning the vm instance name
+	ComputeNamePath string = "/metadata/instance/compute/name"
+	// PlatformFaultDomainPath instance metadata path returning the fault domain of the vm
+	PlatformFaultDomainPath string = "/metadata/instance/compute/platformFaultDomain"
+	// PlatformUpdateDomainPath instance metadata path returning the update domain of the vm
+	PlatformUpdateDomainPath string = "/metadata/instance/compute/platformUpdateDomain"
+	// ScheduledEventsPath instance metadata path serving scheduled events
+	ScheduledEventsPath string = "/metadata/scheduledevents"
+	// EventsPath simulator control path used to add and complete events
+	EventsPath string = "/simulator/events"
+
+	// Scheduled event status before it is started
+	Scheduled string = "Scheduled"
+	// Started event status once approved or after NotBefore has elapsed
+	Started string = "Started"
+)
+
+// Server simulates azure instance metadata service scheduled events for a single virtual machine
+type Server struct {
+	// StartedDuration how long an event stays in Started before it is removed by Advance,
+	// zero keeps started events until they are completed explicitly
+	StartedDuration time.Duration
+
+	mu           sync.Mutex
+	vmName       string
+	incarnation  int
+	sequence     int
+	events       []azure.ScheduledEvent
+	startedAt    map[string]time.Time
+	approved     []string
+	now          func() time.Time
+	faultDomain  string
+	updateDomain string
+}
+
+// New creates a simulator serving metadata for vmName
+func New(vmName string) *Server {
+	return &Server{
+		vmName:       vmName,
+		incarnation:  1,
+		faultDomain:  "0",
+		updateDomain: "0",
+		startedAt:    make(map[string]time.Time),
+		now:          time.Now,
+	}
+}
+
+// SetClock overrides the clock used for NotBefore and StartedDuration checks
+func (s *Server) SetClock(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// SetPlatformDomains sets platformFaultDomain and platformUpdateDomain of the simulated vm
+func (s *Server) SetPlatformDomains(faultDomain, updateDomain string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faultDomain = faultDomain
+	s.updateDomain = updateDomain
+}
+
+// VMName returns simulated vm instance name
+func (s *Server) VMName() string {
+	return s.vmName
+}
+
+// Incarnation returns current document incarnation
+func (s *Server) Incarnation() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.incarnation
+}
+
+// Events returns a copy of current events
+func (s *Server) Events() []azure.ScheduledEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.copyEvents()
+}
+
+// Approved returns event ids received through StartRequests, in order
+func (s *Server) Approved() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.approved...)
+}
+
+// AddEvent adds a scheduled event and returns its id, missing fields are defaulted
+// to a Scheduled Reboot of the simulated vm with NotBefore five minutes from now
+func (s *Server) AddEvent(event azure.ScheduledEvent) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sequence++
+	if event.EventId == "" {
+		event.EventId = fmt.Sprintf("00000000-0000-0000-0000-%012d", s.sequence)
+	}
+	if event.EventStatus == "" {
+		event.EventStatus = Scheduled
+	}
+	if event.EventType == "" {
+		event.EventType = "Reboot"
+	}
+	if event.ResourceType == "" {
+		event.ResourceType = "VirtualMachine"
+	}
+	if len(event.Resources) == 0 {
+		event.Resources = []string{s.vmName}
+	}
+	if event.NotBefore == "" && event.EventStatus == Scheduled {
+		event.NotBefore = s.now().Add(5 * time.Minute).UTC().Format(http.TimeFormat)
+	}
+	if event.EventStatus == Started {
+		s.startedAt[event.EventId] = s.now()
+	}
+	s.events = append(s.events, event)
+	s.incarnation++
+	log.Info("added event", "EventId", event.EventId, "EventType", event.EventType, "Incarnation", s.incarnation)
+	return event.EventId
+}
+
+// StartEvent moves a scheduled event to Started
+func (s *Server) StartEvent(eventID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.startEvent(eventID)
+}
+
+// CompleteEvent removes an event, as azure does once maintenance is over
+func (s *Server) CompleteEvent(eventID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.events {
+		if s.events[i].EventId == eventID {
+			s.events = append(s.events[:i], s.events[i+1:]...)
+			delete(s.startedAt, eventID)
+			s.incarnation++
+			log.Info("completed event", "EventId", eventID, "Incarnation", s.incarnation)
+			return nil
+		}
+	}
+	return errors.Errorf("event %s not found", eventID)
+}
+
+// Advance starts scheduled events whose NotBefore has elapsed and removes
+// events which have been started for longer than StartedDuration
+func (s *Server) Advance() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for _, event := range s.copyEvents() {
+		if event.EventStatus == Scheduled {
+			notBefore, err := azure.ParseNotBefore(event.NotBefore)
+			if err == nil && !now.Before(notBefore) {
+				s.startEvent(event.EventId)
+			}
+			continue
+		}
+		if s.StartedDuration > 0 &&
+			now.Sub(s.startedAt[event.EventId]) >= s.StartedDuration {
+			for i := range s.events {
+				if s.events[i].EventId == event.EventId {
+					s.events = append(s.events[:i], s.events[i+1:]...)
+					break
+				}
+			}
+			delete(s.startedAt, event.EventId)
+			s.incarnation++
+			log.Info("completed event", "EventId", event.EventId, "Incarnation", s.incarnation)
+		}
+	}
+}
+
+// Run calls Advance every interval until stopCh is closed
+func (s *Server) Run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Advance()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (s *Server) startEvent(eventID string) error {
+	i := s.findEvent(eventID)
+	if i < 0 {
+		return errors.Errorf("event %s not found", eventID)
+	}
+	if s.events[i].EventStatus == Started {
+		return nil
+	}
+	s.events[i].EventStatus = Started
+	s.events[i].NotBefore = ""
+	s.startedAt[eventID] = s.now()
+	s.incarnation++
+	log.Info("started event", "EventId", eventID, "Incarnation", s.incarnation)
+	return nil
+}
+
+// findEvent returns the index of the event with eventID, -1 if there is none
+func (s *Server) findEvent(eventID string) int {
+	for i := range s.events {
+		if s.events[i].EventId == eventID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Server) copyEvents() []azure.ScheduledEvent {
+	events := make([]azure.ScheduledEvent, 0, len(s.events))
+	for _, event := range s.events {
+		event.Resources = append([]string{}, event.Resources...)
+		events = append(events, event)
+	}
+	return events
+}
+
+// ServeHTTP serves instance metadata and simulator control requests
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, EventsPath) {
+		s.serveEvents(w, r)
+		return
+	}
+
+	if r.Header.Get("Metadata") != "true" {
+		http.Error(w, "Required metadata header not specified", http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("api-version") == "" {
+		http.Error(w, "Bad request. api-version was not specified in the request", http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Path {
+	case ComputeNamePath, PlatformFaultDomainPath, PlatformUpdateDomainPath:
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprint(w, s.compute(r.URL.Path))
+	case ScheduledEventsPath:
+		s.serveScheduledEvents(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// compute returns the text value of compute metadata path
+func (s *Server) compute(path string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch path {
+	case PlatformFaultDomainPath:
+		return s.faultDomain
+	case PlatformUpdateDomainPath:
+		return s.updateDomain
+	}
+	return s.vmName
+}
+
+func (s *Server) serveScheduledEvents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		result := azure.ScheduledEventList{
+			DocumentIncarnation: s.incarnation,
+			Events:              s.copyEvents(),
+		}
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		message := struct {
+			StartRequests []struct {
+				EventId string `json:"EventId"`
+			} `json:"StartRequests"`
+		}{}
+		if err := json.Unmarshal(body, &message); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// like IMDS, unknown event ids reject the whole request without starting any event
+		for _, request := range message.StartRequests {
+			if s.findEvent(request.EventId) < 0 {
+				http.Error(w, errors.Errorf("event %s not found", request.EventId).Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, request := range message.StartRequests {
+			s.startEvent(request.EventId)
+			s.approved = append(s.approved, request.EventId)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveEvents lets scripts drive the simulator over http
+//
+//	GET    /simulator/events       lists events
+//	POST   /simulator/events       adds the json encoded event in the body
+//	POST   /simulator/events/{id}  starts the event
+//	DELETE /simulator/events/{id}  completes the event
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	eventID := strings.Trim(strings.TrimPrefix(r.URL.Path, EventsPath), "/")
+	var err error
+	switch {
+	case eventID == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Events())
+		return
+	case eventID == "" && r.Method == http.MethodPost:
+		event := azure.ScheduledEvent{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, s.AddEvent(event))
+		return
+	case eventID != "" && r.Method == http.MethodPost:
+		err = s.StartEvent(eventID)
+	case eventID != "" && r.Method == http.MethodDelete:
+		err = s.CompleteEvent(eventID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
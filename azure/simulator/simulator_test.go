@@ -0,0 +1,191 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package simulator_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/awesomenix/drainsafe/azure"
+	"github.com/awesomenix/drainsafe/azure/simulator"
+	"github.com/stretchr/testify/assert"
+)
+
+func get(assert *assert.Assertions, url string) (int, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	assert.Nil(err)
+	req.Header.Set("Metadata", "true")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(err)
+	return resp.StatusCode, string(body)
+}
+
+func getEvents(assert *assert.Assertions, url string) *azure.ScheduledEventList {
+	code, body := get(assert, url+simulator.ScheduledEventsPath+"?api-version=2019-08-01")
+	assert.Equal(http.StatusOK, code)
+	result := &azure.ScheduledEventList{}
+	assert.Nil(json.Unmarshal([]byte(body), result))
+	return result
+}
+
+func TestComputeName(t *testing.T) {
+	assert := assert.New(t)
+	ts := httptest.NewServer(simulator.New("controlplane_0"))
+	defer ts.Close()
+
+	code, body := get(assert, ts.URL+simulator.ComputeNamePath+"?api-version=2019-06-01&format=text")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("controlplane_0", body)
+
+	code, _ = get(assert, ts.URL+simulator.ComputeNamePath)
+	assert.Equal(http.StatusBadRequest, code)
+
+	resp, err := http.Get(ts.URL + simulator.ComputeNamePath + "?api-version=2019-06-01&format=text")
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPlatformDomains(t *testing.T) {
+	assert := assert.New(t)
+	s := simulator.New("controlplane_0")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	code, body := get(assert, ts.URL+simulator.PlatformFaultDomainPath+"?api-version=2019-06-01&format=text")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("0", body)
+
+	s.SetPlatformDomains("2", "4")
+	code, body = get(assert, ts.URL+simulator.PlatformFaultDomainPath+"?api-version=2019-06-01&format=text")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("2", body)
+	code, body = get(assert, ts.URL+simulator.PlatformUpdateDomainPath+"?api-version=2019-06-01&format=text")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("4", body)
+}
+
+func TestEventLifecycle(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2019, 6, 30, 16, 0, 0, 0, time.UTC)
+	s := simulator.New("controlplane_0")
+	s.SetClock(func() time.Time { return now })
+	s.StartedDuration = time.Minute
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	result := getEvents(assert, ts.URL)
+	assert.Equal(1, result.DocumentIncarnation)
+	assert.Empty(result.Events)
+
+	eventID := s.AddEvent(azure.ScheduledEvent{EventType: "Redeploy"})
+	result = getEvents(assert, ts.URL)
+	assert.Equal(2, result.DocumentIncarnation)
+	assert.Len(result.Events, 1)
+	assert.Equal(eventID, result.Events[0].EventId)
+	assert.Equal(simulator.Scheduled, result.Events[0].EventStatus)
+	assert.Equal([]string{"controlplane_0"}, result.Events[0].Resources)
+	assert.Equal("Sun, 30 Jun 2019 16:05:00 GMT", result.Events[0].NotBefore)
+
+	body := []byte(`{"StartRequests": [{"EventId": "` + eventID + `"}]}`)
+	req, err := http.NewRequest("POST", ts.URL+simulator.ScheduledEventsPath+"?api-version=2019-08-01", bytes.NewBuffer(body))
+	assert.Nil(err)
+	req.Header.Set("Metadata", "true")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal([]string{eventID}, s.Approved())
+
+	result = getEvents(assert, ts.URL)
+	assert.Equal(3, result.DocumentIncarnation)
+	assert.Equal(simulator.Started, result.Events[0].EventStatus)
+
+	s.Advance()
+	assert.Len(s.Events(), 1)
+	now = now.Add(time.Minute)
+	s.Advance()
+	assert.Empty(s.Events())
+	assert.Equal(4, s.Incarnation())
+}
+
+func TestStartRequestsUnknownEvent(t *testing.T) {
+	assert := assert.New(t)
+	s := simulator.New("controlplane_0")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	eventID := s.AddEvent(azure.ScheduledEvent{})
+	body := []byte(`{"StartRequests": [{"EventId": "` + eventID + `"}, {"EventId": "unknown"}]}`)
+	req, err := http.NewRequest("POST", ts.URL+simulator.ScheduledEventsPath+"?api-version=2019-08-01", bytes.NewBuffer(body))
+	assert.Nil(err)
+	req.Header.Set("Metadata", "true")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	// no event is started if any of them is unknown
+	assert.Empty(s.Approved())
+	assert.Equal(simulator.Scheduled, s.Events()[0].EventStatus)
+	assert.Equal(2, s.Incarnation())
+}
+
+func TestAdvanceStartsEventsAfterNotBefore(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2019, 6, 30, 16, 0, 0, 0, time.UTC)
+	s := simulator.New("controlplane_0")
+	s.SetClock(func() time.Time { return now })
+
+	eventID := s.AddEvent(azure.ScheduledEvent{NotBefore: "Sun, 30 Jun 2019 16:22:03 GMT"})
+	s.Advance()
+	assert.Equal(simulator.Scheduled, s.Events()[0].EventStatus)
+	now = now.Add(30 * time.Minute)
+	s.Advance()
+	assert.Equal(simulator.Started, s.Events()[0].EventStatus)
+	assert.Nil(s.CompleteEvent(eventID))
+	assert.NotNil(s.CompleteEvent(eventID))
+	assert.NotNil(s.StartEvent(eventID))
+}
+
+func TestControlEndpoints(t *testing.T) {
+	assert := assert.New(t)
+	s := simulator.New("controlplane_0")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+simulator.EventsPath, "application/json", bytes.NewBufferString(`{"EventType": "Freeze"}`))
+	assert.Nil(err)
+	eventID, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("Freeze", s.Events()[0].EventType)
+
+	resp, err = http.Post(ts.URL+simulator.EventsPath+"/"+string(eventID), "", nil)
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal(simulator.Started, s.Events()[0].EventStatus)
+
+	req, err := http.NewRequest("DELETE", ts.URL+simulator.EventsPath+"/"+string(eventID), nil)
+	assert.Nil(err)
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Empty(s.Events())
+
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+}
@@ -5,38 +5,67 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/awesomenix/drainsafe/annotations"
+	drainsafev1 "github.com/awesomenix/drainsafe/api/v1"
+	"github.com/awesomenix/drainsafe/coordinator"
+	"github.com/awesomenix/drainsafe/hooks"
 	"github.com/awesomenix/drainsafe/kubectl"
+	"github.com/awesomenix/drainsafe/metrics"
+	"github.com/awesomenix/drainsafe/policy"
+	"github.com/awesomenix/drainsafe/statemachine"
 	repairmanv1 "github.com/awesomenix/repairman/pkg/api/v1"
 	repairmanclient "github.com/awesomenix/repairman/pkg/client"
 	"github.com/go-logr/logr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
 )
 
+const (
+	// verifyRequeueAfter interval between checks whether evicted pods are rescheduled
+	verifyRequeueAfter = 10 * time.Second
+	// hookRequeueAfter interval between checks of running hooks
+	hookRequeueAfter = 10 * time.Second
+)
+
 // DrainSafeReconciler reconciles a DrainSafe object
 type DrainSafeReconciler struct {
 	client.Client
 	Log      logr.Logger
 	Recorder record.EventRecorder
+	// EventPolicy action per scheduled event type, policy.DefaultEventPolicy if nil
+	EventPolicy policy.EventPolicy
+	// Coordinator limits nodes in maintenance at the same time when repairman is not installed,
+	// all nodes are approved right away if nil
+	Coordinator *coordinator.Coordinator
 }
 
 // +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;list;watch
 // +kubebuilder:rbac:groups=repairman.k8s.io,resources=maintenancerequests,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch;update;patch
 // +kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list
+// +kubebuilder:rbac:groups=apps,resources=deployments;replicasets;statefulsets,verbs=get
+// +kubebuilder:rbac:groups="",resources=replicationcontrollers,verbs=get
 // +kubebuilder:rbac:groups=extensions,resources=daemonsets,verbs=get;list
-// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=list
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;delete
 // +kubebuilder:rbac:groups="",resources=pods/eviction,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=events,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;create;update
 
 // Reconcile consumes event
 func (r *DrainSafeReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
@@ -74,54 +103,105 @@ func (r *DrainSafeReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		rclient = nil
 	}
 
-	return r.ProcessNodeEvent(c, rclient, node)
+	return r.ProcessNodeEvent(ctx, c, rclient, node)
 }
 
 // SetupWithManager called from maanger to register reconciler
 func (r *DrainSafeReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.Node{}).
+		Watches(&source.Kind{Type: &drainsafev1.DrainSafePolicy{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.mapPolicyToNodes),
+		}).
 		WithOptions(controller.Options{MaxConcurrentReconciles: 10}).
 		Complete(r)
 }
 
+// mapPolicyToNodes requeues all nodes when a DrainSafePolicy changes, so nodes waiting for
+// approval or retrying a failed step pick up the new policy right away
+func (r *DrainSafeReconciler) mapPolicyToNodes(o handler.MapObject) []reconcile.Request {
+	nodes := &corev1.NodeList{}
+	if err := r.List(context.TODO(), nodes); err != nil {
+		r.Log.Error(err, "failed to list nodes", "DrainSafePolicy", o.Meta.GetName())
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, node := range nodes.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: node.Name}})
+	}
+	return requests
+}
+
+// updateNodeState moves node to maintenance state, transitions the state machine does not allow
+// are refused
 func (r *DrainSafeReconciler) updateNodeState(node *corev1.Node, state string) (ctrl.Result, error) {
 	log := r.Log.WithValues("node", node.Name)
-	if node.Annotations[annotations.DrainSafeMaintenance] == state {
+	current := node.Annotations[annotations.DrainSafeMaintenance]
+	if current == state {
 		return ctrl.Result{}, nil
 	}
-	node.Annotations[annotations.DrainSafeMaintenance] = state
+	if err := statemachine.Validate(current, state); err != nil {
+		log.Error(err, "refusing to update node state")
+		r.Recorder.Eventf(node, "Warning", "IllegalTransition", "%s %v by %s on %s", node.Name, err, os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"))
+		return ctrl.Result{}, err
+	}
+	stampNodeState(node, state, time.Now())
+	return r.writeNodeState(node)
+}
+
+// writeNodeState persists the maintenance state of node
+func (r *DrainSafeReconciler) writeNodeState(node *corev1.Node) (ctrl.Result, error) {
+	log := r.Log.WithValues("node", node.Name)
+	state := node.Annotations[annotations.DrainSafeMaintenance]
 	if err := r.Update(context.TODO(), node); err != nil {
 		log.Error(err, "failed to update node")
 		return ctrl.Result{RequeueAfter: 1 * time.Minute}, err
 	}
 	r.Recorder.Eventf(node, "Normal", state, "%s by %s on %s", node.Name, os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"))
+	if err := syncNodeMaintenance(context.TODO(), r.Client, node); err != nil {
+		log.Error(err, "failed to sync node maintenance")
+		return ctrl.Result{RequeueAfter: 1 * time.Minute}, err
+	}
 	return ctrl.Result{}, nil
 }
 
-func (r *DrainSafeReconciler) getMaintenanceApproval(log logr.Logger, rclient *repairmanclient.Client, node *corev1.Node) (ctrl.Result, error) {
+func (r *DrainSafeReconciler) getMaintenanceApproval(ctx context.Context, log logr.Logger, p *maintenancePolicy, rclient *repairmanclient.Client, node *corev1.Node) (ctrl.Result, error) {
 	if rclient == nil {
+		if r.Coordinator != nil {
+			acquired, err := r.Coordinator.Acquire(ctx, node)
+			if err != nil {
+				log.Error(err, "failed to acquire maintenance slot")
+				return ctrl.Result{RequeueAfter: p.requeueAfter}, nil
+			}
+			if !acquired {
+				r.Recorder.Eventf(node, "Normal", "MaintenanceThrottled", "%s waiting for a maintenance slot by %s on %s", node.Name, os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"))
+				return ctrl.Result{RequeueAfter: p.requeueAfter}, nil
+			}
+		}
+		node.Annotations[annotations.DrainSafeMaintenanceApprover] = annotations.Drainsafe
 		return r.updateNodeState(node, annotations.MaintenanceApproved)
 	}
 	log.Info("maintenance approval", "Name", node.Name)
-	isApproved, err := rclient.IsMaintenanceApproved(context.TODO(), node.Name, "node")
+	isApproved, err := rclient.IsMaintenanceApproved(ctx, node.Name, "node")
 	if err != nil {
 		log.Error(err, "failed to get maintenance approval from repairman")
-		return ctrl.Result{RequeueAfter: 1 * time.Minute}, nil
+		return ctrl.Result{RequeueAfter: p.requeueAfter}, nil
 	}
 	if isApproved {
-		err = rclient.UpdateMaintenanceState(context.TODO(), node.Name, "node", repairmanv1.InProgress)
+		err = rclient.UpdateMaintenanceState(ctx, node.Name, "node", repairmanv1.InProgress)
 		if err != nil {
 			log.Error(err, "failed to mark maintenance in progress in repairman")
-			return ctrl.Result{RequeueAfter: 1 * time.Minute}, nil
+			return ctrl.Result{RequeueAfter: p.requeueAfter}, nil
 		}
+		node.Annotations[annotations.DrainSafeMaintenanceApprover] = annotations.Repairman
 		return r.updateNodeState(node, annotations.MaintenanceApproved)
 	}
-	return ctrl.Result{RequeueAfter: 1 * time.Minute}, nil
+	return ctrl.Result{RequeueAfter: p.requeueAfter}, nil
 }
 
-// ProcessNodeEvent processes node event
-func (r *DrainSafeReconciler) ProcessNodeEvent(c kubectl.Client, rclient *repairmanclient.Client, node *corev1.Node) (ctrl.Result, error) {
+// ProcessNodeEvent processes node event, a drain running longer than the drain timeout
+// of the node or past ctx is aborted and requeued
+func (r *DrainSafeReconciler) ProcessNodeEvent(ctx context.Context, c kubectl.ContextClient, rclient *repairmanclient.Client, node *corev1.Node) (ctrl.Result, error) {
 	if node.Annotations == nil {
 		return ctrl.Result{}, nil
 	}
@@ -133,8 +213,35 @@ func (r *DrainSafeReconciler) ProcessNodeEvent(c kubectl.Client, rclient *repair
 		"Name", node.Name,
 		"Maintenance", maintenance)
 
-	if maintenance == annotations.Scheduled {
-		return r.getMaintenanceApproval(log, rclient, node)
+	// NodeMaintenance left out of date by a failed sync is repaired before the node moves on
+	if err := syncNodeMaintenance(ctx, r.Client, node); err != nil {
+		log.Error(err, "failed to sync node maintenance")
+		return ctrl.Result{RequeueAfter: 1 * time.Minute}, err
+	}
+
+	p, err := getMaintenancePolicy(ctx, r.Client, node, r.EventPolicy)
+	if err != nil {
+		log.Error(err, "failed to get drainsafe policy")
+		return ctrl.Result{RequeueAfter: defaultRequeueAfter}, nil
+	}
+	if recovered, res, err := r.recoverNodeState(ctx, log, p, node, time.Now()); recovered {
+		return res, err
+	}
+	if guarded, res := r.guardCordon(ctx, log, p, c, node); guarded {
+		return res, nil
+	}
+	action := p.eventPolicy.ActionFor(node.Annotations[annotations.DrainSafeMaintenanceType])
+	if node.Annotations[annotations.DrainSafeMaintenanceType] == "" {
+		// maintenance scheduled by hand carries no event type, it is drained
+		action = policy.Drain
+	}
+
+	if maintenance == annotations.Scheduled || maintenance == annotations.MaintenancePending {
+		if !action.Cordons() {
+			log.Info("maintenance is not cordoned, skipping cordon and drain", "Action", action)
+			return ctrl.Result{}, nil
+		}
+		return r.getMaintenanceApproval(ctx, log, p, rclient, node)
 	}
 
 	if maintenance == annotations.MaintenanceApproved {
@@ -143,60 +250,322 @@ func (r *DrainSafeReconciler) ProcessNodeEvent(c kubectl.Client, rclient *repair
 
 	if maintenance == annotations.Cordoning {
 		node.Annotations[annotations.DrainSafeMaintenanceOwner] = annotations.Drainsafe
+		// override of a previous maintenance does not carry over
+		delete(node.Annotations, annotations.DrainSafeAllowUncordon)
 		if !node.Spec.Unschedulable {
-			if err := c.Cordon(node.Name); err != nil {
+			if err := c.CordonContext(ctx, node.Name); err != nil {
 				log.Error(err, "failed to cordon vm")
-				return ctrl.Result{RequeueAfter: 1 * time.Minute}, nil
+				metrics.Failures.WithLabelValues(metrics.Cordon, failureReason(ctx, err)).Inc()
+				return ctrl.Result{RequeueAfter: p.requeueAfter}, nil
 			}
+			node.Spec.Unschedulable = true
 		}
 		return r.updateNodeState(node, annotations.Cordoned)
 	}
 
 	if maintenance == annotations.Cordoned {
+		delete(node.Annotations, annotations.DrainSafeEvictedPods)
+		if action == policy.CordonOnly {
+			log.Info("maintenance is cordon only, skipping drain", "Action", action)
+			return r.updateNodeState(node, annotations.Drained)
+		}
+		if len(p.preDrainHooks) != 0 {
+			delete(node.Annotations, annotations.DrainSafeHookStatus)
+			return r.updateNodeState(node, annotations.PreDrain)
+		}
+		return r.updateNodeState(node, annotations.Draining)
+	}
+
+	if maintenance == annotations.PreDrain {
+		if done, res := r.runHooks(ctx, log, p, node, hooks.PreDrain, p.preDrainHooks); !done {
+			return res, nil
+		}
+		delete(node.Annotations, annotations.DrainSafeHookStatus)
 		return r.updateNodeState(node, annotations.Draining)
 	}
 
 	if maintenance == annotations.Draining {
 		maintenanceType := node.Annotations[annotations.DrainSafeMaintenanceType]
-		if err := c.Drain(node.Name, getGraceTimeoutPeriod(maintenanceType)); err != nil {
+		notBefore := node.Annotations[annotations.DrainSafeNotBefore]
+		options, sufficient := p.drainOptions(maintenanceType, notBefore, time.Now())
+		if !sufficient {
+			log.Info("insufficient time left to drain safely", "NotBefore", notBefore, "Timeout", options.Timeout)
+			r.Recorder.Eventf(node, "Warning", "InsufficientDrainBudget", "%s has %s left to drain before %s at %s", node.Name, options.Timeout, maintenanceType, notBefore)
+		}
+		drainCtx, cancel := context.WithTimeout(ctx, p.drainTimeout)
+		defer cancel()
+		result, err := c.DrainContext(drainCtx, node.Name, options, func(progress kubectl.DrainProgress) {
+			log.Info("drain progress",
+				"Namespace", progress.Pod.Namespace,
+				"Name", progress.Pod.Name,
+				"Evicted", progress.Pod.Evicted,
+				"Done", progress.Done,
+				"Total", progress.Total)
+		})
+		if err != nil {
 			log.Error(err, "failed to drain vm")
-			return ctrl.Result{RequeueAfter: 1 * time.Minute}, nil
+			metrics.Failures.WithLabelValues(metrics.Drain, drainFailureReason(drainCtx, err, result)).Inc()
+			if kubectl.IsDrainBlocked(err) {
+				r.Recorder.Eventf(node, "Warning", "DrainBlocked", "%s by %s on %s: %v", node.Name, os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"), err)
+			}
+			if drainCtx.Err() == context.DeadlineExceeded {
+				r.Recorder.Eventf(node, "Warning", "DrainTimedOut", "%s drain aborted after %s by %s on %s", node.Name, p.drainTimeout, os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"))
+			}
+			if result != nil && len(result.Blocked()) != 0 {
+				if recordErr := r.recordDisruptionBlocked(ctx, log, node, result.Blocked()); recordErr != nil {
+					return ctrl.Result{RequeueAfter: p.requeueAfter}, recordErr
+				}
+				if p.escalation == drainsafev1.EscalationAlertOnly && p.escalating(notBefore, time.Now()) {
+					r.Recorder.Eventf(node, "Warning", "DisruptionBudgetEscalated", "%s maintenance approved with pods blocked by pod disruption budgets by %s on %s", node.Name, os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"))
+					node.Annotations[annotations.DrainSafeDrainResult] = err.Error()
+					setEvictedPods(node, result)
+					return r.updateNodeState(node, annotations.Drained)
+				}
+			}
+			return ctrl.Result{RequeueAfter: p.requeueAfter}, nil
+		}
+		if options.ForceDelete && node.Annotations[annotations.DrainSafeBlockedPods] != "" {
+			r.Recorder.Eventf(node, "Warning", "DisruptionBudgetEscalated", "%s force deleted pods blocked by pod disruption budgets %s by %s on %s", node.Name, node.Annotations[annotations.DrainSafeBlockingBudgets], os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"))
+		}
+		delete(node.Annotations, annotations.DrainSafeBlockedPods)
+		delete(node.Annotations, annotations.DrainSafeBlockingBudgets)
+		delete(node.Annotations, annotations.DrainSafeDrainResult)
+		setEvictedPods(node, result)
+		if owners := result.Owners(); p.verifyReschedule && len(owners) != 0 {
+			value, err := json.Marshal(owners)
+			if err != nil {
+				log.Error(err, "failed to marshal evicted owners")
+				return r.updateNodeState(node, annotations.Drained)
+			}
+			node.Annotations[annotations.DrainSafeEvictedOwners] = string(value)
+			node.Annotations[annotations.DrainSafeVerifyDeadline] = p.verifyDeadline(notBefore, time.Now()).Format(time.RFC3339)
+			return r.updateNodeState(node, annotations.Verifying)
 		}
 		return r.updateNodeState(node, annotations.Drained)
 	}
 
+	if maintenance == annotations.Verifying {
+		return r.verifyRescheduled(ctx, log, p, c, node)
+	}
+
+	if maintenance == annotations.Running && node.Spec.Unschedulable &&
+		node.Annotations[annotations.DrainSafeMaintenanceOwner] == annotations.Drainsafe &&
+		len(p.postMaintenanceHooks) != 0 {
+		delete(node.Annotations, annotations.DrainSafeHookStatus)
+		return r.updateNodeState(node, annotations.PostMaintenance)
+	}
+
+	if maintenance == annotations.PostMaintenance {
+		if done, res := r.runHooks(ctx, log, p, node, hooks.PostMaintenance, p.postMaintenanceHooks); !done {
+			return res, nil
+		}
+		delete(node.Annotations, annotations.DrainSafeHookStatus)
+		return r.completeMaintenance(ctx, log, p, rclient, c, node)
+	}
+
 	if maintenance == annotations.Running {
-		if !node.Spec.Unschedulable {
-			return ctrl.Result{}, nil
+		return r.completeMaintenance(ctx, log, p, rclient, c, node)
+	}
+
+	// node waits for the scheduled event controller, check again once it would be stuck
+	return ctrl.Result{RequeueAfter: untilStuck(p, node, time.Now())}, nil
+}
+
+// completeMaintenance marks maintenance completed in repairman and uncordons the node if
+// drainsafe cordoned it
+func (r *DrainSafeReconciler) completeMaintenance(ctx context.Context, log logr.Logger, p *maintenancePolicy, rclient *repairmanclient.Client, c kubectl.ContextClient, node *corev1.Node) (ctrl.Result, error) {
+	if !node.Spec.Unschedulable {
+		return r.updateNodeState(node, annotations.Running)
+	}
+	if rclient != nil && isRepairmanApproved(node) {
+		if err := rclient.UpdateMaintenanceState(ctx, node.Name, "node", repairmanv1.Completed); err != nil {
+			log.Error(err, "failed to mark maintenance in progress in repairman")
+			return ctrl.Result{RequeueAfter: p.requeueAfter}, nil
 		}
-		if rclient != nil {
-			if err := rclient.UpdateMaintenanceState(context.TODO(), node.Name, "node", repairmanv1.Completed); err != nil {
-				log.Error(err, "failed to mark maintenance in progress in repairman")
-				return ctrl.Result{RequeueAfter: 1 * time.Minute}, nil
-			}
+	}
+	if node.Annotations[annotations.DrainSafeMaintenanceOwner] == annotations.Drainsafe {
+		reasons, err := checkNodeHealth(ctx, p, c, node)
+		if err != nil {
+			log.Error(err, "failed to check node health")
+			return ctrl.Result{RequeueAfter: p.requeueAfter}, nil
 		}
-		if node.Annotations[annotations.DrainSafeMaintenanceOwner] == annotations.Drainsafe {
-			if err := c.Uncordon(node.Name); err != nil {
-				log.Error(err, "failed to cordon vm")
-				return ctrl.Result{RequeueAfter: 1 * time.Minute}, nil
+		if len(reasons) != 0 {
+			log.Info("node is not healthy, keeping it cordoned", "Reasons", strings.Join(reasons, ", "))
+			metrics.Failures.WithLabelValues(metrics.Uncordon, metrics.ReasonHealthGate).Inc()
+			r.Recorder.Eventf(node, "Warning", "HealthGateFailed", "%s kept cordoned by %s on %s: %s", node.Name, os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"), strings.Join(reasons, ", "))
+			return ctrl.Result{RequeueAfter: p.requeueAfter}, nil
+		}
+		if err := c.UncordonContext(ctx, node.Name); err != nil {
+			log.Error(err, "failed to cordon vm")
+			metrics.Failures.WithLabelValues(metrics.Uncordon, failureReason(ctx, err)).Inc()
+			return ctrl.Result{RequeueAfter: p.requeueAfter}, nil
+		}
+		r.Recorder.Eventf(node, "Normal", annotations.Uncordoned, "%s by %s on %s", node.Name, os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"))
+		node.Annotations[annotations.DrainSafeMaintenanceOwner] = ""
+		node.Annotations[annotations.DrainSafeMaintenanceApprover] = ""
+		res, err := r.updateNodeState(node, annotations.Running)
+		r.releaseMaintenanceSlot(ctx, log, node)
+		return res, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// setEvictedPods records pods evicted by the drain on node
+func setEvictedPods(node *corev1.Node, result *kubectl.DrainResult) {
+	if result == nil || len(result.Evicted()) == 0 {
+		delete(node.Annotations, annotations.DrainSafeEvictedPods)
+		return
+	}
+	node.Annotations[annotations.DrainSafeEvictedPods] = strings.Join(result.Evicted(), ",")
+}
+
+// failureReason reason of a failed cordon or uncordon for the failures metric
+func failureReason(ctx context.Context, err error) string {
+	if ctx.Err() == context.DeadlineExceeded {
+		return metrics.ReasonTimeout
+	}
+	return metrics.ReasonError
+}
+
+// drainFailureReason reason of a failed drain for the failures metric
+func drainFailureReason(ctx context.Context, err error, result *kubectl.DrainResult) string {
+	if kubectl.IsDrainBlocked(err) {
+		return metrics.ReasonBlocked
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return metrics.ReasonTimeout
+	}
+	if result != nil && len(result.Blocked()) != 0 {
+		return metrics.ReasonDisruptionBudget
+	}
+	return metrics.ReasonError
+}
+
+// releaseMaintenanceSlot frees the coordinator slot of node, slots which fail to be released are
+// released by the coordinator once it finds the node out of maintenance
+func (r *DrainSafeReconciler) releaseMaintenanceSlot(ctx context.Context, log logr.Logger, node *corev1.Node) {
+	if r.Coordinator == nil {
+		return
+	}
+	if err := r.Coordinator.Release(ctx, node.Name); err != nil {
+		log.Error(err, "failed to release maintenance slot")
+	}
+}
+
+// runHooks advances hooks of phase, returns true once all hooks are done, otherwise the result
+// to requeue with. Hook progress is recorded on the node so hooks resume where they left off.
+func (r *DrainSafeReconciler) runHooks(ctx context.Context, log logr.Logger, p *maintenancePolicy, node *corev1.Node, phase hooks.Phase, hookList []hooks.Hook) (bool, ctrl.Result) {
+	statuses := []hooks.Status{}
+	if value, ok := node.Annotations[annotations.DrainSafeHookStatus]; ok {
+		if err := json.Unmarshal([]byte(value), &statuses); err != nil {
+			log.Error(err, "failed to parse hook status, restarting hooks")
+		}
+	}
+	result := hooks.NewRunner(r.Client, os.Getenv("POD_NAMESPACE")).Run(ctx, node, phase, hookList, statuses, time.Now())
+	for _, status := range result.Finished {
+		if status.Succeeded {
+			r.Recorder.Eventf(node, "Normal", "HookSucceeded", "%s %s hook %s succeeded by %s on %s", node.Name, phase, status.Name, os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"))
+		} else {
+			r.Recorder.Eventf(node, "Warning", "HookFailed", "%s %s hook %s failed by %s on %s: %s", node.Name, phase, status.Name, os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"), status.Message)
+		}
+	}
+	if result.Done {
+		return true, ctrl.Result{}
+	}
+
+	value, err := json.Marshal(result.Statuses)
+	if err != nil {
+		log.Error(err, "failed to marshal hook status")
+		return false, ctrl.Result{RequeueAfter: p.requeueAfter}
+	}
+	node.Annotations[annotations.DrainSafeHookStatus] = string(value)
+	if err := r.Update(ctx, node); err != nil {
+		log.Error(err, "failed to update node")
+		return false, ctrl.Result{RequeueAfter: p.requeueAfter}
+	}
+	if result.Blocked {
+		log.Info("maintenance blocked by failed hook", "Phase", phase)
+		return false, ctrl.Result{RequeueAfter: p.requeueAfter}
+	}
+	return false, ctrl.Result{RequeueAfter: hookRequeueAfter}
+}
+
+// recordDisruptionBlocked records pods whose eviction is refused by pod disruption budgets,
+// and the budgets refusing it, on the node and its NodeMaintenance
+func (r *DrainSafeReconciler) recordDisruptionBlocked(ctx context.Context, log logr.Logger, node *corev1.Node, blocked []kubectl.PodResult) error {
+	pods, budgets := []string{}, []string{}
+	seen := map[string]bool{}
+	for _, pod := range blocked {
+		pods = append(pods, pod.Namespace+"/"+pod.Name)
+		for _, budget := range pod.DisruptionBudgets {
+			if !seen[budget] {
+				seen[budget] = true
+				budgets = append(budgets, budget)
 			}
-			r.Recorder.Eventf(node, "Normal", annotations.Uncordoned, "%s by %s on %s", node.Name, os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"))
-			node.Annotations[annotations.DrainSafeMaintenanceOwner] = ""
-			return r.updateNodeState(node, annotations.Running)
 		}
 	}
+	log.Info("drain blocked by pod disruption budgets", "Pods", strings.Join(pods, ","), "DisruptionBudgets", strings.Join(budgets, ","))
+	r.Recorder.Eventf(node, "Warning", "DisruptionBlocked", "%s eviction of %s refused by pod disruption budgets %s by %s on %s", node.Name, strings.Join(pods, ","), strings.Join(budgets, ","), os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"))
 
-	return ctrl.Result{}, nil
+	node.Annotations[annotations.DrainSafeBlockedPods] = strings.Join(pods, ",")
+	node.Annotations[annotations.DrainSafeBlockingBudgets] = strings.Join(budgets, ",")
+	if err := r.Update(ctx, node); err != nil {
+		log.Error(err, "failed to update node")
+		return err
+	}
+	if err := syncNodeMaintenance(ctx, r.Client, node); err != nil {
+		log.Error(err, "failed to sync node maintenance")
+		return err
+	}
+	return nil
 }
 
-func getGraceTimeoutPeriod(maintenanceType string) int {
-	switch maintenanceType {
-	case "Reboot", "Freeze":
-		return 840
-	case "Redeploy":
-		return 540
-	case "Preempt":
-		return 15
+// verifyRescheduled moves node to Drained once controllers of evicted pods have all their
+// replicas ready again, or once the verify deadline passes so the maintenance is approved in time
+func (r *DrainSafeReconciler) verifyRescheduled(ctx context.Context, log logr.Logger, p *maintenancePolicy, c kubectl.ContextClient, node *corev1.Node) (ctrl.Result, error) {
+	owners := []kubectl.PodOwner{}
+	if err := json.Unmarshal([]byte(node.Annotations[annotations.DrainSafeEvictedOwners]), &owners); err != nil {
+		log.Error(err, "failed to parse evicted owners, skipping verification")
+		return r.verified(node)
 	}
-	return 60
+	checker, ok := c.(kubectl.RescheduleChecker)
+	if !ok {
+		log.Info("client cannot check rescheduled pods, skipping verification")
+		return r.verified(node)
+	}
+	pending, err := checker.Rescheduled(ctx, node.Name, owners)
+	if err != nil {
+		log.Error(err, "failed to verify evicted pods are rescheduled")
+		return ctrl.Result{RequeueAfter: p.requeueAfter}, nil
+	}
+	if len(pending) == 0 {
+		return r.verified(node)
+	}
+
+	names := []string{}
+	for _, owner := range pending {
+		names = append(names, owner.String())
+	}
+	deadline, err := time.Parse(time.RFC3339, node.Annotations[annotations.DrainSafeVerifyDeadline])
+	if err != nil || !time.Now().Before(deadline) {
+		log.Info("evicted pods were not rescheduled in time", "Pending", strings.Join(names, ", "))
+		r.Recorder.Eventf(node, "Warning", "RescheduleTimedOut", "%s evicted pods of %s were not rescheduled in time by %s on %s", node.Name, strings.Join(names, ", "), os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"))
+		return r.verified(node)
+	}
+	log.Info("waiting for evicted pods to be rescheduled", "Pending", strings.Join(names, ", "), "Deadline", deadline)
+	return ctrl.Result{RequeueAfter: verifyRequeueAfter}, nil
+}
+
+// verified clears verification annotations and moves node to Drained
+func (r *DrainSafeReconciler) verified(node *corev1.Node) (ctrl.Result, error) {
+	delete(node.Annotations, annotations.DrainSafeEvictedOwners)
+	delete(node.Annotations, annotations.DrainSafeVerifyDeadline)
+	return r.updateNodeState(node, annotations.Drained)
+}
+
+// isRepairmanApproved checks if maintenance was approved by repairman, nodes annotated
+// before approver was recorded are assumed to be approved by repairman
+func isRepairmanApproved(node *corev1.Node) bool {
+	approver := node.Annotations[annotations.DrainSafeMaintenanceApprover]
+	return approver == "" || approver == annotations.Repairman
 }
@@ -4,33 +4,57 @@ package controllers_test
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
 	"time"
 
 	"testing"
 
 	"github.com/awesomenix/drainsafe/annotations"
+	drainsafev1 "github.com/awesomenix/drainsafe/api/v1"
 	"github.com/awesomenix/drainsafe/controllers"
+	"github.com/awesomenix/drainsafe/coordinator"
 	"github.com/awesomenix/drainsafe/kubectl"
+	"github.com/awesomenix/drainsafe/metrics"
+	"github.com/awesomenix/drainsafe/policy"
 	repairmanv1 "github.com/awesomenix/repairman/pkg/api/v1"
 	repairmanclient "github.com/awesomenix/repairman/pkg/client"
 	repairmantest "github.com/awesomenix/repairman/pkg/test"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
-var _ kubectl.Client = &fakeKubeClient{}
+var _ kubectl.ContextClient = &fakeKubeClient{}
 
 type fakeKubeClient struct {
-	cordonerr   error
-	drainerr    error
-	uncordonerr error
+	cordonerr    error
+	drainerr     error
+	uncordonerr  error
+	drainOptions kubectl.DrainOptions
+	// drainblock blocks drain until ctx is done
+	drainblock bool
+	// drainResult returned by DrainContext, empty if nil
+	drainResult *kubectl.DrainResult
+	// pending owners returned by Rescheduled
+	pending []kubectl.PodOwner
+	// probeReady returned by ProbeReady
+	probeReady bool
+}
+
+// contextKubeClient implements kubectl.ContextClient only, it neither checks rescheduled pods nor probes
+type contextKubeClient struct {
+	kubectl.ContextClient
 }
 
 func (f *fakeKubeClient) Cordon(vmName string) error {
@@ -45,6 +69,34 @@ func (f *fakeKubeClient) Uncordon(vmName string) error {
 	return f.uncordonerr
 }
 
+func (f *fakeKubeClient) CordonContext(ctx context.Context, vmName string) error {
+	return f.Cordon(vmName)
+}
+
+func (f *fakeKubeClient) DrainContext(ctx context.Context, vmName string, options kubectl.DrainOptions, progress kubectl.ProgressFunc) (*kubectl.DrainResult, error) {
+	if f.drainblock {
+		<-ctx.Done()
+		return &kubectl.DrainResult{}, ctx.Err()
+	}
+	f.drainOptions = options
+	if f.drainResult != nil {
+		return f.drainResult, f.drainerr
+	}
+	return &kubectl.DrainResult{}, f.drainerr
+}
+
+func (f *fakeKubeClient) Rescheduled(ctx context.Context, vmName string, owners []kubectl.PodOwner) ([]kubectl.PodOwner, error) {
+	return f.pending, nil
+}
+
+func (f *fakeKubeClient) ProbeReady(ctx context.Context, vmName, namespace string, selector labels.Selector) (bool, error) {
+	return f.probeReady, nil
+}
+
+func (f *fakeKubeClient) UncordonContext(ctx context.Context, vmName string) error {
+	return f.Uncordon(vmName)
+}
+
 func TestNoAnnotations(t *testing.T) {
 	assert := assert.New(t)
 	corev1.AddToScheme(scheme.Scheme)
@@ -62,7 +114,7 @@ func TestNoAnnotations(t *testing.T) {
 			Annotations: make(map[string]string),
 		},
 	}
-	_, err := reconciler.ProcessNodeEvent(&fakeKubeClient{}, nil, node)
+	_, err := reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
 	assert.Nil(err)
 	assert.Equal(len(node.Annotations), 0)
 }
@@ -72,6 +124,7 @@ func TestReconcile(t *testing.T) {
 	f := fake.NewFakeClient()
 	corev1.AddToScheme(scheme.Scheme)
 	repairmanv1.AddToScheme(scheme.Scheme)
+	drainsafev1.AddToScheme(scheme.Scheme)
 	reconciler := &controllers.DrainSafeReconciler{
 		Client:   f,
 		Recorder: &record.FakeRecorder{},
@@ -83,6 +136,9 @@ func TestReconcile(t *testing.T) {
 			Name:        "dummynode",
 			Annotations: make(map[string]string),
 		},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+		},
 	}
 	err := f.Create(context.TODO(), node)
 	assert.Nil(err)
@@ -93,7 +149,7 @@ func TestReconcile(t *testing.T) {
 		annotations.Cordoned,
 		annotations.Draining,
 		annotations.Drained} {
-		res, err := reconciler.ProcessNodeEvent(&fakeKubeClient{}, nil, node)
+		res, err := reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
 		assert.Nil(err)
 		assert.Equal(res, ctrl.Result{})
 		assert.Equal(state, node.Annotations[annotations.DrainSafeMaintenance])
@@ -103,10 +159,10 @@ func TestReconcile(t *testing.T) {
 	}
 	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Running
 	node.Spec.Unschedulable = true
-	res, err := reconciler.ProcessNodeEvent(&fakeKubeClient{uncordonerr: errors.New("error")}, nil, node)
+	res, err := reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{uncordonerr: errors.New("error")}, nil, node)
 	assert.Nil(err)
 	assert.Equal(res, ctrl.Result{RequeueAfter: 1 * time.Minute})
-	res, err = reconciler.ProcessNodeEvent(&fakeKubeClient{}, nil, node)
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
 	assert.Nil(err)
 	assert.Equal(res, ctrl.Result{})
 	assert.Equal(node.Annotations[annotations.DrainSafeMaintenanceOwner], "")
@@ -117,6 +173,7 @@ func TestReconcileWithRepairMan(t *testing.T) {
 	f := fake.NewFakeClient()
 	corev1.AddToScheme(scheme.Scheme)
 	repairmanv1.AddToScheme(scheme.Scheme)
+	drainsafev1.AddToScheme(scheme.Scheme)
 
 	repairmantest.ReconcileML(f, assert)
 
@@ -137,7 +194,7 @@ func TestReconcileWithRepairMan(t *testing.T) {
 	assert.Nil(err)
 	node.Annotations = make(map[string]string)
 	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Scheduled
-	res, err := reconciler.ProcessNodeEvent(&fakeKubeClient{}, rclient, node)
+	res, err := reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, rclient, node)
 	assert.Nil(err)
 	assert.Equal(res, ctrl.Result{RequeueAfter: 1 * time.Minute})
 	assert.NotEqual(annotations.MaintenanceApproved, node.Annotations[annotations.DrainSafeMaintenance])
@@ -148,14 +205,500 @@ func TestReconcileWithRepairMan(t *testing.T) {
 		annotations.Cordoned,
 		annotations.Draining,
 		annotations.Drained} {
-		res, err := reconciler.ProcessNodeEvent(&fakeKubeClient{}, rclient, node)
+		res, err := reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, rclient, node)
 		assert.Nil(err)
 		assert.Equal(res, ctrl.Result{})
 		assert.Equal(state, node.Annotations[annotations.DrainSafeMaintenance])
 	}
 	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Running
 	node.Spec.Unschedulable = true
-	res, err = reconciler.ProcessNodeEvent(&fakeKubeClient{uncordonerr: errors.New("error")}, rclient, node)
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{uncordonerr: errors.New("error")}, rclient, node)
 	assert.Nil(err)
 	assert.Equal(res, ctrl.Result{RequeueAfter: 1 * time.Minute})
 }
+
+func TestDrainBudget(t *testing.T) {
+	assert := assert.New(t)
+	f := fake.NewFakeClient()
+	corev1.AddToScheme(scheme.Scheme)
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:   f,
+		Recorder: recorder,
+		Log:      ctrl.Log,
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummynode",
+			Annotations: make(map[string]string),
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	c := &fakeKubeClient{}
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Draining
+	node.Annotations[annotations.DrainSafeMaintenanceType] = "Reboot"
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.Equal(kubectl.DrainOptions{GracePeriod: 840, IgnoreDaemonSets: true, Force: true, DeleteLocalData: true, WaveTimeout: 2 * time.Minute}, c.drainOptions)
+	assert.Equal("Normal NodeDrained dummynode by  on ", <-recorder.Events)
+
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Draining
+	node.Annotations[annotations.DrainSafeNotBefore] = time.Now().Add(5 * time.Minute).UTC().Format(time.RFC1123)
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.InDelta(290, c.drainOptions.GracePeriod, 2)
+	assert.InDelta(float64(5*time.Minute), float64(c.drainOptions.Timeout), float64(2*time.Second))
+	assert.Equal(annotations.Drained, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("Normal NodeDrained dummynode by  on ", <-recorder.Events)
+
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Draining
+	node.Annotations[annotations.DrainSafeNotBefore] = "Sun, 30 Jun 2019 16:22:03 GMT"
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.Equal(kubectl.DrainOptions{GracePeriod: 1, Timeout: 10 * time.Second, IgnoreDaemonSets: true, Force: true, DeleteLocalData: true, WaveTimeout: 2 * time.Minute}, c.drainOptions)
+	assert.Contains(<-recorder.Events, "Warning InsufficientDrainBudget")
+}
+
+func TestEventPolicy(t *testing.T) {
+	assert := assert.New(t)
+	f := fake.NewFakeClient()
+	corev1.AddToScheme(scheme.Scheme)
+	eventPolicy, err := policy.ParseEventPolicy("Freeze=CordonOnly,Reboot=AnnotateOnly")
+	assert.Nil(err)
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:      f,
+		Recorder:    &record.FakeRecorder{},
+		Log:         ctrl.Log,
+		EventPolicy: eventPolicy,
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummynode",
+			Annotations: make(map[string]string),
+		},
+	}
+	err = f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Scheduled
+	node.Annotations[annotations.DrainSafeMaintenanceType] = "Reboot"
+	res, err := reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{}, res)
+	assert.Equal(annotations.Scheduled, node.Annotations[annotations.DrainSafeMaintenance])
+
+	// ignored and unknown event types reaching the controller are never drained, e.g. when the
+	// event policy of the scheduled event controller differs
+	reconciler.EventPolicy = policy.DefaultEventPolicy()
+	for _, eventType := range []string{"Freeze", "Unknown"} {
+		node.Annotations[annotations.DrainSafeMaintenanceType] = eventType
+		res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+		assert.Nil(err)
+		assert.Equal(ctrl.Result{}, res)
+		assert.Equal(annotations.Scheduled, node.Annotations[annotations.DrainSafeMaintenance])
+	}
+	reconciler.EventPolicy = eventPolicy
+
+	node.Annotations[annotations.DrainSafeMaintenanceType] = "Freeze"
+	c := &fakeKubeClient{drainerr: errors.New("error")}
+	for _, state := range []string{
+		annotations.MaintenanceApproved,
+		annotations.Cordoning,
+		annotations.Cordoned,
+		annotations.Drained} {
+		res, err := reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+		assert.Nil(err)
+		assert.Equal(ctrl.Result{}, res)
+		assert.Equal(state, node.Annotations[annotations.DrainSafeMaintenance])
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	drainsafev1.AddToScheme(scheme.Scheme)
+	f := fake.NewFakeClient(&drainsafev1.DrainSafePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "default"},
+		Spec: drainsafev1.DrainSafePolicySpec{
+			DrainTimeout: &metav1.Duration{Duration: 10 * time.Millisecond},
+		},
+	})
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:   f,
+		Recorder: recorder,
+		Log:      ctrl.Log,
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummynode",
+			Annotations: make(map[string]string),
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Draining
+	node.Annotations[annotations.DrainSafeMaintenanceType] = "Reboot"
+	timeouts := testutil.ToFloat64(metrics.Failures.WithLabelValues(metrics.Drain, metrics.ReasonTimeout))
+	res, err := reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{drainblock: true}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{RequeueAfter: 1 * time.Minute}, res)
+	assert.Equal(annotations.Draining, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("Warning DrainTimedOut dummynode drain aborted after 10ms by  on ", <-recorder.Events)
+	assert.Equal(timeouts+1, testutil.ToFloat64(metrics.Failures.WithLabelValues(metrics.Drain, metrics.ReasonTimeout)))
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	res, err = reconciler.ProcessNodeEvent(ctx, &fakeKubeClient{drainblock: true}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{RequeueAfter: 1 * time.Minute}, res)
+	assert.Equal(annotations.Draining, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Empty(recorder.Events)
+}
+
+func TestVerifyRescheduled(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	drainsafev1.AddToScheme(scheme.Scheme)
+	f := fake.NewFakeClient(&drainsafev1.DrainSafePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "default"},
+		Spec: drainsafev1.DrainSafePolicySpec{
+			Drain: drainsafev1.DrainSpec{VerifyReschedule: true},
+		},
+	})
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:   f,
+		Recorder: recorder,
+		Log:      ctrl.Log,
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummynode",
+			Annotations: make(map[string]string),
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	owner := kubectl.PodOwner{Namespace: "default", Kind: "ReplicaSet", Name: "web"}
+	c := &fakeKubeClient{
+		drainResult: &kubectl.DrainResult{Pods: []kubectl.PodResult{
+			{Namespace: "default", Name: "web-1", Evicted: true, Owner: &owner},
+			{Namespace: "default", Name: "web-2", Evicted: true, Owner: &owner},
+		}},
+		pending: []kubectl.PodOwner{owner},
+	}
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Draining
+	node.Annotations[annotations.DrainSafeMaintenanceType] = "Reboot"
+	node.Annotations[annotations.DrainSafeNotBefore] = time.Now().Add(3 * time.Minute).UTC().Format(time.RFC1123)
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Verifying, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.JSONEq(`[{"namespace": "default", "kind": "ReplicaSet", "name": "web"}]`, node.Annotations[annotations.DrainSafeEvictedOwners])
+	deadline, err := time.Parse(time.RFC3339, node.Annotations[annotations.DrainSafeVerifyDeadline])
+	assert.Nil(err)
+	assert.InDelta(float64(3*time.Minute-10*time.Second), float64(time.Until(deadline)), float64(2*time.Second))
+	assert.Equal("Normal NodeVerifying dummynode by  on ", <-recorder.Events)
+
+	res, err := reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{RequeueAfter: 10 * time.Second}, res)
+	assert.Equal(annotations.Verifying, node.Annotations[annotations.DrainSafeMaintenance])
+
+	c.pending = nil
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{}, res)
+	assert.Equal(annotations.Drained, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.NotContains(node.Annotations, annotations.DrainSafeEvictedOwners)
+	assert.NotContains(node.Annotations, annotations.DrainSafeVerifyDeadline)
+	assert.Equal("Normal NodeDrained dummynode by  on ", <-recorder.Events)
+
+	// verification gives up once the deadline passes
+	c.pending = []kubectl.PodOwner{owner}
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Verifying
+	node.Annotations[annotations.DrainSafeEvictedOwners] = `[{"namespace": "default", "kind": "ReplicaSet", "name": "web"}]`
+	node.Annotations[annotations.DrainSafeVerifyDeadline] = time.Now().Add(-time.Second).Format(time.RFC3339)
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Drained, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("Warning RescheduleTimedOut dummynode evicted pods of ReplicaSet default/web were not rescheduled in time by  on ", <-recorder.Events)
+
+	// client which cannot check rescheduled pods skips verification
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Verifying
+	node.Annotations[annotations.DrainSafeEvictedOwners] = `[{"namespace": "default", "kind": "ReplicaSet", "name": "web"}]`
+	node.Annotations[annotations.DrainSafeVerifyDeadline] = time.Now().Add(time.Minute).Format(time.RFC3339)
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), &contextKubeClient{c}, nil, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Drained, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("Normal NodeDrained dummynode by  on ", <-recorder.Events)
+
+	// pods without controllers are not verified
+	c.drainResult = &kubectl.DrainResult{Pods: []kubectl.PodResult{{Namespace: "default", Name: "standalone", Evicted: true}}}
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Draining
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Drained, node.Annotations[annotations.DrainSafeMaintenance])
+}
+
+func TestDisruptionBudgetEscalation(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	drainsafev1.AddToScheme(scheme.Scheme)
+	dsp := &drainsafev1.DrainSafePolicy{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	f := fake.NewFakeClient(dsp)
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:   f,
+		Recorder: recorder,
+		Log:      ctrl.Log,
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummynode",
+			Annotations: make(map[string]string),
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	refused := errors.Wrapf(apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0), "gave up evicting pod")
+	c := &fakeKubeClient{
+		drainerr: errors.New("failed to evict 1 pods"),
+		drainResult: &kubectl.DrainResult{Pods: []kubectl.PodResult{
+			{Namespace: "default", Name: "web-1", Evicted: true},
+			{Namespace: "default", Name: "web-2", Err: refused, DisruptionBudgets: []string{"default/web-pdb"}},
+		}},
+	}
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Draining
+	node.Annotations[annotations.DrainSafeMaintenanceType] = "Reboot"
+	node.Annotations[annotations.DrainSafeNotBefore] = time.Now().Add(1 * time.Minute).UTC().Format(time.RFC1123)
+
+	// blocked pods are recorded, drain keeps waiting by default
+	res, err := reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{RequeueAfter: 1 * time.Minute}, res)
+	assert.Equal(annotations.Draining, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("default/web-2", node.Annotations[annotations.DrainSafeBlockedPods])
+	assert.Equal("default/web-pdb", node.Annotations[annotations.DrainSafeBlockingBudgets])
+	assert.False(c.drainOptions.ForceDelete)
+	assert.Equal("Warning DisruptionBlocked dummynode eviction of default/web-2 refused by pod disruption budgets default/web-pdb by  on ", <-recorder.Events)
+	nm := &drainsafev1.NodeMaintenance{}
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, nm)
+	assert.Nil(err)
+	condition := nm.Status.GetCondition(drainsafev1.DisruptionBlockedCondition)
+	assert.NotNil(condition)
+	assert.Equal(corev1.ConditionTrue, condition.Status)
+	assert.Equal("eviction of default/web-2 refused by pod disruption budgets default/web-pdb", condition.Message)
+
+	// alert only approves the maintenance once escalation is due
+	err = f.Get(context.TODO(), types.NamespacedName{Name: "default"}, dsp)
+	assert.Nil(err)
+	dsp.Spec.Drain.DisruptionBudgetEscalation = drainsafev1.EscalationAlertOnly
+	err = f.Update(context.TODO(), dsp)
+	assert.Nil(err)
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.False(c.drainOptions.ForceDelete)
+	assert.InDelta(float64(50*time.Second), float64(c.drainOptions.Timeout), float64(2*time.Second))
+	assert.Equal(annotations.Drained, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("failed to evict 1 pods", node.Annotations[annotations.DrainSafeDrainResult])
+	assert.Contains(<-recorder.Events, "Warning DisruptionBlocked")
+	assert.Equal("Warning DisruptionBudgetEscalated dummynode maintenance approved with pods blocked by pod disruption budgets by  on ", <-recorder.Events)
+	assert.Equal("Normal NodeDrained dummynode by  on ", <-recorder.Events)
+
+	// force delete deletes blocked pods once escalation is due
+	err = f.Get(context.TODO(), types.NamespacedName{Name: "default"}, dsp)
+	assert.Nil(err)
+	dsp.Spec.Drain.DisruptionBudgetEscalation = drainsafev1.EscalationForceDelete
+	err = f.Update(context.TODO(), dsp)
+	assert.Nil(err)
+	c = &fakeKubeClient{}
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Draining
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.True(c.drainOptions.ForceDelete)
+	assert.Equal(annotations.Drained, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.NotContains(node.Annotations, annotations.DrainSafeBlockedPods)
+	assert.NotContains(node.Annotations, annotations.DrainSafeDrainResult)
+	assert.Equal("Warning DisruptionBudgetEscalated dummynode force deleted pods blocked by pod disruption budgets default/web-pdb by  on ", <-recorder.Events)
+	nm = &drainsafev1.NodeMaintenance{}
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, nm)
+	assert.Nil(err)
+	assert.Equal(corev1.ConditionFalse, nm.Status.GetCondition(drainsafev1.DisruptionBlockedCondition).Status)
+
+	// evictions are retried until escalation is due
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Draining
+	node.Annotations[annotations.DrainSafeNotBefore] = time.Now().Add(10 * time.Minute).UTC().Format(time.RFC1123)
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.False(c.drainOptions.ForceDelete)
+	assert.InDelta(float64(8*time.Minute), float64(c.drainOptions.Timeout), float64(2*time.Second))
+}
+
+func TestHooks(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	drainsafev1.AddToScheme(scheme.Scheme)
+	calls := []string{}
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls = append(calls, req.URL.Path)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	retries := int32(0)
+	f := fake.NewFakeClient(&drainsafev1.DrainSafePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "default"},
+		Spec: drainsafev1.DrainSafePolicySpec{
+			Hooks: drainsafev1.HooksSpec{
+				PreDrain: []drainsafev1.Hook{
+					{Name: "deregister", Webhook: &drainsafev1.WebhookHook{URL: server.URL + "/deregister"}},
+				},
+				PostMaintenance: []drainsafev1.Hook{
+					{Name: "register", Webhook: &drainsafev1.WebhookHook{URL: server.URL + "/register"}, Retries: &retries, FailurePolicy: drainsafev1.HookFailureFail},
+				},
+			},
+		},
+	})
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:   f,
+		Recorder: recorder,
+		Log:      ctrl.Log,
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummynode",
+			Annotations: make(map[string]string),
+		},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Cordoned
+	node.Annotations[annotations.DrainSafeMaintenanceType] = "Reboot"
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(annotations.PreDrain, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("Normal NodePreDrain dummynode by  on ", <-recorder.Events)
+
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Draining, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal([]string{"/deregister"}, calls)
+	assert.Equal("Normal HookSucceeded dummynode PreDrain hook deregister succeeded by  on ", <-recorder.Events)
+	assert.Equal("Normal NodeDraining dummynode by  on ", <-recorder.Events)
+
+	// post maintenance hooks run before the node is uncordoned, failures block
+	status = http.StatusServiceUnavailable
+	node.Spec.Unschedulable = true
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Running
+	node.Annotations[annotations.DrainSafeMaintenanceOwner] = annotations.Drainsafe
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(annotations.PostMaintenance, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("Normal NodePostMaintenance dummynode by  on ", <-recorder.Events)
+
+	res, err := reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{RequeueAfter: 1 * time.Minute}, res)
+	assert.Equal(annotations.PostMaintenance, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Contains(node.Annotations[annotations.DrainSafeHookStatus], `"failed":true`)
+	assert.Equal("Warning HookFailed dummynode PostMaintenance hook register failed by  on : webhook returned 503 Service Unavailable", <-recorder.Events)
+
+	// nodes held by failed hooks are never reset, even with the event of the last maintenance recorded
+	node.Annotations[annotations.DrainSafeEventID] = "F3E6E2D2-E86A-47F0-AA8E-18918049A2B1"
+	node.Annotations[annotations.DrainSafeMaintenanceStateTime] = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{RequeueAfter: 1 * time.Minute}, res)
+	assert.Equal(annotations.PostMaintenance, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Empty(recorder.Events)
+
+	// hook status is reset once the node enters the hook state again
+	status = http.StatusOK
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Running
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.NotContains(node.Annotations, annotations.DrainSafeHookStatus)
+	assert.Equal("Normal NodePostMaintenance dummynode by  on ", <-recorder.Events)
+
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Running, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("", node.Annotations[annotations.DrainSafeMaintenanceOwner])
+	assert.Equal([]string{"/deregister", "/register", "/register"}, calls)
+	assert.Equal("Normal HookSucceeded dummynode PostMaintenance hook register succeeded by  on ", <-recorder.Events)
+	assert.Equal("Normal NodeUncordoned dummynode by  on ", <-recorder.Events)
+}
+
+func TestCoordinator(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	f := fake.NewFakeClient()
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:      f,
+		Recorder:    recorder,
+		Log:         ctrl.Log,
+		Coordinator: coordinator.New(f, nil, "drainsafe-system", intstr.FromInt(1), ""),
+	}
+
+	nodes := []*corev1.Node{}
+	for _, name := range []string{"node1", "node2"} {
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Annotations: map[string]string{annotations.DrainSafeMaintenance: annotations.Scheduled},
+			},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+			},
+		}
+		err := f.Create(context.TODO(), node)
+		assert.Nil(err)
+		nodes = append(nodes, node)
+	}
+
+	res, err := reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, nodes[0])
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{}, res)
+	assert.Equal(annotations.MaintenanceApproved, nodes[0].Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("Normal MaintenanceApproved node1 by  on ", <-recorder.Events)
+
+	// second node waits until the first node is uncordoned
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, nodes[1])
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{RequeueAfter: 1 * time.Minute}, res)
+	assert.Equal(annotations.Scheduled, nodes[1].Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("Normal MaintenanceThrottled node2 waiting for a maintenance slot by  on ", <-recorder.Events)
+
+	nodes[0].Spec.Unschedulable = true
+	nodes[0].Annotations[annotations.DrainSafeMaintenance] = annotations.Running
+	nodes[0].Annotations[annotations.DrainSafeMaintenanceOwner] = annotations.Drainsafe
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, nodes[0])
+	assert.Nil(err)
+	assert.Equal("Normal NodeUncordoned node1 by  on ", <-recorder.Events)
+	cm := &corev1.ConfigMap{}
+	err = f.Get(context.TODO(), types.NamespacedName{Namespace: "drainsafe-system", Name: coordinator.DefaultName}, cm)
+	assert.Nil(err)
+	assert.Empty(cm.Data)
+
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, nodes[1])
+	assert.Nil(err)
+	assert.Equal(annotations.MaintenanceApproved, nodes[1].Annotations[annotations.DrainSafeMaintenance])
+}
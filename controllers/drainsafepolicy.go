@@ -0,0 +1,364 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	drainsafev1 "github.com/awesomenix/drainsafe/api/v1"
+	"github.com/awesomenix/drainsafe/azure"
+	"github.com/awesomenix/drainsafe/hooks"
+	"github.com/awesomenix/drainsafe/kubectl"
+	"github.com/awesomenix/drainsafe/policy"
+	"github.com/awesomenix/drainsafe/statemachine"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// +kubebuilder:rbac:groups=drainsafe.azure.com,resources=drainsafepolicies,verbs=get;list;watch
+
+const (
+	// defaultRequeueAfter drainsafe controller retry interval if not set by DrainSafePolicy
+	defaultRequeueAfter = 1 * time.Minute
+	// defaultScheduledEventRequeueAfter scheduled event controller retry interval if not set by DrainSafePolicy
+	defaultScheduledEventRequeueAfter = 30 * time.Second
+	// defaultDrainTimeout how long a drain may run if not set by DrainSafePolicy
+	defaultDrainTimeout = 30 * time.Minute
+	// defaultWaveTimeout how long a drain waits for pods of a wave to be rescheduled if not set by DrainSafePolicy
+	defaultWaveTimeout = 2 * time.Minute
+	// defaultEscalateBefore how long before NotBefore blocked drains are escalated if not set by DrainSafePolicy
+	defaultEscalateBefore = 2 * time.Minute
+	// defaultVerifyTimeout how long evicted pods are verified to be rescheduled if not set by DrainSafePolicy
+	defaultVerifyTimeout = 5 * time.Minute
+)
+
+// maintenancePolicy tunables of a node, resolved from DrainSafePolicy and command line flags
+type maintenancePolicy struct {
+	// name and resourceVersion of the DrainSafePolicy applied, empty if none selects the node
+	name            string
+	resourceVersion string
+
+	eventPolicy                policy.EventPolicy
+	gracePeriods               map[string]int
+	requeueAfter               time.Duration
+	scheduledEventRequeueAfter time.Duration
+	drainTimeout               time.Duration
+	ignoreDaemonSets           bool
+	force                      bool
+	deleteLocalData            bool
+	podPolicies                []kubectl.PodPolicySelector
+	waveOrder                  kubectl.WaveOrder
+	waveTimeout                time.Duration
+	verifyReschedule           bool
+	verifyTimeout              time.Duration
+	escalation                 drainsafev1.DisruptionBudgetEscalation
+	escalateBefore             time.Duration
+	preDrainHooks              []hooks.Hook
+	postMaintenanceHooks       []hooks.Hook
+	healthGate                 bool
+	healthConditions           []corev1.NodeConditionType
+	probeSelector              labels.Selector
+	probeNamespace             string
+	stuckTimeout               time.Duration
+	stuckRecovery              drainsafev1.StuckStateRecovery
+}
+
+// defaultMaintenancePolicy tunables from command line flags, used when no DrainSafePolicy selects a node
+func defaultMaintenancePolicy(eventPolicy policy.EventPolicy) *maintenancePolicy {
+	p := &maintenancePolicy{
+		eventPolicy:                policy.EventPolicy{},
+		gracePeriods:               map[string]int{},
+		requeueAfter:               defaultRequeueAfter,
+		scheduledEventRequeueAfter: defaultScheduledEventRequeueAfter,
+		drainTimeout:               defaultDrainTimeout,
+		ignoreDaemonSets:           true,
+		force:                      true,
+		deleteLocalData:            true,
+		waveTimeout:                defaultWaveTimeout,
+		verifyTimeout:              defaultVerifyTimeout,
+		escalation:                 drainsafev1.EscalationWait,
+		escalateBefore:             defaultEscalateBefore,
+		healthGate:                 true,
+		stuckTimeout:               statemachine.DefaultStuckTimeout,
+		stuckRecovery:              drainsafev1.StuckStateReset,
+	}
+	if eventPolicy == nil {
+		eventPolicy = policy.DefaultEventPolicy()
+	}
+	for eventType, action := range eventPolicy {
+		p.eventPolicy[eventType] = action
+	}
+	return p
+}
+
+// getMaintenancePolicy resolves tunables of node, the highest priority DrainSafePolicy selecting
+// the node is merged over command line flags. Policies are read from the manager cache on
+// every call so changes apply without a restart.
+func getMaintenancePolicy(ctx context.Context, c client.Reader, node *corev1.Node, eventPolicy policy.EventPolicy) (*maintenancePolicy, error) {
+	p := defaultMaintenancePolicy(eventPolicy)
+
+	policies := &drainsafev1.DrainSafePolicyList{}
+	if err := c.List(ctx, policies); err != nil {
+		if meta.IsNoMatchError(err) || runtime.IsNotRegisteredError(err) {
+			// DrainSafePolicy is not installed
+			return p, nil
+		}
+		return nil, err
+	}
+
+	selected := []drainsafev1.DrainSafePolicy{}
+	for _, dsp := range policies.Items {
+		selector := labels.Everything()
+		if dsp.Spec.NodeSelector != nil {
+			s, err := metav1.LabelSelectorAsSelector(dsp.Spec.NodeSelector)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid node selector in drainsafe policy %s", dsp.Name)
+			}
+			selector = s
+		}
+		if selector.Matches(labels.Set(node.Labels)) {
+			selected = append(selected, dsp)
+		}
+	}
+	if len(selected) == 0 {
+		return p, nil
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		if selected[i].Spec.Priority != selected[j].Spec.Priority {
+			return selected[i].Spec.Priority > selected[j].Spec.Priority
+		}
+		return selected[i].Name < selected[j].Name
+	})
+
+	dsp := selected[0]
+	p.name = dsp.Name
+	p.resourceVersion = dsp.ResourceVersion
+	for eventType, action := range dsp.Spec.EventActions {
+		if err := p.eventPolicy.Set(eventType + "=" + string(action)); err != nil {
+			return nil, errors.Wrapf(err, "invalid event action in drainsafe policy %s", dsp.Name)
+		}
+	}
+	for eventType, gracePeriod := range dsp.Spec.GracePeriodSeconds {
+		p.gracePeriods[eventType] = int(gracePeriod)
+	}
+	if dsp.Spec.RequeueAfter != nil && dsp.Spec.RequeueAfter.Duration > 0 {
+		p.requeueAfter = dsp.Spec.RequeueAfter.Duration
+	}
+	if dsp.Spec.ScheduledEventRequeueAfter != nil && dsp.Spec.ScheduledEventRequeueAfter.Duration > 0 {
+		p.scheduledEventRequeueAfter = dsp.Spec.ScheduledEventRequeueAfter.Duration
+	}
+	if dsp.Spec.DrainTimeout != nil && dsp.Spec.DrainTimeout.Duration > 0 {
+		p.drainTimeout = dsp.Spec.DrainTimeout.Duration
+	}
+	if dsp.Spec.Drain.IgnoreDaemonSets != nil {
+		p.ignoreDaemonSets = *dsp.Spec.Drain.IgnoreDaemonSets
+	}
+	if dsp.Spec.Drain.Force != nil {
+		p.force = *dsp.Spec.Drain.Force
+	}
+	if dsp.Spec.Drain.DeleteLocalData != nil {
+		p.deleteLocalData = *dsp.Spec.Drain.DeleteLocalData
+	}
+	for _, podPolicy := range dsp.Spec.Drain.PodPolicies {
+		selector, err := metav1.LabelSelectorAsSelector(&podPolicy.Selector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pod selector in drainsafe policy %s", dsp.Name)
+		}
+		drainPolicy, err := kubectl.ParsePodDrainPolicy(string(podPolicy.Policy))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pod policy in drainsafe policy %s", dsp.Name)
+		}
+		p.podPolicies = append(p.podPolicies, kubectl.PodPolicySelector{Selector: selector, Policy: drainPolicy})
+	}
+	waveOrder, err := kubectl.ParseWaveOrder(string(dsp.Spec.Drain.WaveOrder))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid wave order in drainsafe policy %s", dsp.Name)
+	}
+	p.waveOrder = waveOrder
+	if dsp.Spec.Drain.WaveTimeout != nil && dsp.Spec.Drain.WaveTimeout.Duration > 0 {
+		p.waveTimeout = dsp.Spec.Drain.WaveTimeout.Duration
+	}
+	p.verifyReschedule = dsp.Spec.Drain.VerifyReschedule
+	if dsp.Spec.Drain.VerifyTimeout != nil && dsp.Spec.Drain.VerifyTimeout.Duration > 0 {
+		p.verifyTimeout = dsp.Spec.Drain.VerifyTimeout.Duration
+	}
+	if dsp.Spec.Drain.DisruptionBudgetEscalation != "" {
+		p.escalation = dsp.Spec.Drain.DisruptionBudgetEscalation
+	}
+	if dsp.Spec.Drain.EscalateBefore != nil && dsp.Spec.Drain.EscalateBefore.Duration > 0 {
+		p.escalateBefore = dsp.Spec.Drain.EscalateBefore.Duration
+	}
+	if p.preDrainHooks, err = convertHooks(dsp.Spec.Hooks.PreDrain); err != nil {
+		return nil, errors.Wrapf(err, "invalid pre drain hook in drainsafe policy %s", dsp.Name)
+	}
+	if p.postMaintenanceHooks, err = convertHooks(dsp.Spec.Hooks.PostMaintenance); err != nil {
+		return nil, errors.Wrapf(err, "invalid post maintenance hook in drainsafe policy %s", dsp.Name)
+	}
+	p.healthGate = !dsp.Spec.HealthGate.Disabled
+	p.healthConditions = dsp.Spec.HealthGate.Conditions
+	if dsp.Spec.HealthGate.ProbeSelector != nil {
+		if p.probeSelector, err = metav1.LabelSelectorAsSelector(dsp.Spec.HealthGate.ProbeSelector); err != nil {
+			return nil, errors.Wrapf(err, "invalid probe selector in drainsafe policy %s", dsp.Name)
+		}
+		p.probeNamespace = dsp.Spec.HealthGate.ProbeNamespace
+	}
+	if dsp.Spec.StuckState.Timeout != nil && dsp.Spec.StuckState.Timeout.Duration > 0 {
+		p.stuckTimeout = dsp.Spec.StuckState.Timeout.Duration
+	}
+	if dsp.Spec.StuckState.Recovery != "" {
+		p.stuckRecovery = dsp.Spec.StuckState.Recovery
+	}
+	return p, nil
+}
+
+// convertHooks converts hooks of a DrainSafePolicy, filling in defaults
+func convertHooks(specs []drainsafev1.Hook) ([]hooks.Hook, error) {
+	converted := []hooks.Hook{}
+	for _, spec := range specs {
+		if (spec.Webhook == nil) == (spec.Job == nil) {
+			return nil, errors.Errorf("hook %s must set exactly one of webhook or job", spec.Name)
+		}
+		hook := hooks.Hook{
+			Name:          spec.Name,
+			Timeout:       hooks.DefaultTimeout,
+			Retries:       hooks.DefaultRetries,
+			IgnoreFailure: spec.FailurePolicy != drainsafev1.HookFailureFail,
+		}
+		if spec.Webhook != nil {
+			hook.Webhook = &hooks.Webhook{URL: spec.Webhook.URL}
+		}
+		if spec.Job != nil {
+			hook.Job = &hooks.Job{
+				Namespace:          spec.Job.Namespace,
+				Image:              spec.Job.Image,
+				Command:            spec.Job.Command,
+				Args:               spec.Job.Args,
+				ServiceAccountName: spec.Job.ServiceAccountName,
+			}
+		}
+		if spec.Timeout != nil && spec.Timeout.Duration > 0 {
+			hook.Timeout = spec.Timeout.Duration
+		}
+		if spec.Retries != nil {
+			hook.Retries = int(*spec.Retries)
+		}
+		converted = append(converted, hook)
+	}
+	return converted, nil
+}
+
+// version identifies the DrainSafePolicy applied, changes whenever the policy is switched or updated
+func (p *maintenancePolicy) version() string {
+	if p.name == "" {
+		return ""
+	}
+	return p.name + "/" + p.resourceVersion
+}
+
+// gracePeriod pod termination grace period in seconds for maintenance type
+func (p *maintenancePolicy) gracePeriod(maintenanceType string) int {
+	if gracePeriod, ok := p.gracePeriods[maintenanceType]; ok {
+		return gracePeriod
+	}
+	return getGraceTimeoutPeriod(maintenanceType)
+}
+
+const (
+	// minDrainBudget minimum time left before NotBefore to drain safely
+	minDrainBudget = 30 * time.Second
+	// drainMargin time reserved after pod grace period to complete eviction before NotBefore
+	drainMargin = 10 * time.Second
+)
+
+// drainOptions derives pod grace period and drain timeout from the time left before
+// notBefore, returns false if the time left is too short to drain safely
+func (p *maintenancePolicy) drainOptions(maintenanceType, notBefore string, now time.Time) (kubectl.DrainOptions, bool) {
+	options := kubectl.DrainOptions{
+		GracePeriod:      p.gracePeriod(maintenanceType),
+		IgnoreDaemonSets: p.ignoreDaemonSets,
+		Force:            p.force,
+		DeleteLocalData:  p.deleteLocalData,
+		PodPolicies:      p.podPolicies,
+		WaveOrder:        p.waveOrder,
+		WaveTimeout:      p.waveTimeout,
+	}
+	deadline, err := azure.ParseNotBefore(notBefore)
+	if err != nil {
+		return options, true
+	}
+
+	budget := deadline.Sub(now)
+	if budget < drainMargin {
+		budget = drainMargin
+	}
+	options.Timeout = budget
+	if gracePeriod := int((budget - drainMargin) / time.Second); gracePeriod < options.GracePeriod {
+		options.GracePeriod = gracePeriod
+	}
+	if options.GracePeriod < 1 {
+		options.GracePeriod = 1
+	}
+	if p.escalation != drainsafev1.EscalationWait {
+		// stop retrying evictions refused by pod disruption budgets once escalation is due
+		if untilEscalation := deadline.Add(-p.escalateBefore).Sub(now); untilEscalation > 0 {
+			if untilEscalation < options.Timeout {
+				options.Timeout = untilEscalation
+			}
+		} else {
+			// escalation is due, stop draining in time to approve the maintenance before notBefore
+			if untilDeadline := deadline.Add(-drainMargin).Sub(now); untilDeadline < options.Timeout {
+				options.Timeout = untilDeadline
+			}
+			if options.Timeout < time.Second {
+				options.Timeout = time.Second
+			}
+			options.ForceDelete = p.escalation == drainsafev1.EscalationForceDelete
+		}
+	}
+	return options, budget >= minDrainBudget
+}
+
+// escalating checks if drains blocked by pod disruption budgets are escalated, i.e. less than
+// escalateBefore is left before notBefore
+func (p *maintenancePolicy) escalating(notBefore string, now time.Time) bool {
+	if p.escalation == drainsafev1.EscalationWait {
+		return false
+	}
+	deadline, err := azure.ParseNotBefore(notBefore)
+	if err != nil {
+		return false
+	}
+	return !now.Before(deadline.Add(-p.escalateBefore))
+}
+
+// verifyDeadline time after which verification of rescheduled pods gives up, verifyTimeout from
+// now bounded by notBefore less drainMargin so the maintenance is still approved in time
+func (p *maintenancePolicy) verifyDeadline(notBefore string, now time.Time) time.Time {
+	deadline := now.Add(p.verifyTimeout)
+	if eventDeadline, err := azure.ParseNotBefore(notBefore); err == nil {
+		if eventDeadline = eventDeadline.Add(-drainMargin); eventDeadline.Before(deadline) {
+			deadline = eventDeadline
+		}
+	}
+	return deadline
+}
+
+func getGraceTimeoutPeriod(maintenanceType string) int {
+	switch maintenanceType {
+	case "Reboot", "Freeze":
+		return 840
+	case "Redeploy":
+		return 540
+	case "Preempt":
+		return 15
+	}
+	return 60
+}
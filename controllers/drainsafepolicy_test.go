@@ -0,0 +1,194 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package controllers_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	drainsafev1 "github.com/awesomenix/drainsafe/api/v1"
+	"github.com/awesomenix/drainsafe/azure"
+	"github.com/awesomenix/drainsafe/controllers"
+	"github.com/awesomenix/drainsafe/kubectl"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDrainSafePolicy(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	drainsafev1.AddToScheme(scheme.Scheme)
+	force := false
+	f := fake.NewFakeClient(
+		&drainsafev1.DrainSafePolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "default"},
+			Spec: drainsafev1.DrainSafePolicySpec{
+				GracePeriodSeconds: map[string]int32{"Reboot": 300},
+			},
+		},
+		&drainsafev1.DrainSafePolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "gpu"},
+			Spec: drainsafev1.DrainSafePolicySpec{
+				NodeSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"pool": "gpu"}},
+				Priority:           10,
+				EventActions:       map[string]drainsafev1.EventAction{"Freeze": "CordonOnly"},
+				GracePeriodSeconds: map[string]int32{"Reboot": 120},
+				RequeueAfter:       &metav1.Duration{Duration: 5 * time.Minute},
+				Drain: drainsafev1.DrainSpec{
+					Force:       &force,
+					WaveOrder:   "PriorityClass",
+					WaveTimeout: &metav1.Duration{Duration: 30 * time.Second},
+				},
+			},
+		},
+	)
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:   f,
+		Recorder: &record.FakeRecorder{},
+		Log:      ctrl.Log,
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummynode",
+			Annotations: make(map[string]string),
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	c := &fakeKubeClient{}
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Draining
+	node.Annotations[annotations.DrainSafeMaintenanceType] = "Reboot"
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.Equal(kubectl.DrainOptions{GracePeriod: 300, IgnoreDaemonSets: true, Force: true, DeleteLocalData: true, WaveTimeout: 2 * time.Minute}, c.drainOptions)
+
+	node.Labels = map[string]string{"pool": "gpu"}
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Draining
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.Equal(kubectl.DrainOptions{GracePeriod: 120, IgnoreDaemonSets: true, Force: false, DeleteLocalData: true, WaveOrder: kubectl.WaveOrderPriorityClass, WaveTimeout: 30 * time.Second}, c.drainOptions)
+
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Cordoning
+	res, err := reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{cordonerr: errors.New("error")}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{RequeueAfter: 5 * time.Minute}, res)
+
+	node.Spec.Unschedulable = true
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Cordoned
+	node.Annotations[annotations.DrainSafeMaintenanceType] = "Freeze"
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Drained, node.Annotations[annotations.DrainSafeMaintenance])
+}
+
+func TestScheduledEventDrainSafePolicy(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	drainsafev1.AddToScheme(scheme.Scheme)
+	dsp := &drainsafev1.DrainSafePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "default"},
+		Spec: drainsafev1.DrainSafePolicySpec{
+			EventActions: map[string]drainsafev1.EventAction{"Reboot": "Ignore"},
+		},
+	}
+	f := fake.NewFakeClient(dsp)
+	reconciler := &controllers.ScheduledEventReconciler{
+		Client:         f,
+		Recorder:       &record.FakeRecorder{},
+		Log:            ctrl.Log,
+		AzClient:       azure.NewWithQuery(&testQuery{get: scheduledevent}),
+		Hostname:       "dummyhostname",
+		VMInstanceName: "controlplane_0",
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummyhostname",
+			Annotations: make(map[string]string),
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	node = &corev1.Node{}
+	err = f.Get(context.TODO(), types.NamespacedName{Name: "dummyhostname"}, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Running, node.Annotations[annotations.DrainSafeMaintenance])
+
+	// policy change is picked up although the scheduled events document did not change
+	err = f.Get(context.TODO(), types.NamespacedName{Name: "default"}, dsp)
+	assert.Nil(err)
+	dsp.Spec.EventActions["Reboot"] = "Drain"
+	err = f.Update(context.TODO(), dsp)
+	assert.Nil(err)
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	err = f.Get(context.TODO(), types.NamespacedName{Name: "dummyhostname"}, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Running, node.Annotations[annotations.DrainSafeMaintenance])
+	// the policy watch requeues the node, whose event finds the changed policy
+	_, err = reconciler.ProcessNodeEvent(node)
+	assert.Nil(err)
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	err = f.Get(context.TODO(), types.NamespacedName{Name: "dummyhostname"}, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Scheduled, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("Reboot", node.Annotations[annotations.DrainSafeMaintenanceType])
+}
+
+func TestDrainSafePolicyPodPolicies(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	drainsafev1.AddToScheme(scheme.Scheme)
+	f := fake.NewFakeClient(&drainsafev1.DrainSafePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "default"},
+		Spec: drainsafev1.DrainSafePolicySpec{
+			Drain: drainsafev1.DrainSpec{
+				PodPolicies: []drainsafev1.PodPolicy{
+					{Selector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}, Policy: "never"},
+				},
+			},
+		},
+	})
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:   f,
+		Recorder: recorder,
+		Log:      ctrl.Log,
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummynode",
+			Annotations: make(map[string]string),
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	c := &fakeKubeClient{drainerr: errors.Wrapf(kubectl.ErrDrainBlocked, "default/db")}
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Draining
+	node.Annotations[annotations.DrainSafeMaintenanceType] = "Reboot"
+	res, err := reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{RequeueAfter: 1 * time.Minute}, res)
+	assert.Equal(annotations.Draining, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Len(c.drainOptions.PodPolicies, 1)
+	assert.Equal(kubectl.PodDrainNever, c.drainOptions.PodPolicies[0].Policy)
+	assert.True(c.drainOptions.PodPolicies[0].Selector.Matches(labels.Set{"app": "db"}))
+	assert.Contains(<-recorder.Events, "Warning DrainBlocked dummynode")
+}
@@ -0,0 +1,59 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/awesomenix/drainsafe/kubectl"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// pressureConditions node conditions which must not be True for a node to be uncordoned
+var pressureConditions = []corev1.NodeConditionType{
+	corev1.NodeMemoryPressure,
+	corev1.NodeDiskPressure,
+	corev1.NodePIDPressure,
+	corev1.NodeNetworkUnavailable,
+}
+
+// checkNodeHealth returns why node is not healthy enough to be uncordoned after maintenance,
+// empty if it is. Ready has to be True, pressure conditions and conditions of the policy must
+// not be True, and a ready probe pod has to run on the node if the policy selects probe pods.
+func checkNodeHealth(ctx context.Context, p *maintenancePolicy, c kubectl.ContextClient, node *corev1.Node) ([]string, error) {
+	if !p.healthGate {
+		return nil, nil
+	}
+	reasons := []string{}
+	conditions := map[corev1.NodeConditionType]corev1.NodeCondition{}
+	for _, condition := range node.Status.Conditions {
+		conditions[condition.Type] = condition
+	}
+	if ready, ok := conditions[corev1.NodeReady]; !ok {
+		reasons = append(reasons, "Ready condition not reported")
+	} else if ready.Status != corev1.ConditionTrue {
+		reasons = append(reasons, fmt.Sprintf("Ready is %s: %s", ready.Status, ready.Message))
+	}
+	checked := append(append([]corev1.NodeConditionType{}, pressureConditions...), p.healthConditions...)
+	for _, conditionType := range checked {
+		if condition, ok := conditions[conditionType]; ok && condition.Status == corev1.ConditionTrue {
+			reasons = append(reasons, fmt.Sprintf("%s is True: %s", conditionType, condition.Message))
+		}
+	}
+	if p.probeSelector != nil {
+		prober, ok := c.(kubectl.ReadinessProber)
+		if !ok {
+			return append(reasons, fmt.Sprintf("probe pods %s cannot be checked", p.probeSelector)), nil
+		}
+		ready, err := prober.ProbeReady(ctx, node.Name, p.probeNamespace, p.probeSelector)
+		if err != nil {
+			return nil, err
+		}
+		if !ready {
+			reasons = append(reasons, fmt.Sprintf("no ready probe pod %s", p.probeSelector))
+		}
+	}
+	return reasons, nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package controllers_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	drainsafev1 "github.com/awesomenix/drainsafe/api/v1"
+	"github.com/awesomenix/drainsafe/controllers"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestHealthGate(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	drainsafev1.AddToScheme(scheme.Scheme)
+	dsp := &drainsafev1.DrainSafePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "default"},
+		Spec: drainsafev1.DrainSafePolicySpec{
+			HealthGate: drainsafev1.HealthGateSpec{
+				Conditions: []corev1.NodeConditionType{"KernelDeadlock"},
+			},
+		},
+	}
+	f := fake.NewFakeClient(dsp)
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:   f,
+		Recorder: recorder,
+		Log:      ctrl.Log,
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "dummynode",
+			Annotations: map[string]string{
+				annotations.DrainSafeMaintenance:      annotations.Running,
+				annotations.DrainSafeMaintenanceOwner: annotations.Drainsafe,
+			},
+		},
+		Spec: corev1.NodeSpec{Unschedulable: true},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeReady, Status: corev1.ConditionFalse, Message: "container runtime network not ready"},
+				{Type: corev1.NodeDiskPressure, Status: corev1.ConditionTrue, Message: "disk full"},
+				{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionFalse},
+				{Type: "KernelDeadlock", Status: corev1.ConditionTrue, Message: "task hung"},
+			},
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	// unhealthy nodes are kept cordoned
+	res, err := reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{RequeueAfter: 1 * time.Minute}, res)
+	assert.Equal(annotations.Drainsafe, node.Annotations[annotations.DrainSafeMaintenanceOwner])
+	assert.Equal("Warning HealthGateFailed dummynode kept cordoned by  on : Ready is False: container runtime network not ready, DiskPressure is True: disk full, KernelDeadlock is True: task hung", <-recorder.Events)
+
+	// probe pods have to be ready once nodes report healthy conditions
+	node.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}
+	err = f.Get(context.TODO(), types.NamespacedName{Name: "default"}, dsp)
+	assert.Nil(err)
+	dsp.Spec.HealthGate.ProbeSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "node-probe"}}
+	dsp.Spec.HealthGate.ProbeNamespace = "kube-system"
+	err = f.Update(context.TODO(), dsp)
+	assert.Nil(err)
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{RequeueAfter: 1 * time.Minute}, res)
+	assert.Equal("Warning HealthGateFailed dummynode kept cordoned by  on : no ready probe pod app=node-probe", <-recorder.Events)
+
+	// client which cannot probe keeps the node cordoned
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &contextKubeClient{&fakeKubeClient{probeReady: true}}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{RequeueAfter: 1 * time.Minute}, res)
+	assert.Equal("Warning HealthGateFailed dummynode kept cordoned by  on : probe pods app=node-probe cannot be checked", <-recorder.Events)
+
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{probeReady: true}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{}, res)
+	assert.Equal(annotations.Running, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("", node.Annotations[annotations.DrainSafeMaintenanceOwner])
+	assert.Equal("Normal NodeUncordoned dummynode by  on ", <-recorder.Events)
+
+	// disabled health gate uncordons right away
+	err = f.Get(context.TODO(), types.NamespacedName{Name: "default"}, dsp)
+	assert.Nil(err)
+	dsp.Spec.HealthGate.Disabled = true
+	err = f.Update(context.TODO(), dsp)
+	assert.Nil(err)
+	node.Status.Conditions = nil
+	node.Annotations[annotations.DrainSafeMaintenanceOwner] = annotations.Drainsafe
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{}, res)
+	assert.Equal("Normal NodeUncordoned dummynode by  on ", <-recorder.Events)
+}
@@ -0,0 +1,231 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	drainsafev1 "github.com/awesomenix/drainsafe/api/v1"
+	"github.com/awesomenix/drainsafe/azure"
+	"github.com/awesomenix/drainsafe/metrics"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// +kubebuilder:rbac:groups=drainsafe.azure.com,resources=nodemaintenances,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=drainsafe.azure.com,resources=nodemaintenances/status,verbs=get;update;patch
+
+// maxMaintenanceHistory past maintenances kept in the history of a NodeMaintenance
+const maxMaintenanceHistory = 10
+
+// conditionForState condition reached when entering maintenance state
+var conditionForState = map[string]drainsafev1.NodeMaintenanceConditionType{
+	annotations.MaintenanceApproved: drainsafev1.MaintenanceApprovedCondition,
+	annotations.Cordoned:            drainsafev1.NodeCordonedCondition,
+	annotations.Drained:             drainsafev1.NodeDrainedCondition,
+	annotations.Started:             drainsafev1.MaintenanceStartedCondition,
+	annotations.Running:             drainsafev1.MaintenanceCompletedCondition,
+}
+
+// startsMaintenance states a maintenance starts in
+var startsMaintenance = map[string]bool{
+	annotations.Scheduled:          true,
+	annotations.MaintenancePending: true,
+	annotations.ExpressDraining:    true,
+}
+
+// endsMaintenance phases of a maintenance which completed or is waiting for uncordon
+var endsMaintenance = map[string]bool{
+	annotations.Running:         true,
+	annotations.PostMaintenance: true,
+}
+
+// syncNodeMaintenance mirrors node maintenance annotations into the NodeMaintenance named after the node,
+// the annotations are the source of truth and the NodeMaintenance is only written when it is out of date
+func syncNodeMaintenance(ctx context.Context, c client.Client, node *corev1.Node) error {
+	state := node.Annotations[annotations.DrainSafeMaintenance]
+	if state == "" {
+		return nil
+	}
+
+	nm := &drainsafev1.NodeMaintenance{}
+	exists := true
+	if err := c.Get(ctx, types.NamespacedName{Name: node.Name}, nm); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		if state == annotations.Running {
+			// nothing to record for nodes which never had a maintenance
+			return nil
+		}
+		exists = false
+		nm = &drainsafev1.NodeMaintenance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: node.Name,
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "v1",
+					Kind:       "Node",
+					Name:       node.Name,
+					UID:        node.UID,
+				}},
+			},
+		}
+	}
+
+	before := nm.DeepCopy()
+	now := metav1.Now()
+	eventID := node.Annotations[annotations.DrainSafeEventID]
+	newEvent := eventID != "" && eventID != nm.Spec.EventID
+	restarted := startsMaintenance[state] && endsMaintenance[nm.Status.Phase]
+	if newEvent || restarted {
+		// new maintenance, keep the previous one in history and start over, maintenances
+		// without an event id start over once the node is scheduled again after the last one
+		history := nm.Status.History
+		if len(nm.Status.Transitions) != 0 {
+			history = appendHistory(history, newMaintenanceRecord(nm))
+		}
+		nm.Spec = drainsafev1.NodeMaintenanceSpec{EventID: eventID}
+		nm.Status = drainsafev1.NodeMaintenanceStatus{History: history}
+	}
+	nm.Spec.NodeName = node.Name
+	if eventType := node.Annotations[annotations.DrainSafeMaintenanceType]; eventType != "" {
+		nm.Spec.EventType = eventType
+	}
+	if notBefore, err := azure.ParseNotBefore(node.Annotations[annotations.DrainSafeNotBefore]); err == nil {
+		deadline := metav1.NewTime(notBefore)
+		nm.Spec.Deadline = &deadline
+	}
+
+	changed := nm.Status.Phase != state
+	transitions := nm.Status.Transitions
+	if changed {
+		nm.Status.Phase = state
+		nm.Status.Transitions = append(nm.Status.Transitions, drainsafev1.StateTransition{
+			Phase: state,
+			Time:  now,
+		})
+	}
+	if state == annotations.MaintenanceApproved || state == annotations.ExpressDraining {
+		nm.Status.Approver = node.Annotations[annotations.DrainSafeMaintenanceApprover]
+	}
+	if conditionType, ok := conditionForState[state]; ok {
+		nm.Status.SetCondition(drainsafev1.NodeMaintenanceCondition{
+			Type:               conditionType,
+			Status:             corev1.ConditionTrue,
+			LastTransitionTime: now,
+			Reason:             state,
+			Message:            node.Annotations[annotations.DrainSafeMaintenanceApprover],
+		})
+	}
+	if pods := node.Annotations[annotations.DrainSafeBlockedPods]; pods != "" {
+		nm.Status.SetCondition(drainsafev1.NodeMaintenanceCondition{
+			Type:               drainsafev1.DisruptionBlockedCondition,
+			Status:             corev1.ConditionTrue,
+			LastTransitionTime: now,
+			Reason:             "EvictionRefused",
+			Message:            fmt.Sprintf("eviction of %s refused by pod disruption budgets %s", pods, node.Annotations[annotations.DrainSafeBlockingBudgets]),
+		})
+	} else if condition := nm.Status.GetCondition(drainsafev1.DisruptionBlockedCondition); condition != nil && condition.Status == corev1.ConditionTrue {
+		nm.Status.SetCondition(drainsafev1.NodeMaintenanceCondition{
+			Type:               drainsafev1.DisruptionBlockedCondition,
+			Status:             corev1.ConditionFalse,
+			LastTransitionTime: now,
+			Reason:             state,
+		})
+	}
+	var drained *drainsafev1.DrainResult
+	switch state {
+	case annotations.Draining, annotations.ExpressDraining:
+		if nm.Status.Drain == nil {
+			nm.Status.Drain = &drainsafev1.DrainResult{StartTime: &now}
+		}
+	case annotations.Drained:
+		if nm.Status.Drain == nil {
+			nm.Status.Drain = &drainsafev1.DrainResult{StartTime: &now}
+		}
+		if nm.Status.Drain.CompletionTime == nil {
+			result := node.Annotations[annotations.DrainSafeDrainResult]
+			nm.Status.Drain.CompletionTime = &now
+			nm.Status.Drain.Succeeded = result == "" || result == annotations.DrainSucceeded
+			nm.Status.Drain.Message = result
+			if pods := node.Annotations[annotations.DrainSafeEvictedPods]; pods != "" {
+				nm.Status.Drain.EvictedPods = strings.Split(pods, ",")
+			}
+			drained = nm.Status.Drain.DeepCopy()
+		}
+	}
+
+	if exists && apiequality.Semantic.DeepEqual(before.Spec, nm.Spec) && apiequality.Semantic.DeepEqual(before.Status, nm.Status) {
+		return nil
+	}
+	status := nm.Status.DeepCopy()
+	if !exists {
+		if err := c.Create(ctx, nm); err != nil {
+			return err
+		}
+	} else if err := c.Update(ctx, nm); err != nil {
+		return err
+	}
+	nm.Status = *status
+	if err := c.Status().Update(ctx, nm); err != nil {
+		return err
+	}
+	if changed {
+		observeTransition(transitions, state, now.Time)
+	}
+	if drained != nil {
+		metrics.DrainDuration.WithLabelValues(strconv.FormatBool(drained.Succeeded)).Observe(drained.CompletionTime.Sub(drained.StartTime.Time).Seconds())
+	}
+	return nil
+}
+
+// newMaintenanceRecord summarizes the maintenance tracked by nm
+func newMaintenanceRecord(nm *drainsafev1.NodeMaintenance) drainsafev1.MaintenanceRecord {
+	return drainsafev1.MaintenanceRecord{
+		EventID:     nm.Spec.EventID,
+		EventType:   nm.Spec.EventType,
+		Deadline:    nm.Spec.Deadline,
+		Approver:    nm.Status.Approver,
+		Phase:       nm.Status.Phase,
+		Transitions: nm.Status.Transitions,
+		Drain:       nm.Status.Drain,
+	}
+}
+
+// appendHistory appends record to history, dropping the oldest records beyond maxMaintenanceHistory
+func appendHistory(history []drainsafev1.MaintenanceRecord, record drainsafev1.MaintenanceRecord) []drainsafev1.MaintenanceRecord {
+	history = append(history, record)
+	if len(history) > maxMaintenanceHistory {
+		history = history[len(history)-maxMaintenanceHistory:]
+	}
+	return history
+}
+
+// observeTransition records time spent in the phase left when entering state, and time
+// since the maintenance was scheduled once the node is drained
+func observeTransition(transitions []drainsafev1.StateTransition, state string, now time.Time) {
+	if len(transitions) == 0 {
+		return
+	}
+	previous := transitions[len(transitions)-1]
+	metrics.StateDuration.WithLabelValues(previous.Phase).Observe(now.Sub(previous.Time.Time).Seconds())
+	if state != annotations.Drained {
+		return
+	}
+	for _, transition := range transitions {
+		if transition.Phase == annotations.Scheduled {
+			metrics.ScheduledToDrained.Observe(now.Sub(transition.Time.Time).Seconds())
+			return
+		}
+	}
+}
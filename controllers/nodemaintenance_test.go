@@ -0,0 +1,237 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package controllers_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	drainsafev1 "github.com/awesomenix/drainsafe/api/v1"
+	"github.com/awesomenix/drainsafe/controllers"
+	"github.com/awesomenix/drainsafe/kubectl"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// statusErrClient fails status updates of NodeMaintenances
+type statusErrClient struct {
+	client.Client
+}
+
+func (c *statusErrClient) Status() client.StatusWriter {
+	return &statusErrWriter{c.Client.Status()}
+}
+
+type statusErrWriter struct {
+	client.StatusWriter
+}
+
+func (w *statusErrWriter) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	if _, ok := obj.(*drainsafev1.NodeMaintenance); ok {
+		return errors.New("status update failed")
+	}
+	return w.StatusWriter.Update(ctx, obj, opts...)
+}
+
+func TestNodeMaintenance(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	drainsafev1.AddToScheme(scheme.Scheme)
+	f := fake.NewFakeClient()
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:   f,
+		Recorder: &record.FakeRecorder{},
+		Log:      ctrl.Log,
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummynode",
+			Annotations: make(map[string]string),
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Scheduled
+	node.Annotations[annotations.DrainSafeMaintenanceType] = "Reboot"
+	node.Annotations[annotations.DrainSafeEventID] = "F3E6E2D2-E86A-47F0-AA8E-18918049A2B1"
+	node.Annotations[annotations.DrainSafeNotBefore] = "Sun, 30 Jun 2019 16:22:03 GMT"
+	c := &fakeKubeClient{drainResult: &kubectl.DrainResult{Pods: []kubectl.PodResult{
+		{Namespace: "default", Name: "web-1", Evicted: true},
+		{Namespace: "default", Name: "web-2", Evicted: true},
+	}}}
+	for i := 0; i < 5; i++ {
+		_, err := reconciler.ProcessNodeEvent(context.TODO(), c, nil, node)
+		assert.Nil(err)
+	}
+	assert.Equal(annotations.Drained, node.Annotations[annotations.DrainSafeMaintenance])
+
+	nm := &drainsafev1.NodeMaintenance{}
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, nm)
+	assert.Nil(err)
+	assert.Equal("dummynode", nm.Spec.NodeName)
+	assert.Equal("F3E6E2D2-E86A-47F0-AA8E-18918049A2B1", nm.Spec.EventID)
+	assert.Equal("Reboot", nm.Spec.EventType)
+	assert.Equal("2019-06-30T16:22:03Z", nm.Spec.Deadline.UTC().Format("2006-01-02T15:04:05Z"))
+	assert.Equal(annotations.Drained, nm.Status.Phase)
+	phases := []string{}
+	for _, transition := range nm.Status.Transitions {
+		phases = append(phases, transition.Phase)
+	}
+	assert.Equal([]string{
+		annotations.Scheduled,
+		annotations.MaintenanceApproved,
+		annotations.Cordoning,
+		annotations.Cordoned,
+		annotations.Draining,
+		annotations.Drained}, phases)
+	for _, conditionType := range []drainsafev1.NodeMaintenanceConditionType{
+		drainsafev1.MaintenanceApprovedCondition,
+		drainsafev1.NodeCordonedCondition,
+		drainsafev1.NodeDrainedCondition} {
+		condition := nm.Status.GetCondition(conditionType)
+		assert.NotNil(condition)
+		assert.Equal(corev1.ConditionTrue, condition.Status)
+	}
+	assert.Equal(annotations.Drainsafe, nm.Status.GetCondition(drainsafev1.MaintenanceApprovedCondition).Message)
+	assert.Nil(nm.Status.GetCondition(drainsafev1.MaintenanceStartedCondition))
+	assert.True(nm.Status.Drain.Succeeded)
+	assert.NotNil(nm.Status.Drain.StartTime)
+	assert.NotNil(nm.Status.Drain.CompletionTime)
+	assert.Equal([]string{"default/web-1", "default/web-2"}, nm.Status.Drain.EvictedPods)
+	assert.Equal(annotations.Drainsafe, nm.Status.Approver)
+	assert.Empty(nm.Status.History)
+
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Scheduled
+	node.Annotations[annotations.DrainSafeEventID] = "A0E6E2D2-E86A-47F0-AA8E-18918049A2B1"
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	nm = &drainsafev1.NodeMaintenance{}
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, nm)
+	assert.Nil(err)
+	assert.Equal("A0E6E2D2-E86A-47F0-AA8E-18918049A2B1", nm.Spec.EventID)
+	assert.Len(nm.Status.Transitions, 2)
+	assert.Nil(nm.Status.Drain)
+	assert.Len(nm.Status.History, 1)
+	record := nm.Status.History[0]
+	assert.Equal("F3E6E2D2-E86A-47F0-AA8E-18918049A2B1", record.EventID)
+	assert.Equal("Reboot", record.EventType)
+	assert.Equal("2019-06-30T16:22:03Z", record.Deadline.UTC().Format("2006-01-02T15:04:05Z"))
+	assert.Equal(annotations.Drainsafe, record.Approver)
+	assert.Equal(annotations.Drained, record.Phase)
+	assert.Len(record.Transitions, 6)
+	assert.True(record.Drain.Succeeded)
+	assert.Equal([]string{"default/web-1", "default/web-2"}, record.Drain.EvictedPods)
+
+	for i := 0; i < 12; i++ {
+		node.Annotations[annotations.DrainSafeMaintenance] = annotations.Scheduled
+		node.Annotations[annotations.DrainSafeEventID] = fmt.Sprintf("event-%d", i)
+		_, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+		assert.Nil(err)
+	}
+	nm = &drainsafev1.NodeMaintenance{}
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, nm)
+	assert.Nil(err)
+	assert.Len(nm.Status.History, 10)
+	assert.Equal("event-1", nm.Status.History[0].EventID)
+	assert.Equal("event-10", nm.Status.History[9].EventID)
+}
+
+func TestNodeMaintenanceSyncFailure(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	drainsafev1.AddToScheme(scheme.Scheme)
+	f := fake.NewFakeClient()
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:   &statusErrClient{f},
+		Recorder: &record.FakeRecorder{},
+		Log:      ctrl.Log,
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "dummynode",
+			Annotations: map[string]string{
+				annotations.DrainSafeMaintenance: annotations.Scheduled,
+				annotations.DrainSafeEventID:     "F3E6E2D2-E86A-47F0-AA8E-18918049A2B1",
+			},
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	// failed sync is returned and requeued instead of moving the node on
+	res, err := reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.NotNil(err)
+	assert.Equal(ctrl.Result{RequeueAfter: 1 * time.Minute}, res)
+	assert.Equal(annotations.Scheduled, node.Annotations[annotations.DrainSafeMaintenance])
+
+	// the next reconcile repairs the NodeMaintenance before moving the node on
+	reconciler.Client = f
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(annotations.MaintenanceApproved, node.Annotations[annotations.DrainSafeMaintenance])
+	nm := &drainsafev1.NodeMaintenance{}
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, nm)
+	assert.Nil(err)
+	assert.Equal(annotations.MaintenanceApproved, nm.Status.Phase)
+	assert.Len(nm.Status.Transitions, 2)
+}
+
+func TestNodeMaintenanceWithoutEventID(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	drainsafev1.AddToScheme(scheme.Scheme)
+	f := fake.NewFakeClient()
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:   f,
+		Recorder: &record.FakeRecorder{},
+		Log:      ctrl.Log,
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummynode",
+			Annotations: make(map[string]string),
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	// every maintenance gets its own record, the node is scheduled again once the last one completed
+	for i := 0; i < 3; i++ {
+		node.Annotations[annotations.DrainSafeMaintenance] = annotations.Scheduled
+		for j := 0; j < 5; j++ {
+			_, err := reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+			assert.Nil(err)
+		}
+		assert.Equal(annotations.Drained, node.Annotations[annotations.DrainSafeMaintenance])
+		node.Annotations[annotations.DrainSafeMaintenance] = annotations.Running
+		_, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+		assert.Nil(err)
+
+		nm := &drainsafev1.NodeMaintenance{}
+		err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, nm)
+		assert.Nil(err)
+		assert.Equal("", nm.Spec.EventID)
+		assert.Equal(annotations.Scheduled, nm.Status.Transitions[0].Phase)
+		assert.Equal(annotations.Running, nm.Status.Phase)
+		assert.Len(nm.Status.History, i)
+		for _, record := range nm.Status.History {
+			assert.Equal(annotations.Running, record.Phase)
+			assert.Equal(annotations.Scheduled, record.Transitions[0].Phase)
+		}
+	}
+}
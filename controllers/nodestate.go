@@ -0,0 +1,125 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	drainsafev1 "github.com/awesomenix/drainsafe/api/v1"
+	"github.com/awesomenix/drainsafe/kubectl"
+	"github.com/awesomenix/drainsafe/metrics"
+	"github.com/awesomenix/drainsafe/statemachine"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// resetAnnotations progress of a maintenance step removed when a node is reset to a safe state
+var resetAnnotations = []string{
+	annotations.DrainSafeHookStatus,
+	annotations.DrainSafeEvictedOwners,
+	annotations.DrainSafeVerifyDeadline,
+	annotations.DrainSafeBlockedPods,
+	annotations.DrainSafeBlockingBudgets,
+}
+
+// stampNodeState sets maintenance state of node and when it was entered
+func stampNodeState(node *corev1.Node, state string, now time.Time) {
+	node.Annotations[annotations.DrainSafeMaintenance] = state
+	node.Annotations[annotations.DrainSafeMaintenanceStateTime] = now.UTC().Format(time.RFC3339)
+}
+
+// stateTime returns when node entered its maintenance state, zero if not recorded
+func stateTime(node *corev1.Node) time.Time {
+	since, err := time.Parse(time.RFC3339, node.Annotations[annotations.DrainSafeMaintenanceStateTime])
+	if err != nil {
+		return time.Time{}
+	}
+	return since
+}
+
+// untilStuck returns how long until node is stuck in its maintenance state, zero if it never is
+func untilStuck(p *maintenancePolicy, node *corev1.Node, now time.Time) time.Duration {
+	stuckAt := statemachine.StuckAt(node.Annotations[annotations.DrainSafeMaintenance], stateTime(node), p.stuckTimeout)
+	if stuckAt.IsZero() {
+		return 0
+	}
+	if !stuckAt.After(now) {
+		return p.requeueAfter
+	}
+	return stuckAt.Sub(now)
+}
+
+// recoverNodeState resets a node in an unknown maintenance state to a safe state, and a node
+// stuck in its state unless the policy only alerts, returns true if node was reset
+func (r *DrainSafeReconciler) recoverNodeState(ctx context.Context, log logr.Logger, p *maintenancePolicy, node *corev1.Node, now time.Time) (bool, ctrl.Result, error) {
+	state := node.Annotations[annotations.DrainSafeMaintenance]
+	safeState := statemachine.SafeState(node.Annotations[annotations.DrainSafeEventID] != "")
+	if !statemachine.Known(state) {
+		log.Info("unknown maintenance state, resetting", "Maintenance", state, "SafeState", safeState)
+		r.Recorder.Eventf(node, "Warning", "UnknownMaintenanceState", "%s has unknown maintenance state %q, reset to %s by %s on %s", node.Name, state, safeState, os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"))
+		res, err := r.resetNodeState(node, safeState, now)
+		return true, res, err
+	}
+	if !statemachine.Bounded(state) {
+		return false, ctrl.Result{}, nil
+	}
+	since := stateTime(node)
+	if since.IsZero() {
+		// state was entered before its time was recorded, start the clock now
+		node.Annotations[annotations.DrainSafeMaintenanceStateTime] = now.UTC().Format(time.RFC3339)
+		if err := r.Update(ctx, node); err != nil {
+			log.Error(err, "failed to record maintenance state time")
+		}
+		return false, ctrl.Result{}, nil
+	}
+	if !statemachine.Stuck(state, since, p.stuckTimeout, now) {
+		return false, ctrl.Result{}, nil
+	}
+	if p.stuckRecovery == drainsafev1.StuckStateAlertOnly {
+		log.Info("maintenance is stuck", "Maintenance", state, "Since", since)
+		r.Recorder.Eventf(node, "Warning", "MaintenanceStuck", "%s stuck in %s since %s by %s on %s", node.Name, state, since.Format(time.RFC3339), os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"))
+		return false, ctrl.Result{}, nil
+	}
+	log.Info("maintenance is stuck, resetting", "Maintenance", state, "Since", since, "SafeState", safeState)
+	r.Recorder.Eventf(node, "Warning", "MaintenanceStuck", "%s stuck in %s since %s, reset to %s by %s on %s", node.Name, state, since.Format(time.RFC3339), safeState, os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"))
+	res, err := r.resetNodeState(node, safeState, now)
+	return true, res, err
+}
+
+// resetNodeState moves node to state regardless of the transition table, dropping progress of
+// the maintenance step it was in
+func (r *DrainSafeReconciler) resetNodeState(node *corev1.Node, state string, now time.Time) (ctrl.Result, error) {
+	for _, key := range resetAnnotations {
+		delete(node.Annotations, key)
+	}
+	stampNodeState(node, state, now)
+	return r.writeNodeState(node)
+}
+
+// guardCordon cordons node again if it was uncordoned while drainsafe keeps it cordoned, unless
+// the break glass override is set, returns true if node was cordoned again
+func (r *DrainSafeReconciler) guardCordon(ctx context.Context, log logr.Logger, p *maintenancePolicy, c kubectl.ContextClient, node *corev1.Node) (bool, ctrl.Result) {
+	state := node.Annotations[annotations.DrainSafeMaintenance]
+	if node.Spec.Unschedulable || !statemachine.KeepsCordoned(state) ||
+		node.Annotations[annotations.DrainSafeMaintenanceOwner] != annotations.Drainsafe {
+		return false, ctrl.Result{}
+	}
+	if node.Annotations[annotations.DrainSafeAllowUncordon] == "true" {
+		log.Info("node uncordoned with override, leaving it schedulable", "Maintenance", state)
+		return false, ctrl.Result{}
+	}
+	log.Info("node uncordoned during maintenance, cordoning again", "Maintenance", state)
+	if err := c.CordonContext(ctx, node.Name); err != nil {
+		log.Error(err, "failed to cordon vm")
+		metrics.Failures.WithLabelValues(metrics.Cordon, failureReason(ctx, err)).Inc()
+		return true, ctrl.Result{RequeueAfter: p.requeueAfter}
+	}
+	r.Recorder.Eventf(node, "Warning", "UncordonReverted", "%s uncordoned in %s, cordoned again by %s on %s", node.Name, state, os.Getenv("POD_NAME"), os.Getenv("NODE_NAME"))
+	// cordon updates the node, continue once it is reconciled again
+	return true, ctrl.Result{}
+}
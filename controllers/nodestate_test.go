@@ -0,0 +1,213 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package controllers_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	drainsafev1 "github.com/awesomenix/drainsafe/api/v1"
+	"github.com/awesomenix/drainsafe/controllers"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRecoverNodeState(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	drainsafev1.AddToScheme(scheme.Scheme)
+	dsp := &drainsafev1.DrainSafePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "default"},
+		Spec: drainsafev1.DrainSafePolicySpec{
+			StuckState: drainsafev1.StuckStateSpec{Timeout: &metav1.Duration{Duration: time.Hour}},
+		},
+	}
+	f := fake.NewFakeClient(dsp)
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:   f,
+		Recorder: recorder,
+		Log:      ctrl.Log,
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "dummynode",
+			Annotations: map[string]string{
+				annotations.DrainSafeMaintenance:     "NodeDrainnig",
+				annotations.DrainSafeEventID:         "F3E6E2D2-E86A-47F0-AA8E-18918049A2B1",
+				annotations.DrainSafeMaintenanceType: "Reboot",
+				annotations.DrainSafeHookStatus:      "[]",
+			},
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	// unknown state is reset right away
+	res, err := reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{}, res)
+	assert.Equal(annotations.Scheduled, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.NotContains(node.Annotations, annotations.DrainSafeHookStatus)
+	assert.Equal("Warning UnknownMaintenanceState dummynode has unknown maintenance state \"NodeDrainnig\", reset to MaintenanceScheduled by  on ", <-recorder.Events)
+	assert.Equal("Normal MaintenanceScheduled dummynode by  on ", <-recorder.Events)
+
+	// waiting for the scheduled event controller is checked again once stuck
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Drained
+	node.Annotations[annotations.DrainSafeMaintenanceStateTime] = time.Now().Add(-30 * time.Minute).UTC().Format(time.RFC3339)
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.InDelta((30 * time.Minute).Seconds(), res.RequeueAfter.Seconds(), 5)
+	assert.Empty(recorder.Events)
+
+	// stuck with a pending event restarts the maintenance
+	node.Annotations[annotations.DrainSafeMaintenanceStateTime] = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{}, res)
+	assert.Equal(annotations.Scheduled, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Contains(<-recorder.Events, "Warning MaintenanceStuck dummynode stuck in NodeDrained since")
+	assert.Equal("Normal MaintenanceScheduled dummynode by  on ", <-recorder.Events)
+
+	// started maintenance is never reset, it ends when azure completes the event
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Started
+	node.Annotations[annotations.DrainSafeMaintenanceStateTime] = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{}, res)
+	assert.Equal(annotations.Started, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Empty(recorder.Events)
+
+	// stuck without a pending event completes the maintenance
+	delete(node.Annotations, annotations.DrainSafeEventID)
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Drained
+	node.Annotations[annotations.DrainSafeMaintenanceStateTime] = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Running, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Contains(<-recorder.Events, "reset to NodeRunning")
+	assert.Equal("Normal NodeRunning dummynode by  on ", <-recorder.Events)
+	updated := &corev1.Node{}
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, updated)
+	assert.Nil(err)
+	assert.Equal(annotations.Running, updated.Annotations[annotations.DrainSafeMaintenance])
+
+	// state entered before its time was recorded starts the clock
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Drained
+	delete(node.Annotations, annotations.DrainSafeMaintenanceStateTime)
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.InDelta(time.Hour.Seconds(), res.RequeueAfter.Seconds(), 5)
+	assert.Equal(annotations.Drained, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.NotEmpty(node.Annotations[annotations.DrainSafeMaintenanceStateTime])
+
+	// alert only leaves stuck nodes in their state
+	dsp.Spec.StuckState.Recovery = drainsafev1.StuckStateAlertOnly
+	err = f.Update(context.TODO(), dsp)
+	assert.Nil(err)
+	node.Annotations[annotations.DrainSafeMaintenanceStateTime] = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{RequeueAfter: 1 * time.Minute}, res)
+	assert.Equal(annotations.Drained, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Contains(<-recorder.Events, "Warning MaintenanceStuck dummynode stuck in NodeDrained since")
+	assert.Empty(recorder.Events)
+}
+
+func TestMaintenancePending(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	f := fake.NewFakeClient()
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:   f,
+		Recorder: &record.FakeRecorder{},
+		Log:      ctrl.Log,
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "dummynode",
+			Annotations: map[string]string{
+				annotations.DrainSafeMaintenance:     annotations.MaintenancePending,
+				annotations.DrainSafeMaintenanceType: "Reboot",
+			},
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(annotations.MaintenanceApproved, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.NotEmpty(node.Annotations[annotations.DrainSafeMaintenanceStateTime])
+}
+
+func TestGuardCordon(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	f := fake.NewFakeClient()
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &controllers.DrainSafeReconciler{
+		Client:   f,
+		Recorder: recorder,
+		Log:      ctrl.Log,
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "dummynode",
+			Annotations: map[string]string{
+				annotations.DrainSafeMaintenance:          annotations.Drained,
+				annotations.DrainSafeMaintenanceOwner:     annotations.Drainsafe,
+				annotations.DrainSafeMaintenanceStateTime: time.Now().UTC().Format(time.RFC3339),
+				annotations.DrainSafeEventID:              "F3E6E2D2-E86A-47F0-AA8E-18918049A2B1",
+			},
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	// uncordoned while drained is cordoned again
+	res, err := reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{}, res)
+	assert.Equal("Warning UncordonReverted dummynode uncordoned in NodeDrained, cordoned again by  on ", <-recorder.Events)
+	assert.Empty(recorder.Events)
+
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{cordonerr: errors.New("error")}, nil, node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{RequeueAfter: 1 * time.Minute}, res)
+	assert.Empty(recorder.Events)
+
+	// break glass override leaves the node schedulable
+	node.Annotations[annotations.DrainSafeAllowUncordon] = "true"
+	res, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.NotEqual(time.Duration(0), res.RequeueAfter)
+	assert.Empty(recorder.Events)
+
+	// cordoned by someone else is left alone
+	delete(node.Annotations, annotations.DrainSafeAllowUncordon)
+	node.Annotations[annotations.DrainSafeMaintenanceOwner] = ""
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Empty(recorder.Events)
+
+	// override does not carry over to the next maintenance
+	node.Annotations[annotations.DrainSafeAllowUncordon] = "true"
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Cordoning
+	_, err = reconciler.ProcessNodeEvent(context.TODO(), &fakeKubeClient{}, nil, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Cordoned, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.True(node.Spec.Unschedulable)
+	assert.NotContains(node.Annotations, annotations.DrainSafeAllowUncordon)
+}
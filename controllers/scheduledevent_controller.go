@@ -5,15 +5,26 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/awesomenix/drainsafe/annotations"
+	drainsafev1 "github.com/awesomenix/drainsafe/api/v1"
 	"github.com/awesomenix/drainsafe/azure"
+	"github.com/awesomenix/drainsafe/kubectl"
+	"github.com/awesomenix/drainsafe/metrics"
+	"github.com/awesomenix/drainsafe/policy"
+	"github.com/awesomenix/drainsafe/statemachine"
 	"github.com/go-logr/logr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -21,6 +32,9 @@ import (
 	"k8s.io/client-go/tools/record"
 )
 
+// DefaultResyncPeriod how often scheduled events are processed even if the document did not change
+const DefaultResyncPeriod = 5 * time.Minute
+
 // ScheduledEventReconciler reconciles a DrainSafe object
 type ScheduledEventReconciler struct {
 	client.Client
@@ -28,8 +42,22 @@ type ScheduledEventReconciler struct {
 	Recorder       record.EventRecorder
 	StopCh         <-chan struct{}
 	AzClient       *azure.Client
+	KubeClient     kubectl.ContextClient
 	Hostname       string
 	VMInstanceName string
+	// PlatformFaultDomain and PlatformUpdateDomain of the virtual machine, recorded on the node
+	// so maintenance approval can limit how many domains are in maintenance at once
+	PlatformFaultDomain  string
+	PlatformUpdateDomain string
+	// ResyncPeriod forces processing of unchanged scheduled events, DefaultResyncPeriod if zero
+	ResyncPeriod time.Duration
+	// EventPolicy action per scheduled event type, policy.DefaultEventPolicy if nil
+	EventPolicy policy.EventPolicy
+
+	// mu guards lastSync and lastPolicy, which node events reset when the policy changed
+	mu         sync.Mutex
+	lastSync   time.Time
+	lastPolicy string
 }
 
 // Reconcile consumes event
@@ -61,13 +89,32 @@ func (r *ScheduledEventReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.Node{}).
+		Watches(&source.Kind{Type: &drainsafev1.DrainSafePolicy{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.mapPolicyToNode),
+		}).
 		Complete(r)
 }
 
+// mapPolicyToNode requeues the node when a DrainSafePolicy changes, so scheduled events are
+// processed with the new policy on the next tick
+func (r *ScheduledEventReconciler) mapPolicyToNode(o handler.MapObject) []reconcile.Request {
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: r.Hostname}}}
+}
+
 func (r *ScheduledEventReconciler) startup() error {
 	hostname := os.Getenv("NODE_NAME")
 
-	r.AzClient = azure.New()
+	if r.AzClient == nil {
+		r.AzClient = azure.New()
+	}
+	if r.KubeClient == nil {
+		c, err := kubectl.New()
+		if err != nil {
+			r.Log.Error(err, "failed to create new kubectl client")
+			return err
+		}
+		r.KubeClient = c
+	}
 	vmInstanceName, err := r.AzClient.GetVMInstanceName()
 	if err != nil {
 		r.Log.Error(err, "failed to get vm instance name")
@@ -76,6 +123,12 @@ func (r *ScheduledEventReconciler) startup() error {
 
 	r.Hostname = hostname
 	r.VMInstanceName = vmInstanceName
+	if r.PlatformFaultDomain, err = r.AzClient.GetPlatformFaultDomain(); err != nil {
+		r.Log.Error(err, "failed to get platform fault domain")
+	}
+	if r.PlatformUpdateDomain, err = r.AzClient.GetPlatformUpdateDomain(); err != nil {
+		r.Log.Error(err, "failed to get platform update domain")
+	}
 
 	go r.eventWatcher()
 
@@ -100,30 +153,205 @@ func (r *ScheduledEventReconciler) updateNodeState(node *corev1.Node, state stri
 		return ctrl.Result{}, nil
 	}
 	r.Log.Info("updating node state", "Current", node.Annotations[annotations.DrainSafeMaintenance], "Desired", state)
-	node.Annotations[annotations.DrainSafeMaintenance] = state
+	if err := r.validateNodeState(node, state); err != nil {
+		return ctrl.Result{}, err
+	}
+	stampNodeState(node, state, time.Now())
 	if err := r.Update(context.TODO(), node); err != nil {
 		r.Log.Error(err, "failed to update node")
 		return ctrl.Result{RequeueAfter: 1 * time.Minute}, err
 	}
 	r.Recorder.Eventf(node, "Normal", state, "%s by %s", node.Name, os.Getenv("POD_NAME"))
+	if err := syncNodeMaintenance(context.TODO(), r.Client, node); err != nil {
+		r.Log.Error(err, "failed to sync node maintenance")
+		return ctrl.Result{RequeueAfter: 1 * time.Minute}, err
+	}
 	return ctrl.Result{}, nil
 }
 
-func (r *ScheduledEventReconciler) updateNodeStateWithType(node *corev1.Node, state, mtype string) (ctrl.Result, error) {
+func (r *ScheduledEventReconciler) updateNodeStateWithEvents(node *corev1.Node, state string, events []azure.ScheduledEvent) (ctrl.Result, error) {
 	if node.Annotations[annotations.DrainSafeMaintenance] == state {
 		return ctrl.Result{}, nil
 	}
-	r.Log.Info("updating node state", "Current", node.Annotations[annotations.DrainSafeMaintenance], "Desired", state, "MaintenanceType", mtype)
-	node.Annotations[annotations.DrainSafeMaintenance] = state
-	node.Annotations[annotations.DrainSafeMaintenanceType] = mtype
+	r.Log.Info("updating node state", "Current", node.Annotations[annotations.DrainSafeMaintenance], "Desired", state, "Events", len(events))
+	if node.Annotations == nil {
+		node.Annotations = make(map[string]string)
+	}
+	if err := r.validateNodeState(node, state); err != nil {
+		return ctrl.Result{}, err
+	}
+	stampNodeState(node, state, time.Now())
+	setEventAnnotations(node, events)
 	if err := r.Update(context.TODO(), node); err != nil {
 		r.Log.Error(err, "failed to update node")
 		return ctrl.Result{RequeueAfter: 1 * time.Minute}, err
 	}
-	r.Recorder.Eventf(node, "Normal", state, "%s on %s by %s", mtype, node.Name, os.Getenv("POD_NAME"))
+	if len(events) == 0 {
+		r.Recorder.Eventf(node, "Normal", state, "%s by %s", node.Name, os.Getenv("POD_NAME"))
+	}
+	for _, event := range events {
+		r.Recorder.Eventf(node, "Normal", state, "%s %s on %s by %s", event.EventType, event.EventId, node.Name, os.Getenv("POD_NAME"))
+	}
+	if err := syncNodeMaintenance(context.TODO(), r.Client, node); err != nil {
+		r.Log.Error(err, "failed to sync node maintenance")
+		return ctrl.Result{RequeueAfter: 1 * time.Minute}, err
+	}
 	return ctrl.Result{}, nil
 }
 
+// validateNodeState returns an error if the state machine does not allow node to move to state
+func (r *ScheduledEventReconciler) validateNodeState(node *corev1.Node, state string) error {
+	if err := statemachine.Validate(node.Annotations[annotations.DrainSafeMaintenance], state); err != nil {
+		r.Log.Error(err, "refusing to update node state")
+		r.Recorder.Eventf(node, "Warning", "IllegalTransition", "%s %v by %s", node.Name, err, os.Getenv("POD_NAME"))
+		return err
+	}
+	return nil
+}
+
+// updatePlatformDomains records fault and update domain of the virtual machine on node, domains
+// which could not be read from the instance metadata service are left as they are
+func (r *ScheduledEventReconciler) updatePlatformDomains(node *corev1.Node) error {
+	domains := map[string]string{
+		annotations.DrainSafePlatformFaultDomain:  r.PlatformFaultDomain,
+		annotations.DrainSafePlatformUpdateDomain: r.PlatformUpdateDomain,
+	}
+	changed := false
+	for key, value := range domains {
+		if value != "" && node.Annotations[key] != value {
+			if node.Annotations == nil {
+				node.Annotations = make(map[string]string)
+			}
+			node.Annotations[key] = value
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	r.Log.Info("updating platform domains", "FaultDomain", r.PlatformFaultDomain, "UpdateDomain", r.PlatformUpdateDomain)
+	if err := r.Update(context.TODO(), node); err != nil {
+		r.Log.Error(err, "failed to update node")
+		return err
+	}
+	return nil
+}
+
+// updateNodeEvents refreshes pending events on node without changing its state
+func (r *ScheduledEventReconciler) updateNodeEvents(node *corev1.Node, events []azure.ScheduledEvent) error {
+	recorded := getEventAnnotations(node)
+	if strings.Join(eventIDs(recorded), ",") == strings.Join(eventIDs(events), ",") {
+		return nil
+	}
+	r.Log.Info("updating pending events", "Maintenance", node.Annotations[annotations.DrainSafeMaintenance], "Events", len(events))
+	setEventAnnotations(node, events)
+	if err := r.Update(context.TODO(), node); err != nil {
+		r.Log.Error(err, "failed to update node")
+		return err
+	}
+	tracked := eventSet(recorded)
+	for _, event := range events {
+		if !tracked[event.EventId] {
+			r.Recorder.Eventf(node, "Normal", annotations.Scheduled, "%s %s on %s by %s", event.EventType, event.EventId, node.Name, os.Getenv("POD_NAME"))
+		}
+	}
+	if err := syncNodeMaintenance(context.TODO(), r.Client, node); err != nil {
+		r.Log.Error(err, "failed to sync node maintenance")
+		return err
+	}
+	return nil
+}
+
+// setEventAnnotations records pending events on node, with details of the most disruptive
+// one and earliest NotBefore among them, removes them if there are no events
+func setEventAnnotations(node *corev1.Node, events []azure.ScheduledEvent) {
+	keys := []string{
+		annotations.DrainSafeMaintenanceType,
+		annotations.DrainSafeEventID,
+		annotations.DrainSafeNotBefore,
+		annotations.DrainSafeResources,
+		annotations.DrainSafeEventSource,
+		annotations.DrainSafeDescription,
+		annotations.DrainSafeDuration,
+		annotations.DrainSafeEvents,
+	}
+	event := azure.MostDisruptive(events)
+	if event == nil {
+		node.Annotations[annotations.DrainSafeMaintenanceType] = ""
+		for _, key := range keys[1:] {
+			delete(node.Annotations, key)
+		}
+		return
+	}
+	pending, _ := json.Marshal(events)
+	values := []string{
+		event.EventType,
+		event.EventId,
+		azure.EarliestNotBefore(events),
+		strings.Join(event.Resources, ","),
+		event.EventSource,
+		event.Description,
+		strconv.Itoa(event.DurationInSeconds),
+		string(pending),
+	}
+	for i, key := range keys {
+		node.Annotations[key] = values[i]
+	}
+}
+
+// getEventAnnotations returns pending events recorded on node
+func getEventAnnotations(node *corev1.Node) []azure.ScheduledEvent {
+	events := []azure.ScheduledEvent{}
+	if pending, ok := node.Annotations[annotations.DrainSafeEvents]; ok {
+		json.Unmarshal([]byte(pending), &events)
+	}
+	return events
+}
+
+// hasNewEvents checks if events contains events which are not recorded
+func hasNewEvents(recorded, events []azure.ScheduledEvent) bool {
+	tracked := eventSet(recorded)
+	for _, event := range events {
+		if !tracked[event.EventId] {
+			return true
+		}
+	}
+	return false
+}
+
+// eventSet returns ids of events
+func eventSet(events []azure.ScheduledEvent) map[string]bool {
+	ids := map[string]bool{}
+	for _, event := range events {
+		ids[event.EventId] = true
+	}
+	return ids
+}
+
+// eventIDs returns ids of events in order
+func eventIDs(events []azure.ScheduledEvent) []string {
+	ids := []string{}
+	for _, event := range events {
+		ids = append(ids, event.EventId)
+	}
+	return ids
+}
+
+// approveScheduledEvents approves every event scheduled on the vm and records each of them
+func (r *ScheduledEventReconciler) approveScheduledEvents(node *corev1.Node) error {
+	approved, err := r.AzClient.ApproveScheduledEvents(r.VMInstanceName)
+	if err != nil {
+		return err
+	}
+	for _, event := range approved {
+		r.Recorder.Eventf(node, "Normal", "EventApproved", "%s %s on %s by %s", event.EventType, event.EventId, node.Name, os.Getenv("POD_NAME"))
+		if notBefore, err := azure.ParseNotBefore(event.NotBefore); err == nil {
+			metrics.ApprovalRemaining.WithLabelValues(event.EventType).Observe(time.Until(notBefore).Seconds())
+		}
+	}
+	return nil
+}
+
 // ProcessNodeEvent processes node event
 func (r *ScheduledEventReconciler) ProcessNodeEvent(node *corev1.Node) (ctrl.Result, error) {
 	if node.Annotations == nil {
@@ -137,39 +365,190 @@ func (r *ScheduledEventReconciler) ProcessNodeEvent(node *corev1.Node) (ctrl.Res
 		"Name", node.Name,
 		"Maintenance", maintenance)
 
+	p, err := getMaintenancePolicy(context.TODO(), r.Client, node, r.EventPolicy)
+	if err != nil {
+		log.Error(err, "failed to get drainsafe policy")
+		return ctrl.Result{RequeueAfter: defaultScheduledEventRequeueAfter}, nil
+	}
+	r.mu.Lock()
+	if p.version() != r.lastPolicy {
+		// scheduled events are processed again with the changed policy on the next tick
+		r.lastSync = time.Time{}
+	}
+	r.mu.Unlock()
+
 	if maintenance == annotations.Drained {
-		if err := r.AzClient.ApproveScheduledEvent(r.VMInstanceName); err != nil {
+		if err := r.approveScheduledEvents(node); err != nil {
 			log.Error(err, "failed to approve scheduled event")
-			return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+			return ctrl.Result{RequeueAfter: p.scheduledEventRequeueAfter}, nil
 		}
 		return r.updateNodeState(node, annotations.Started)
 	}
 
-	return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+	return ctrl.Result{RequeueAfter: p.scheduledEventRequeueAfter}, nil
 }
 
-// ProcessScheduledEvent process scheduled event.
+// ProcessScheduledEvent process scheduled event, only when the scheduled events document
+// changed since the last run, the DrainSafePolicy of the node changed since the last successful
+// run, the last run failed or ResyncPeriod has elapsed. Nothing is read from the API server
+// otherwise.
 func (r *ScheduledEventReconciler) ProcessScheduledEvent() error {
+	result, changed, err := r.AzClient.Changed()
+	if err != nil {
+		r.Log.Error(err, "failed to get scheduled events")
+		return err
+	}
+	if !changed && !r.resyncDue() {
+		return nil
+	}
+	p, err := r.processScheduledEventList(result)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		// the document is processed again on the next tick even if it did not change
+		r.lastSync = time.Time{}
+		return err
+	}
+	r.lastPolicy = p.version()
+	r.lastSync = time.Now()
+	return nil
+}
+
+// resyncDue returns whether scheduled events are processed even if the document did not change
+func (r *ScheduledEventReconciler) resyncDue() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	resyncPeriod := r.ResyncPeriod
+	if resyncPeriod == 0 {
+		resyncPeriod = DefaultResyncPeriod
+	}
+	return r.lastSync.IsZero() || time.Since(r.lastSync) >= resyncPeriod
+}
+
+// processScheduledEventList moves the node along the events of result scheduled on the vm and
+// returns the policy they were processed with
+func (r *ScheduledEventReconciler) processScheduledEventList(result *azure.ScheduledEventList) (*maintenancePolicy, error) {
 	node := &corev1.Node{}
 	if err := r.Get(context.TODO(), types.NamespacedName{Name: r.Hostname}, node); err != nil {
 		r.Log.Error(err, "failed to get node", "Name", r.Hostname)
-		return err
+		return nil, err
 	}
-	maintenance := node.Annotations[annotations.DrainSafeMaintenance]
-	isScheduled, err := r.AzClient.IsScheduledEvent(r.VMInstanceName)
+	if err := r.updatePlatformDomains(node); err != nil {
+		return nil, err
+	}
+	p, err := getMaintenancePolicy(context.TODO(), r.Client, node, r.EventPolicy)
 	if err != nil {
-		r.Log.Error(err, "failed to find scheduled events")
-		return err
+		r.Log.Error(err, "failed to get drainsafe policy")
+		return nil, err
 	}
-	if len(isScheduled) != 0 {
-		if maintenance != "" &&
-			maintenance != annotations.Running {
-			r.Log.Info("node is under going maintenance, skipping setting annotation", "Maintenance", maintenance)
-			return nil
+	r.AzClient.SetEventPolicy(p.eventPolicy)
+	return p, r.processScheduledEvent(node, p, r.AzClient.VMScheduledEvents(result, r.VMInstanceName))
+}
+
+// processScheduledEvent moves node along the events scheduled on the vm
+func (r *ScheduledEventReconciler) processScheduledEvent(node *corev1.Node, p *maintenancePolicy, events []azure.ScheduledEvent) error {
+	maintenance := node.Annotations[annotations.DrainSafeMaintenance]
+	var err error
+	if len(events) != 0 {
+		if p.eventPolicy.ActionFor(azure.MostDisruptive(events).EventType) == policy.ExpressDrain {
+			switch maintenance {
+			case "", annotations.Running, annotations.PostMaintenance, annotations.Scheduled, annotations.MaintenancePending, annotations.MaintenanceApproved, annotations.ExpressDraining:
+				return r.expressDrain(node, events, p)
+			}
 		}
-		_, err = r.updateNodeStateWithType(node, annotations.Scheduled, isScheduled)
+		switch maintenance {
+		case "", annotations.Running, annotations.PostMaintenance:
+			_, err = r.updateNodeStateWithEvents(node, annotations.Scheduled, events)
+			return err
+		case annotations.Started:
+			if !hasNewEvents(getEventAnnotations(node), events) {
+				// events were approved when the node was drained
+				return nil
+			}
+			if !node.Spec.Unschedulable {
+				// node was uncordoned since it was drained, workload may have landed on it again
+				r.Log.Info("node is no longer cordoned, skipping approval of scheduled events", "Events", len(events))
+				r.Recorder.Eventf(node, "Warning", "ApprovalSkipped", "%s no longer cordoned in %s by %s", node.Name, maintenance, os.Getenv("POD_NAME"))
+				return r.updateNodeEvents(node, events)
+			}
+			// node is still drained, approve events scheduled while maintenance is in progress
+			r.Log.Info("node is under going maintenance, approving scheduled events", "Events", len(events))
+			if err := r.approveScheduledEvents(node); err != nil {
+				return err
+			}
+			return r.updateNodeEvents(node, events)
+		}
+		r.Log.Info("node is under going maintenance, skipping setting state", "Maintenance", maintenance)
+		return r.updateNodeEvents(node, events)
+	}
+	if maintenance == annotations.PostMaintenance {
+		// maintenance completed, drainsafe controller runs post maintenance hooks before uncordoning
+		return r.updateNodeEvents(node, nil)
+	}
+	_, err = r.updateNodeStateWithEvents(node, annotations.Running, nil)
+	return err
+}
+
+// expressDrain cordons, drains and approves right away without going through drainsafe controller
+// and repairman approval, for events such as Preempt which give about 30 seconds notice
+func (r *ScheduledEventReconciler) expressDrain(node *corev1.Node, events []azure.ScheduledEvent, p *maintenancePolicy) error {
+	if node.Annotations == nil {
+		node.Annotations = make(map[string]string)
+	}
+	node.Annotations[annotations.DrainSafeMaintenanceOwner] = annotations.Drainsafe
+	node.Annotations[annotations.DrainSafeMaintenanceApprover] = annotations.ExpressDrain
+	if _, err := r.updateNodeStateWithEvents(node, annotations.ExpressDraining, events); err != nil {
 		return err
 	}
-	_, err = r.updateNodeStateWithType(node, annotations.Running, "")
+
+	maintenanceType := node.Annotations[annotations.DrainSafeMaintenanceType]
+	notBefore := node.Annotations[annotations.DrainSafeNotBefore]
+	options, sufficient := p.drainOptions(maintenanceType, notBefore, time.Now())
+	if !sufficient {
+		r.Recorder.Eventf(node, "Warning", "InsufficientDrainBudget", "%s has %s left to drain before %s at %s", node.Name, options.Timeout, maintenanceType, notBefore)
+	}
+
+	eventID := node.Annotations[annotations.DrainSafeEventID]
+	result := annotations.DrainSucceeded
+	// drain runs on the watcher, bound it by NotBefore so polling resumes once the event starts
+	timeout := p.drainTimeout
+	if options.Timeout > 0 && options.Timeout < timeout {
+		timeout = options.Timeout
+	}
+	drainResult, err := r.expressCordonAndDrain(node, options, timeout)
+	if err != nil {
+		r.Log.Error(err, "failed to express drain vm")
+		r.Recorder.Eventf(node, "Warning", "ExpressDrainFailed", "%s %s on %s by %s: %v", maintenanceType, eventID, node.Name, os.Getenv("POD_NAME"), err)
+		result = err.Error()
+	} else {
+		r.Recorder.Eventf(node, "Normal", "ExpressDrained", "%s %s on %s by %s", maintenanceType, eventID, node.Name, os.Getenv("POD_NAME"))
+	}
+
+	// cordon updates the node, get latest before recording the result
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: node.Name}, node); err != nil {
+		r.Log.Error(err, "failed to get node", "Name", node.Name)
+		return err
+	}
+	// azure starts the event at NotBefore regardless, approve even if drain failed to use all of the notice,
+	// the node event of Drained approves the events like for any other drain
+	node.Annotations[annotations.DrainSafeDrainResult] = result
+	setEvictedPods(node, drainResult)
+	_, err = r.updateNodeState(node, annotations.Drained)
 	return err
 }
+
+func (r *ScheduledEventReconciler) expressCordonAndDrain(node *corev1.Node, options kubectl.DrainOptions, timeout time.Duration) (*kubectl.DrainResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if !node.Spec.Unschedulable {
+		if err := r.KubeClient.CordonContext(ctx, node.Name); err != nil {
+			metrics.Failures.WithLabelValues(metrics.Cordon, failureReason(ctx, err)).Inc()
+			return nil, err
+		}
+	}
+	result, err := r.KubeClient.DrainContext(ctx, node.Name, options, nil)
+	if err != nil {
+		metrics.Failures.WithLabelValues(metrics.Drain, drainFailureReason(ctx, err, result)).Inc()
+	}
+	return result, err
+}
@@ -4,13 +4,18 @@ package controllers_test
 
 import (
 	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/awesomenix/drainsafe/annotations"
 	"github.com/awesomenix/drainsafe/azure"
+	"github.com/awesomenix/drainsafe/azure/simulator"
 	"github.com/awesomenix/drainsafe/controllers"
 	repairmanv1 "github.com/awesomenix/repairman/pkg/api/v1"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -19,6 +24,7 @@ import (
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 )
 
 const (
@@ -33,7 +39,10 @@ const (
 			"Resources": [
 				"controlplane_0"
 			],
-			"NotBefore": "Sun, 30 Jun 2019 16:22:03 GMT"
+			"NotBefore": "Sun, 30 Jun 2019 16:22:03 GMT",
+			"Description": "Host server is undergoing maintenance.",
+			"EventSource": "Platform",
+			"DurationInSeconds": 600
 			}
 		]
 	}`
@@ -43,6 +52,8 @@ type testQuery struct {
 	getErr  error
 	postErr error
 	get     string
+	// scheduledEventGets counts requests of the scheduled events document
+	scheduledEventGets int
 }
 
 func (q *testQuery) Post(url string, body []byte) error {
@@ -50,6 +61,9 @@ func (q *testQuery) Post(url string, body []byte) error {
 }
 
 func (q *testQuery) Get(url string) (string, error) {
+	if strings.Contains(url, "/metadata/scheduledevents") {
+		q.scheduledEventGets++
+	}
 	return q.get, q.getErr
 }
 
@@ -62,12 +76,14 @@ func TestProcessScheduledEvent(t *testing.T) {
 	c := azure.NewWithQuery(tQuery)
 
 	reconciler := &controllers.ScheduledEventReconciler{
-		Client:         f,
-		Recorder:       &record.FakeRecorder{},
-		Log:            ctrl.Log,
-		AzClient:       c,
-		Hostname:       "dummyhostname",
-		VMInstanceName: "controlplane_0",
+		Client:               f,
+		Recorder:             &record.FakeRecorder{},
+		Log:                  ctrl.Log,
+		AzClient:             c,
+		Hostname:             "dummyhostname",
+		VMInstanceName:       "controlplane_0",
+		PlatformFaultDomain:  "1",
+		PlatformUpdateDomain: "4",
 	}
 
 	node := &corev1.Node{
@@ -85,6 +101,37 @@ func TestProcessScheduledEvent(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal("Reboot", node.Annotations[annotations.DrainSafeMaintenanceType])
 	assert.Equal(annotations.Scheduled, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("F3E6E2D2-E86A-47F0-AA8E-18918049A2B1", node.Annotations[annotations.DrainSafeEventID])
+	assert.Equal("Sun, 30 Jun 2019 16:22:03 GMT", node.Annotations[annotations.DrainSafeNotBefore])
+	assert.Equal("controlplane_0", node.Annotations[annotations.DrainSafeResources])
+	assert.Equal("Platform", node.Annotations[annotations.DrainSafeEventSource])
+	assert.Equal("Host server is undergoing maintenance.", node.Annotations[annotations.DrainSafeDescription])
+	assert.Equal("600", node.Annotations[annotations.DrainSafeDuration])
+	assert.Equal("1", node.Annotations[annotations.DrainSafePlatformFaultDomain])
+	assert.Equal("4", node.Annotations[annotations.DrainSafePlatformUpdateDomain])
+
+	tQuery.get = `{"DocumentIncarnation": 2, "Events": []}`
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	node = &corev1.Node{}
+	err = f.Get(context.TODO(), types.NamespacedName{Name: "dummyhostname"}, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Running, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Empty(node.Annotations[annotations.DrainSafeMaintenanceType])
+	assert.Empty(node.Annotations[annotations.DrainSafeEventID])
+	assert.Empty(node.Annotations[annotations.DrainSafeNotBefore])
+
+	// post maintenance hooks are left to complete
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.PostMaintenance
+	err = f.Update(context.TODO(), node)
+	assert.Nil(err)
+	tQuery.get = `{"DocumentIncarnation": 3, "Events": []}`
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	node = &corev1.Node{}
+	err = f.Get(context.TODO(), types.NamespacedName{Name: "dummyhostname"}, node)
+	assert.Nil(err)
+	assert.Equal(annotations.PostMaintenance, node.Annotations[annotations.DrainSafeMaintenance])
 }
 
 func TestProcessNodeEvent(t *testing.T) {
@@ -128,3 +175,303 @@ func TestProcessNodeEvent(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal(annotations.Started, node.Annotations[annotations.DrainSafeMaintenance])
 }
+
+func TestProcessScheduledEventIncarnation(t *testing.T) {
+	assert := assert.New(t)
+	f := fake.NewFakeClient()
+	corev1.AddToScheme(scheme.Scheme)
+	repairmanv1.AddToScheme(scheme.Scheme)
+	tQuery := &testQuery{get: scheduledevent}
+	c := azure.NewWithQuery(tQuery)
+
+	reconciler := &controllers.ScheduledEventReconciler{
+		Client:         f,
+		Recorder:       &record.FakeRecorder{},
+		Log:            ctrl.Log,
+		AzClient:       c,
+		Hostname:       "dummyhostname",
+		VMInstanceName: "controlplane_0",
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummyhostname",
+			Annotations: make(map[string]string),
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	assert.Equal(1, tQuery.scheduledEventGets)
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Scheduled, node.Annotations[annotations.DrainSafeMaintenance])
+
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Running
+	err = f.Update(context.TODO(), node)
+	assert.Nil(err)
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Running, node.Annotations[annotations.DrainSafeMaintenance])
+
+	tQuery.get = strings.Replace(scheduledevent, `"DocumentIncarnation": 1`, `"DocumentIncarnation": 2`, 1)
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Scheduled, node.Annotations[annotations.DrainSafeMaintenance])
+
+	// unchanged document is not processed without reading the node
+	err = f.Delete(context.TODO(), node)
+	assert.Nil(err)
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+
+	// failed run is retried even if the document did not change
+	tQuery.get = strings.Replace(scheduledevent, `"DocumentIncarnation": 1`, `"DocumentIncarnation": 3`, 1)
+	err = reconciler.ProcessScheduledEvent()
+	assert.NotNil(err)
+	node = &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummyhostname",
+			Annotations: map[string]string{annotations.DrainSafeMaintenance: annotations.Running},
+		},
+	}
+	err = f.Create(context.TODO(), node)
+	assert.Nil(err)
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Scheduled, node.Annotations[annotations.DrainSafeMaintenance])
+}
+
+func TestMultipleScheduledEvents(t *testing.T) {
+	assert := assert.New(t)
+	f := fake.NewFakeClient()
+	corev1.AddToScheme(scheme.Scheme)
+	sim := simulator.New("controlplane_0")
+	ts := httptest.NewServer(sim)
+	defer ts.Close()
+
+	reconciler := &controllers.ScheduledEventReconciler{
+		Client:         f,
+		Recorder:       &record.FakeRecorder{},
+		Log:            ctrl.Log,
+		AzClient:       azure.New(azure.WithEndpoint(ts.URL)),
+		Hostname:       "dummyhostname",
+		VMInstanceName: "controlplane_0",
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummyhostname",
+			Annotations: make(map[string]string),
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	reboot := sim.AddEvent(azure.ScheduledEvent{EventType: "Reboot", NotBefore: "Sun, 30 Jun 2019 16:10:00 GMT"})
+	redeploy := sim.AddEvent(azure.ScheduledEvent{EventType: "Redeploy", NotBefore: "Sun, 30 Jun 2019 16:20:00 GMT"})
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Scheduled, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("Redeploy", node.Annotations[annotations.DrainSafeMaintenanceType])
+	assert.Equal(redeploy, node.Annotations[annotations.DrainSafeEventID])
+	assert.Equal("Sun, 30 Jun 2019 16:10:00 GMT", node.Annotations[annotations.DrainSafeNotBefore])
+	events := []azure.ScheduledEvent{}
+	assert.Nil(json.Unmarshal([]byte(node.Annotations[annotations.DrainSafeEvents]), &events))
+	assert.Len(events, 2)
+
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Cordoned
+	err = f.Update(context.TODO(), node)
+	assert.Nil(err)
+	terminate := sim.AddEvent(azure.ScheduledEvent{EventType: "Terminate", NotBefore: "Sun, 30 Jun 2019 16:30:00 GMT"})
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Cordoned, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("Terminate", node.Annotations[annotations.DrainSafeMaintenanceType])
+
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Drained
+	err = f.Update(context.TODO(), node)
+	assert.Nil(err)
+	before := map[string]uint64{}
+	for _, eventType := range []string{"Reboot", "Redeploy", "Terminate"} {
+		before[eventType] = approvalsLate(assert, eventType)
+	}
+	res, err := reconciler.ProcessNodeEvent(node)
+	assert.Nil(err)
+	assert.Equal(ctrl.Result{}, res)
+	assert.Equal(annotations.Started, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal([]string{reboot, redeploy, terminate}, sim.Approved())
+
+	// every approved event is observed by its type, approved late past its NotBefore
+	for eventType, count := range before {
+		assert.Equal(count+1, approvalsLate(assert, eventType), eventType)
+	}
+}
+
+// approvalsLate returns how many events of eventType were approved past their NotBefore
+func approvalsLate(assert *assert.Assertions, eventType string) uint64 {
+	families, err := ctrlmetrics.Registry.Gather()
+	assert.Nil(err)
+	for _, family := range families {
+		if family.GetName() != "drainsafe_approval_notbefore_remaining_seconds" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			if m.GetLabel()[0].GetValue() == eventType {
+				return m.GetHistogram().GetBucket()[0].GetCumulativeCount()
+			}
+		}
+	}
+	return 0
+}
+
+func TestExpressDrain(t *testing.T) {
+	assert := assert.New(t)
+	f := fake.NewFakeClient()
+	corev1.AddToScheme(scheme.Scheme)
+	sim := simulator.New("controlplane_0")
+	ts := httptest.NewServer(sim)
+	defer ts.Close()
+
+	kubeClient := &fakeKubeClient{}
+	reconciler := &controllers.ScheduledEventReconciler{
+		Client:         f,
+		Recorder:       &record.FakeRecorder{},
+		Log:            ctrl.Log,
+		AzClient:       azure.New(azure.WithEndpoint(ts.URL)),
+		KubeClient:     kubeClient,
+		Hostname:       "dummyhostname",
+		VMInstanceName: "controlplane_0",
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummyhostname",
+			Annotations: make(map[string]string),
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	preempt := sim.AddEvent(azure.ScheduledEvent{EventType: "Preempt", NotBefore: time.Now().Add(30 * time.Second).UTC().Format(time.RFC1123)})
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Drained, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal(annotations.Drainsafe, node.Annotations[annotations.DrainSafeMaintenanceOwner])
+	assert.Equal(annotations.ExpressDrain, node.Annotations[annotations.DrainSafeMaintenanceApprover])
+	assert.Equal(annotations.DrainSucceeded, node.Annotations[annotations.DrainSafeDrainResult])
+	assert.Empty(sim.Approved())
+	assert.Equal(15, kubeClient.drainOptions.GracePeriod)
+	assert.InDelta(float64(30*time.Second), float64(kubeClient.drainOptions.Timeout), float64(2*time.Second))
+
+	// drained node event approves the events once
+	_, err = reconciler.ProcessNodeEvent(node)
+	assert.Nil(err)
+	assert.Equal(annotations.Started, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal([]string{preempt}, sim.Approved())
+	node.Spec.Unschedulable = true
+	err = f.Update(context.TODO(), node)
+	assert.Nil(err)
+	reconciler.ResyncPeriod = time.Nanosecond
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	assert.Equal([]string{preempt}, sim.Approved())
+
+	assert.Nil(sim.CompleteEvent(preempt))
+	kubeClient.drainerr = errors.New("error")
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Running
+	err = f.Update(context.TODO(), node)
+	assert.Nil(err)
+	terminate := sim.AddEvent(azure.ScheduledEvent{EventType: "Terminate"})
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, node)
+	assert.Nil(err)
+	assert.Equal(annotations.Drained, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal("error", node.Annotations[annotations.DrainSafeDrainResult])
+	_, err = reconciler.ProcessNodeEvent(node)
+	assert.Nil(err)
+	assert.Equal(annotations.Started, node.Annotations[annotations.DrainSafeMaintenance])
+	assert.Equal([]string{preempt, terminate}, sim.Approved())
+}
+
+func TestStartedScheduledEvents(t *testing.T) {
+	assert := assert.New(t)
+	f := fake.NewFakeClient()
+	corev1.AddToScheme(scheme.Scheme)
+	sim := simulator.New("controlplane_0")
+	ts := httptest.NewServer(sim)
+	defer ts.Close()
+
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &controllers.ScheduledEventReconciler{
+		Client:         f,
+		Recorder:       recorder,
+		Log:            ctrl.Log,
+		AzClient:       azure.New(azure.WithEndpoint(ts.URL)),
+		Hostname:       "dummyhostname",
+		VMInstanceName: "controlplane_0",
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummyhostname",
+			Annotations: make(map[string]string),
+		},
+	}
+	err := f.Create(context.TODO(), node)
+	assert.Nil(err)
+
+	// event id which is a prefix of a tracked one is still a new event
+	sim.AddEvent(azure.ScheduledEvent{EventId: "F3E6E2D2-E86A", EventType: "Reboot"})
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	assert.Equal("Normal MaintenanceScheduled Reboot F3E6E2D2-E86A on dummyhostname by ", <-recorder.Events)
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, node)
+	assert.Nil(err)
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Cordoned
+	err = f.Update(context.TODO(), node)
+	assert.Nil(err)
+	sim.AddEvent(azure.ScheduledEvent{EventId: "F3E6E2D2", EventType: "Reboot"})
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	assert.Equal("Normal MaintenanceScheduled Reboot F3E6E2D2 on dummyhostname by ", <-recorder.Events)
+	assert.Empty(recorder.Events)
+
+	// node uncordoned after it was drained is not approved
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, node)
+	assert.Nil(err)
+	node.Annotations[annotations.DrainSafeMaintenance] = annotations.Started
+	err = f.Update(context.TODO(), node)
+	assert.Nil(err)
+	sim.AddEvent(azure.ScheduledEvent{EventType: "Redeploy"})
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	assert.Empty(sim.Approved())
+	assert.Equal("Warning ApprovalSkipped dummyhostname no longer cordoned in MaintenanceStarted by ", <-recorder.Events)
+	err = f.Get(context.TODO(), types.NamespacedName{Name: node.Name}, node)
+	assert.Nil(err)
+	assert.Equal("Redeploy", node.Annotations[annotations.DrainSafeMaintenanceType])
+
+	// cordoned node is approved
+	node.Spec.Unschedulable = true
+	err = f.Update(context.TODO(), node)
+	assert.Nil(err)
+	sim.AddEvent(azure.ScheduledEvent{EventType: "Reboot"})
+	err = reconciler.ProcessScheduledEvent()
+	assert.Nil(err)
+	assert.Len(sim.Approved(), 4)
+}
@@ -0,0 +1,289 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package coordinator
+
+import (
+	"context"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var log logr.Logger = ctrl.Log.WithName("coordinator")
+
+// DefaultName name of the ConfigMap holding maintenance slots
+const DefaultName = "drainsafe-maintenance-slots"
+
+// Domain nodes are spread across and taken down together by azure maintenance
+type Domain string
+
+const (
+	// Zone availability zone of the node, topology.kubernetes.io/zone label
+	Zone Domain = "Zone"
+	// FaultDomain azure platformFaultDomain of the node, unique within a zone
+	FaultDomain Domain = "FaultDomain"
+	// UpdateDomain azure platformUpdateDomain of the node, unique within a zone
+	UpdateDomain Domain = "UpdateDomain"
+)
+
+var domains = []Domain{Zone, FaultDomain, UpdateDomain}
+
+const (
+	zoneLabel     = "topology.kubernetes.io/zone"
+	betaZoneLabel = "failure-domain.beta.kubernetes.io/zone"
+)
+
+// Coordinator limits how many nodes are in maintenance at the same time. Nodes holding a slot
+// are recorded in a ConfigMap, keyed by node name with the group of the node as value, updates
+// rely on optimistic concurrency so concurrent controllers never hand out more slots than allowed.
+type Coordinator struct {
+	// Client writes the ConfigMap and lists nodes
+	Client client.Client
+	// Reader reads the ConfigMap and the nodes holding slots bypassing caches, Client if nil
+	Reader client.Reader
+	// Namespace and Name of the ConfigMap
+	Namespace string
+	Name      string
+	// MaxConcurrent nodes in maintenance per group, a count or a percentage of nodes in the
+	// group rounded up, at least one node is allowed
+	MaxConcurrent intstr.IntOrString
+	// GroupLabel node label whose values group nodes, e.g. topology.kubernetes.io/zone or
+	// agentpool, MaxConcurrent applies per group, all nodes are in a single group if empty
+	GroupLabel string
+	// MaxDomains how many distinct domains may have nodes in maintenance at once, across all
+	// groups, domains without a limit or with a limit of zero are not checked
+	MaxDomains map[Domain]int
+}
+
+// New creates a coordinator recording slots in ConfigMap DefaultName of namespace
+func New(c client.Client, reader client.Reader, namespace string, maxConcurrent intstr.IntOrString, groupLabel string) *Coordinator {
+	if namespace == "" {
+		namespace = "default"
+	}
+	return &Coordinator{
+		Client:        c,
+		Reader:        reader,
+		Namespace:     namespace,
+		Name:          DefaultName,
+		MaxConcurrent: maxConcurrent,
+		GroupLabel:    groupLabel,
+	}
+}
+
+// Validate checks MaxConcurrent is a count or a percentage
+func (c *Coordinator) Validate() error {
+	if _, err := intstr.GetValueFromIntOrPercent(&c.MaxConcurrent, 100, true); err != nil {
+		return errors.Wrapf(err, "invalid max concurrent maintenance %s", c.MaxConcurrent.String())
+	}
+	return nil
+}
+
+// Acquire reserves a maintenance slot for node, returns false if the group of node has no slot
+// left. Slots of nodes which are gone or no longer in maintenance are released first.
+func (c *Coordinator) Acquire(ctx context.Context, node *corev1.Node) (bool, error) {
+	cm, err := c.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := cm.Data[node.Name]; ok {
+		return true, nil
+	}
+
+	holders, pruned, err := c.prune(ctx, cm)
+	if err != nil {
+		return false, err
+	}
+	if domain, ok := c.domainsAllowed(node, holders); !ok {
+		log.Info("maintenance would exceed domain limit", "Node", node.Name, "Domain", domain, "Limit", c.MaxDomains[domain])
+		return false, c.savePruned(ctx, cm, pruned)
+	}
+	group := node.Labels[c.GroupLabel]
+	limit, err := c.limit(ctx, group)
+	if err != nil {
+		return false, err
+	}
+	inGroup := 0
+	for _, g := range cm.Data {
+		if c.GroupLabel == "" || g == group {
+			inGroup++
+		}
+	}
+	if inGroup >= limit {
+		log.Info("no maintenance slot left", "Node", node.Name, "Group", group, "Holders", inGroup, "Limit", limit)
+		return false, c.savePruned(ctx, cm, pruned)
+	}
+
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[node.Name] = group
+	if err := c.Client.Update(ctx, cm); err != nil {
+		return false, errors.Wrapf(err, "error acquiring maintenance slot")
+	}
+	log.Info("acquired maintenance slot", "Node", node.Name, "Group", group, "Holders", inGroup+1, "Limit", limit)
+	return true, nil
+}
+
+// Release frees the maintenance slot of node, if any
+func (c *Coordinator) Release(ctx context.Context, nodeName string) error {
+	cm, err := c.get(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := cm.Data[nodeName]; !ok {
+		return nil
+	}
+	delete(cm.Data, nodeName)
+	if err := c.Client.Update(ctx, cm); err != nil {
+		return errors.Wrapf(err, "error releasing maintenance slot")
+	}
+	log.Info("released maintenance slot", "Node", nodeName)
+	return nil
+}
+
+// get returns the ConfigMap holding slots, creating it if it does not exist
+func (c *Coordinator) get(ctx context.Context) (*corev1.ConfigMap, error) {
+	cm := &corev1.ConfigMap{}
+	err := c.reader().Get(ctx, types.NamespacedName{Namespace: c.Namespace, Name: c.Name}, cm)
+	if err == nil {
+		return cm, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(err, "error getting maintenance slots")
+	}
+	cm = &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: c.Namespace, Name: c.Name},
+		Data:       map[string]string{},
+	}
+	if err := c.Client.Create(ctx, cm); err != nil {
+		return nil, errors.Wrapf(err, "error creating maintenance slots")
+	}
+	return cm, nil
+}
+
+// reader returns the reader bypassing caches, Client if not set
+func (c *Coordinator) reader() client.Reader {
+	if c.Reader == nil {
+		return c.Client
+	}
+	return c.Reader
+}
+
+// prune releases slots of nodes which are gone or no longer in maintenance, returns nodes
+// still holding slots and whether any slot was released. Holders are read bypassing caches, a
+// stale cached node of a slot just handed out by another controller must not release it.
+func (c *Coordinator) prune(ctx context.Context, cm *corev1.ConfigMap) ([]*corev1.Node, bool, error) {
+	holders := []*corev1.Node{}
+	pruned := false
+	for name := range cm.Data {
+		node := &corev1.Node{}
+		if err := c.reader().Get(ctx, types.NamespacedName{Name: name}, node); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, false, errors.Wrapf(err, "error getting node %s", name)
+			}
+		} else if InMaintenance(node) {
+			holders = append(holders, node)
+			continue
+		}
+		log.Info("releasing stale maintenance slot", "Node", name)
+		delete(cm.Data, name)
+		pruned = true
+	}
+	return holders, pruned, nil
+}
+
+// savePruned persists slots released by prune
+func (c *Coordinator) savePruned(ctx context.Context, cm *corev1.ConfigMap, pruned bool) error {
+	if !pruned {
+		return nil
+	}
+	if err := c.Client.Update(ctx, cm); err != nil {
+		return errors.Wrapf(err, "error releasing stale maintenance slots")
+	}
+	return nil
+}
+
+// domainsAllowed returns whether node may go into maintenance together with holders without
+// exceeding MaxDomains, otherwise the domain whose limit would be exceeded
+func (c *Coordinator) domainsAllowed(node *corev1.Node, holders []*corev1.Node) (Domain, bool) {
+	for _, domain := range domains {
+		limit := c.MaxDomains[domain]
+		value := NodeDomain(node, domain)
+		if limit <= 0 || value == "" {
+			continue
+		}
+		values := map[string]bool{value: true}
+		for _, holder := range holders {
+			if v := NodeDomain(holder, domain); v != "" {
+				values[v] = true
+			}
+		}
+		if len(values) > limit {
+			return domain, false
+		}
+	}
+	return "", true
+}
+
+// NodeDomain returns domain of node, empty if unknown. Fault and update domains are qualified
+// with the zone of the node, as they are only unique within a zone.
+func NodeDomain(node *corev1.Node, domain Domain) string {
+	zone := node.Labels[zoneLabel]
+	if zone == "" {
+		zone = node.Labels[betaZoneLabel]
+	}
+	value := ""
+	switch domain {
+	case Zone:
+		return zone
+	case FaultDomain:
+		value = node.Annotations[annotations.DrainSafePlatformFaultDomain]
+	case UpdateDomain:
+		value = node.Annotations[annotations.DrainSafePlatformUpdateDomain]
+	}
+	if value == "" || zone == "" {
+		return value
+	}
+	return zone + "/" + value
+}
+
+// limit returns how many nodes of group may be in maintenance at the same time
+func (c *Coordinator) limit(ctx context.Context, group string) (int, error) {
+	nodes := &corev1.NodeList{}
+	opts := []client.ListOption{}
+	if c.GroupLabel != "" {
+		opts = append(opts, client.MatchingLabels{c.GroupLabel: group})
+	}
+	if err := c.Client.List(ctx, nodes, opts...); err != nil {
+		return 0, errors.Wrapf(err, "error listing nodes")
+	}
+	limit, err := intstr.GetValueFromIntOrPercent(&c.MaxConcurrent, len(nodes.Items), true)
+	if err != nil {
+		return 0, err
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	return limit, nil
+}
+
+// InMaintenance returns whether node is scheduled for maintenance and not yet uncordoned by
+// drainsafe. Scheduled and pending nodes count, slots are acquired before the node is approved.
+func InMaintenance(node *corev1.Node) bool {
+	switch node.Annotations[annotations.DrainSafeMaintenance] {
+	case "":
+		return false
+	case annotations.Running:
+		return node.Spec.Unschedulable && node.Annotations[annotations.DrainSafeMaintenanceOwner] == annotations.Drainsafe
+	}
+	return true
+}
@@ -0,0 +1,233 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package coordinator_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	"github.com/awesomenix/drainsafe/coordinator"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newNode(name, zone, maintenance string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      map[string]string{"zone": zone},
+			Annotations: map[string]string{annotations.DrainSafeMaintenance: maintenance},
+		},
+	}
+}
+
+func newClient(objects ...runtime.Object) client.Client {
+	corev1.AddToScheme(scheme.Scheme)
+	return fake.NewFakeClient(objects...)
+}
+
+func slots(assert *assert.Assertions, c client.Client) map[string]string {
+	cm := &corev1.ConfigMap{}
+	err := c.Get(context.TODO(), types.NamespacedName{Namespace: "drainsafe-system", Name: coordinator.DefaultName}, cm)
+	assert.Nil(err)
+	return cm.Data
+}
+
+func TestAcquireRelease(t *testing.T) {
+	assert := assert.New(t)
+	node1 := newNode("node1", "1", annotations.Scheduled)
+	node2 := newNode("node2", "1", annotations.Scheduled)
+	node3 := newNode("node3", "2", annotations.Scheduled)
+	c := newClient(node1, node2, node3)
+	co := coordinator.New(c, nil, "drainsafe-system", intstr.FromInt(1), "")
+
+	acquired, err := co.Acquire(context.TODO(), node1)
+	assert.Nil(err)
+	assert.True(acquired)
+	assert.Equal(map[string]string{"node1": ""}, slots(assert, c))
+
+	// node1 keeps its slot while still scheduled, before it is approved
+	acquired, err = co.Acquire(context.TODO(), node2)
+	assert.Nil(err)
+	assert.False(acquired)
+
+	// acquiring again keeps the slot
+	acquired, err = co.Acquire(context.TODO(), node1)
+	assert.Nil(err)
+	assert.True(acquired)
+
+	err = co.Release(context.TODO(), "node1")
+	assert.Nil(err)
+	assert.Empty(slots(assert, c))
+	acquired, err = co.Acquire(context.TODO(), node2)
+	assert.Nil(err)
+	assert.True(acquired)
+	err = co.Release(context.TODO(), "unknown")
+	assert.Nil(err)
+}
+
+func TestAcquireStale(t *testing.T) {
+	assert := assert.New(t)
+	node1 := newNode("node1", "1", annotations.Drained)
+	node2 := newNode("node2", "1", annotations.Scheduled)
+	c := newClient(node1, node2)
+	co := coordinator.New(c, nil, "drainsafe-system", intstr.FromInt(1), "")
+
+	acquired, err := co.Acquire(context.TODO(), node1)
+	assert.Nil(err)
+	assert.True(acquired)
+
+	// node waiting for uncordon after maintenance keeps its slot
+	node1.Spec.Unschedulable = true
+	node1.Annotations[annotations.DrainSafeMaintenance] = annotations.Running
+	node1.Annotations[annotations.DrainSafeMaintenanceOwner] = annotations.Drainsafe
+	err = c.Update(context.TODO(), node1)
+	assert.Nil(err)
+	acquired, err = co.Acquire(context.TODO(), node2)
+	assert.Nil(err)
+	assert.False(acquired)
+
+	// slot is released once the node is uncordoned
+	node1.Spec.Unschedulable = false
+	node1.Annotations[annotations.DrainSafeMaintenanceOwner] = ""
+	err = c.Update(context.TODO(), node1)
+	assert.Nil(err)
+	acquired, err = co.Acquire(context.TODO(), node2)
+	assert.Nil(err)
+	assert.True(acquired)
+	assert.Equal(map[string]string{"node2": ""}, slots(assert, c))
+
+	// slot of a deleted node is released
+	err = c.Delete(context.TODO(), node2)
+	assert.Nil(err)
+	acquired, err = co.Acquire(context.TODO(), node1)
+	assert.Nil(err)
+	assert.True(acquired)
+	assert.Equal(map[string]string{"node1": ""}, slots(assert, c))
+}
+
+// staleNodes client returning nodes from a stale cache
+type staleNodes struct {
+	client.Client
+	cache client.Client
+}
+
+func (c *staleNodes) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	if _, ok := obj.(*corev1.Node); ok {
+		return c.cache.Get(ctx, key, obj)
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func TestAcquirePendingHolders(t *testing.T) {
+	assert := assert.New(t)
+	node1 := newNode("node1", "1", annotations.MaintenancePending)
+	node2 := newNode("node2", "1", annotations.Scheduled)
+	c := newClient(node1, node2)
+	// the cache has not seen node1 go into maintenance yet
+	cached := &staleNodes{Client: c, cache: newClient(newNode("node1", "1", annotations.Running), node2.DeepCopy())}
+	co := coordinator.New(cached, c, "drainsafe-system", intstr.FromInt(1), "")
+
+	acquired, err := co.Acquire(context.TODO(), node1)
+	assert.Nil(err)
+	assert.True(acquired)
+
+	// pending holder read bypassing the stale cache keeps its slot
+	acquired, err = co.Acquire(context.TODO(), node2)
+	assert.Nil(err)
+	assert.False(acquired)
+	assert.Equal(map[string]string{"node1": ""}, slots(assert, c))
+
+	// a holder whose maintenance annotation was removed releases its slot
+	node1.Annotations[annotations.DrainSafeMaintenance] = ""
+	err = c.Update(context.TODO(), node1)
+	assert.Nil(err)
+	acquired, err = co.Acquire(context.TODO(), node2)
+	assert.Nil(err)
+	assert.True(acquired)
+	assert.Equal(map[string]string{"node2": ""}, slots(assert, c))
+}
+
+func TestAcquirePercentPerGroup(t *testing.T) {
+	assert := assert.New(t)
+	nodes := []*corev1.Node{
+		newNode("node1", "1", annotations.Drained),
+		newNode("node2", "1", annotations.Drained),
+		newNode("node3", "1", annotations.Drained),
+		newNode("node4", "1", annotations.Drained),
+		newNode("node5", "2", annotations.Drained),
+	}
+	objects := []runtime.Object{}
+	for _, node := range nodes {
+		objects = append(objects, node)
+	}
+	c := newClient(objects...)
+	co := coordinator.New(c, nil, "drainsafe-system", intstr.FromString("30%"), "zone")
+	assert.Nil(co.Validate())
+
+	// 30% of 4 nodes in zone 1 rounds up to 2
+	for i, expected := range []bool{true, true, false} {
+		acquired, err := co.Acquire(context.TODO(), nodes[i])
+		assert.Nil(err)
+		assert.Equal(expected, acquired, nodes[i].Name)
+	}
+	// zone 2 has its own slots, at least one node is allowed
+	acquired, err := co.Acquire(context.TODO(), nodes[4])
+	assert.Nil(err)
+	assert.True(acquired)
+	assert.Equal(map[string]string{"node1": "1", "node2": "1", "node5": "2"}, slots(assert, c))
+
+	co.MaxConcurrent = intstr.FromString("many")
+	assert.NotNil(co.Validate())
+}
+
+func TestAcquireDomains(t *testing.T) {
+	assert := assert.New(t)
+	withDomains := func(node *corev1.Node, faultDomain, updateDomain string) *corev1.Node {
+		node.Labels = map[string]string{"topology.kubernetes.io/zone": node.Labels["zone"]}
+		node.Annotations[annotations.DrainSafePlatformFaultDomain] = faultDomain
+		node.Annotations[annotations.DrainSafePlatformUpdateDomain] = updateDomain
+		return node
+	}
+	nodes := []*corev1.Node{
+		withDomains(newNode("node1", "eastus-1", annotations.Drained), "0", "0"),
+		withDomains(newNode("node2", "eastus-1", annotations.Drained), "0", "1"),
+		withDomains(newNode("node3", "eastus-2", annotations.Drained), "0", "0"),
+		withDomains(newNode("node4", "eastus-1", annotations.Drained), "1", "1"),
+	}
+	objects := []runtime.Object{}
+	for _, node := range nodes {
+		objects = append(objects, node)
+	}
+	c := newClient(objects...)
+	co := coordinator.New(c, nil, "drainsafe-system", intstr.FromString("100%"), "")
+	co.MaxDomains = map[coordinator.Domain]int{coordinator.Zone: 1, coordinator.FaultDomain: 1}
+	assert.Equal("eastus-1/0", coordinator.NodeDomain(nodes[0], coordinator.FaultDomain))
+	assert.Equal("eastus-1/1", coordinator.NodeDomain(nodes[1], coordinator.UpdateDomain))
+
+	// update domains are not limited, node2 shares zone and fault domain with node1
+	for i, expected := range []bool{true, true, false, false} {
+		acquired, err := co.Acquire(context.TODO(), nodes[i])
+		assert.Nil(err)
+		assert.Equal(expected, acquired, nodes[i].Name)
+	}
+
+	co.MaxDomains[coordinator.FaultDomain] = 0
+	co.MaxDomains[coordinator.UpdateDomain] = 2
+	acquired, err := co.Acquire(context.TODO(), nodes[3])
+	assert.Nil(err)
+	assert.True(acquired)
+
+	co.MaxDomains = nil
+	acquired, err = co.Acquire(context.TODO(), nodes[2])
+	assert.Nil(err)
+	assert.True(acquired)
+}
@@ -10,6 +10,7 @@ require (
 	github.com/onsi/ginkgo v1.10.1
 	github.com/onsi/gomega v1.7.0
 	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v1.0.0
 	github.com/stretchr/testify v1.3.0
 	k8s.io/api v0.0.0
 	k8s.io/apiextensions-apiserver v0.0.0
@@ -0,0 +1,326 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var log logr.Logger = ctrl.Log.WithName("hooks")
+
+// Phase of maintenance hooks run in
+type Phase string
+
+const (
+	// PreDrain hooks run once the node is cordoned, before it is drained
+	PreDrain Phase = "PreDrain"
+	// PostMaintenance hooks run once maintenance completed, before the node is uncordoned
+	PostMaintenance Phase = "PostMaintenance"
+)
+
+const (
+	// DefaultTimeout how long a hook may run including retries
+	DefaultTimeout = 5 * time.Minute
+	// DefaultRetries how many times a failed hook is retried
+	DefaultRetries = 3
+	// webhookTimeout how long a single webhook call may take
+	webhookTimeout = 30 * time.Second
+)
+
+// Webhook hook called with a POST of WebhookRequest, succeeds on a 2xx response
+type Webhook struct {
+	URL string
+}
+
+// Job hook run as a kubernetes job, succeeds once the job completes
+type Job struct {
+	// Namespace of the job, namespace of the runner if empty
+	Namespace          string
+	Image              string
+	Command            []string
+	Args               []string
+	ServiceAccountName string
+}
+
+// Hook action run around maintenance, exactly one of Webhook or Job is set
+type Hook struct {
+	Name    string
+	Webhook *Webhook
+	Job     *Job
+	// Timeout how long the hook may run including retries, no limit if zero
+	Timeout time.Duration
+	// Retries how many times a failed hook is retried
+	Retries int
+	// IgnoreFailure maintenance proceeds once the hook failed or timed out
+	IgnoreFailure bool
+}
+
+// WebhookRequest body posted to webhooks
+type WebhookRequest struct {
+	Node      string `json:"node"`
+	Phase     Phase  `json:"phase"`
+	Hook      string `json:"hook"`
+	EventID   string `json:"eventId,omitempty"`
+	EventType string `json:"eventType,omitempty"`
+	NotBefore string `json:"notBefore,omitempty"`
+}
+
+// Status progress of a hook, persisted between runs
+type Status struct {
+	Name      string    `json:"name"`
+	StartTime time.Time `json:"startTime"`
+	// Attempts failed so far
+	Attempts int `json:"attempts,omitempty"`
+	// Job name of the job of the current attempt
+	Job       string `json:"job,omitempty"`
+	Succeeded bool   `json:"succeeded,omitempty"`
+	Failed    bool   `json:"failed,omitempty"`
+	// Message why the last attempt failed
+	Message string `json:"message,omitempty"`
+}
+
+// Result of running hooks
+type Result struct {
+	// Statuses of hooks started so far, to be passed to the next run
+	Statuses []Status
+	// Finished hooks which succeeded or failed during the run
+	Finished []Status
+	// Done all hooks succeeded or failed ignoring failure
+	Done bool
+	// Blocked a hook failed which does not ignore failure, maintenance must not proceed
+	Blocked bool
+}
+
+// Runner runs hooks
+type Runner struct {
+	Client     client.Client
+	HTTPClient *http.Client
+	// Namespace of jobs which do not set a namespace
+	Namespace string
+}
+
+// NewRunner creates a runner creating jobs in namespace unless set by the hook
+func NewRunner(c client.Client, namespace string) *Runner {
+	if namespace == "" {
+		namespace = "default"
+	}
+	return &Runner{
+		Client:     c,
+		HTTPClient: &http.Client{Timeout: webhookTimeout},
+		Namespace:  namespace,
+	}
+}
+
+// Run advances hooks of phase for node, resuming from statuses of a previous run. Hooks run
+// one at a time in order, a hook starts once the previous one succeeded or failed ignoring
+// failure. Run does not block, webhooks are called once and jobs are created or checked once
+// per run, failed attempts are retried on the next run until Retries or Timeout are exceeded.
+func (r *Runner) Run(ctx context.Context, node *corev1.Node, phase Phase, hooks []Hook, statuses []Status, now time.Time) Result {
+	result := Result{Statuses: append([]Status{}, statuses...)}
+	for _, hook := range hooks {
+		status := result.status(hook.Name, now)
+		if !status.Succeeded && !status.Failed {
+			r.step(ctx, node, phase, hook, status, now)
+			if status.Succeeded || status.Failed {
+				result.Finished = append(result.Finished, *status)
+			}
+		}
+		if status.Succeeded || (status.Failed && hook.IgnoreFailure) {
+			continue
+		}
+		result.Blocked = status.Failed
+		return result
+	}
+	result.Done = true
+	return result
+}
+
+// status returns status of hook, started now if the hook did not start yet
+func (r *Result) status(name string, now time.Time) *Status {
+	for i := range r.Statuses {
+		if r.Statuses[i].Name == name {
+			return &r.Statuses[i]
+		}
+	}
+	r.Statuses = append(r.Statuses, Status{Name: name, StartTime: now})
+	return &r.Statuses[len(r.Statuses)-1]
+}
+
+// step runs a single attempt of hook or checks the attempt in progress
+func (r *Runner) step(ctx context.Context, node *corev1.Node, phase Phase, hook Hook, status *Status, now time.Time) {
+	if hook.Timeout > 0 && now.Sub(status.StartTime) >= hook.Timeout {
+		status.Failed = true
+		status.Message = fmt.Sprintf("timed out after %s, %s", hook.Timeout, status.Message)
+		return
+	}
+
+	var done bool
+	var err error
+	switch {
+	case hook.Webhook != nil:
+		done, err = r.callWebhook(ctx, node, phase, hook)
+	case hook.Job != nil:
+		done, err = r.runJob(ctx, node, phase, hook, status)
+	default:
+		status.Failed = true
+		status.Message = "hook has neither webhook nor job"
+		return
+	}
+	if err != nil {
+		log.Info("Hook attempt failed", "Node", node.Name, "Phase", phase, "Hook", hook.Name, "Attempt", status.Attempts+1, "Error", err.Error())
+		status.Attempts++
+		status.Message = err.Error()
+		status.Failed = status.Attempts > hook.Retries
+		return
+	}
+	if done {
+		log.Info("Hook succeeded", "Node", node.Name, "Phase", phase, "Hook", hook.Name)
+		status.Succeeded = true
+		status.Message = ""
+	}
+}
+
+// callWebhook posts WebhookRequest to the webhook, done on a 2xx response
+func (r *Runner) callWebhook(ctx context.Context, node *corev1.Node, phase Phase, hook Hook) (bool, error) {
+	body, err := json.Marshal(WebhookRequest{
+		Node:      node.Name,
+		Phase:     phase,
+		Hook:      hook.Name,
+		EventID:   node.Annotations[annotations.DrainSafeEventID],
+		EventType: node.Annotations[annotations.DrainSafeMaintenanceType],
+		NotBefore: node.Annotations[annotations.DrainSafeNotBefore],
+	})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, hook.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, errors.Wrapf(err, "error calling webhook")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, errors.Errorf("webhook returned %s", resp.Status)
+	}
+	return true, nil
+}
+
+// runJob creates the job of the current attempt or checks its progress, done once the job completes.
+// Finished jobs are deleted, their outcome is kept in status.
+func (r *Runner) runJob(ctx context.Context, node *corev1.Node, phase Phase, hook Hook, status *Status) (bool, error) {
+	namespace := hook.Job.Namespace
+	if namespace == "" {
+		namespace = r.Namespace
+	}
+	if status.Job == "" {
+		job := r.newJob(node, phase, hook, namespace, jobName(node, phase, hook.Name, status))
+		if err := r.Client.Create(ctx, job); err != nil && !apierrors.IsAlreadyExists(err) {
+			return false, errors.Wrapf(err, "error creating job")
+		}
+		status.Job = job.Name
+		return false, nil
+	}
+
+	job := &batchv1.Job{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: status.Job}, job); err != nil {
+		status.Job = ""
+		return false, errors.Wrapf(err, "error getting job")
+	}
+	if job.Status.Succeeded > 0 {
+		r.deleteJob(ctx, job)
+		return true, nil
+	}
+	if job.Status.Failed > 0 {
+		r.deleteJob(ctx, job)
+		status.Job = ""
+		return false, errors.Errorf("job %s/%s failed", namespace, job.Name)
+	}
+	return false, nil
+}
+
+// deleteJob deletes a finished job with its pods, a job which could not be deleted is left behind
+func (r *Runner) deleteJob(ctx context.Context, job *batchv1.Job) {
+	if err := r.Client.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !apierrors.IsNotFound(err) {
+		log.Error(err, "Failed to delete finished hook job", "Namespace", job.Namespace, "Job", job.Name)
+	}
+}
+
+func (r *Runner) newJob(node *corev1.Node, phase Phase, hook Hook, namespace, name string) *batchv1.Job {
+	backoffLimit := int32(0)
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "Node",
+				Name:       node.Name,
+				UID:        node.UID,
+			}},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy:      corev1.RestartPolicyNever,
+					ServiceAccountName: hook.Job.ServiceAccountName,
+					Containers: []corev1.Container{{
+						Name:    "hook",
+						Image:   hook.Job.Image,
+						Command: hook.Job.Command,
+						Args:    hook.Job.Args,
+						Env: []corev1.EnvVar{
+							{Name: "NODE_NAME", Value: node.Name},
+							{Name: "MAINTENANCE_PHASE", Value: string(phase)},
+							{Name: "MAINTENANCE_TYPE", Value: node.Annotations[annotations.DrainSafeMaintenanceType]},
+							{Name: "EVENT_ID", Value: node.Annotations[annotations.DrainSafeEventID]},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// jobName name of the job of the current attempt, a valid dns label. The name is unique to the
+// maintenance, hashing the event id and the start time of the hook, so that jobs of an earlier
+// maintenance of the node are never picked up.
+func jobName(node *corev1.Node, phase Phase, hookName string, status *Status) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%s/%s/%d", node.Annotations[annotations.DrainSafeEventID], phase, hookName, status.StartTime.UnixNano())
+	suffix := fmt.Sprintf("-%08x-%d", h.Sum32(), status.Attempts)
+	name := strings.ToLower(fmt.Sprintf("drainsafe-%s-%s", node.Name, hookName))
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '-'
+	}, name)
+	if len(name)+len(suffix) > 63 {
+		name = strings.TrimRight(name[:63-len(suffix)], "-")
+	}
+	return name + suffix
+}
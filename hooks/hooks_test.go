@@ -0,0 +1,199 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package hooks_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	"github.com/awesomenix/drainsafe/hooks"
+	"github.com/stretchr/testify/assert"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var node = &corev1.Node{
+	ObjectMeta: metav1.ObjectMeta{
+		Name: "dummynode",
+		Annotations: map[string]string{
+			annotations.DrainSafeEventID:         "F3E6E2D2-E86A-47F0-AA8E-18918049A2B1",
+			annotations.DrainSafeMaintenanceType: "Reboot",
+		},
+	},
+}
+
+func TestWebhook(t *testing.T) {
+	assert := assert.New(t)
+	requests := []hooks.WebhookRequest{}
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		request := hooks.WebhookRequest{}
+		assert.Nil(json.NewDecoder(req.Body).Decode(&request))
+		requests = append(requests, request)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	runner := hooks.NewRunner(fake.NewFakeClient(), "")
+	hookList := []hooks.Hook{
+		{Name: "deregister", Webhook: &hooks.Webhook{URL: server.URL}, Retries: 1},
+		{Name: "flush", Webhook: &hooks.Webhook{URL: server.URL}, Retries: 0, IgnoreFailure: true},
+	}
+	now := time.Now()
+
+	result := runner.Run(context.TODO(), node, hooks.PreDrain, hookList, nil, now)
+	assert.False(result.Done)
+	assert.False(result.Blocked)
+	assert.Empty(result.Finished)
+	assert.Equal(1, result.Statuses[0].Attempts)
+	assert.Contains(result.Statuses[0].Message, "500")
+	assert.Equal(hooks.WebhookRequest{
+		Node:      "dummynode",
+		Phase:     hooks.PreDrain,
+		Hook:      "deregister",
+		EventID:   "F3E6E2D2-E86A-47F0-AA8E-18918049A2B1",
+		EventType: "Reboot",
+	}, requests[0])
+
+	// retried until retries are exceeded, then the next hook is run
+	status = http.StatusOK
+	result = runner.Run(context.TODO(), node, hooks.PreDrain, hookList, result.Statuses, now)
+	assert.True(result.Done)
+	assert.Len(result.Finished, 2)
+	assert.True(result.Statuses[0].Succeeded)
+	assert.True(result.Statuses[1].Succeeded)
+	assert.Equal("flush", requests[2].Hook)
+
+	// failed hooks which ignore failure do not block
+	status = http.StatusBadGateway
+	result = runner.Run(context.TODO(), node, hooks.PostMaintenance, hookList[1:], nil, now)
+	assert.True(result.Done)
+	assert.True(result.Statuses[0].Failed)
+
+	// failed hooks block unless they ignore failure
+	result = runner.Run(context.TODO(), node, hooks.PostMaintenance, hookList[:1], nil, now)
+	result = runner.Run(context.TODO(), node, hooks.PostMaintenance, hookList[:1], result.Statuses, now)
+	assert.False(result.Done)
+	assert.True(result.Blocked)
+	assert.Len(result.Finished, 1)
+	result = runner.Run(context.TODO(), node, hooks.PostMaintenance, hookList[:1], result.Statuses, now)
+	assert.True(result.Blocked)
+	assert.Empty(result.Finished)
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	runner := hooks.NewRunner(fake.NewFakeClient(), "")
+	hookList := []hooks.Hook{{Name: "warmup", Webhook: &hooks.Webhook{URL: server.URL}, Retries: 10, Timeout: time.Minute}}
+	now := time.Now()
+	result := runner.Run(context.TODO(), node, hooks.PostMaintenance, hookList, nil, now)
+	assert.False(result.Done)
+	result = runner.Run(context.TODO(), node, hooks.PostMaintenance, hookList, result.Statuses, now.Add(time.Minute))
+	assert.True(result.Blocked)
+	assert.Contains(result.Statuses[0].Message, "timed out after 1m0s")
+}
+
+func TestJob(t *testing.T) {
+	assert := assert.New(t)
+	batchv1.AddToScheme(scheme.Scheme)
+	f := fake.NewFakeClient()
+	runner := hooks.NewRunner(f, "drainsafe-system")
+	hookList := []hooks.Hook{{
+		Name:    "Warmup",
+		Job:     &hooks.Job{Image: "busybox", Command: []string{"sh", "-c", "exit 0"}},
+		Retries: 1,
+	}}
+	now := time.Now()
+
+	result := runner.Run(context.TODO(), node, hooks.PostMaintenance, hookList, nil, now)
+	assert.False(result.Done)
+	first := result.Statuses[0].Job
+	assert.True(strings.HasPrefix(first, "drainsafe-dummynode-warmup-"))
+	assert.True(strings.HasSuffix(first, "-0"))
+	job := &batchv1.Job{}
+	err := f.Get(context.TODO(), types.NamespacedName{Namespace: "drainsafe-system", Name: first}, job)
+	assert.Nil(err)
+	assert.Equal("busybox", job.Spec.Template.Spec.Containers[0].Image)
+	assert.Contains(job.Spec.Template.Spec.Containers[0].Env, corev1.EnvVar{Name: "MAINTENANCE_PHASE", Value: "PostMaintenance"})
+
+	// failed job is deleted and retried with a new job
+	job.Status.Failed = 1
+	err = f.Update(context.TODO(), job)
+	assert.Nil(err)
+	result = runner.Run(context.TODO(), node, hooks.PostMaintenance, hookList, result.Statuses, now)
+	assert.Equal(1, result.Statuses[0].Attempts)
+	assert.Equal("", result.Statuses[0].Job)
+	err = f.Get(context.TODO(), types.NamespacedName{Namespace: "drainsafe-system", Name: first}, &batchv1.Job{})
+	assert.True(apierrors.IsNotFound(err))
+	result = runner.Run(context.TODO(), node, hooks.PostMaintenance, hookList, result.Statuses, now)
+	second := result.Statuses[0].Job
+	assert.NotEqual(first, second)
+	assert.True(strings.HasSuffix(second, "-1"))
+
+	job = &batchv1.Job{}
+	err = f.Get(context.TODO(), types.NamespacedName{Namespace: "drainsafe-system", Name: second}, job)
+	assert.Nil(err)
+	job.Status.Succeeded = 1
+	err = f.Update(context.TODO(), job)
+	assert.Nil(err)
+	result = runner.Run(context.TODO(), node, hooks.PostMaintenance, hookList, result.Statuses, now)
+	assert.True(result.Done)
+	assert.True(result.Statuses[0].Succeeded)
+	err = f.Get(context.TODO(), types.NamespacedName{Namespace: "drainsafe-system", Name: second}, &batchv1.Job{})
+	assert.True(apierrors.IsNotFound(err))
+}
+
+func TestJobBackToBackMaintenances(t *testing.T) {
+	assert := assert.New(t)
+	batchv1.AddToScheme(scheme.Scheme)
+	f := fake.NewFakeClient()
+	runner := hooks.NewRunner(f, "drainsafe-system")
+	hookList := []hooks.Hook{{
+		Name: "Warmup",
+		Job:  &hooks.Job{Image: "busybox", Command: []string{"sh", "-c", "exit 0"}},
+	}}
+	now := time.Now()
+
+	for i, eventID := range []string{"", "", "F3E6E2D2-E86A-47F0-AA8E-18918049A2B1", "0C5E0F3A-2C3B-4C8E-9E36-6B1F2A7C9D10"} {
+		n := node.DeepCopy()
+		n.Annotations[annotations.DrainSafeEventID] = eventID
+		start := now.Add(time.Duration(i) * time.Hour)
+
+		// each maintenance creates its own job, and does not pick up the job of the previous one
+		result := runner.Run(context.TODO(), n, hooks.PostMaintenance, hookList, nil, start)
+		assert.False(result.Done)
+		name := result.Statuses[0].Job
+		result = runner.Run(context.TODO(), n, hooks.PostMaintenance, hookList, result.Statuses, start)
+		assert.False(result.Done, "maintenance %d", i)
+
+		job := &batchv1.Job{}
+		err := f.Get(context.TODO(), types.NamespacedName{Namespace: "drainsafe-system", Name: name}, job)
+		assert.Nil(err)
+		job.Status.Succeeded = 1
+		err = f.Update(context.TODO(), job)
+		assert.Nil(err)
+		result = runner.Run(context.TODO(), n, hooks.PostMaintenance, hookList, result.Statuses, start)
+		assert.True(result.Done)
+
+		jobs := &batchv1.JobList{}
+		err = f.List(context.TODO(), jobs)
+		assert.Nil(err)
+		assert.Empty(jobs.Items)
+	}
+}
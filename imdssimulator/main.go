@@ -0,0 +1,56 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/awesomenix/drainsafe/azure"
+	"github.com/awesomenix/drainsafe/azure/simulator"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+var setupLog = ctrl.Log.WithName("setup")
+
+func main() {
+	var addr, vmName, eventType, faultDomain, updateDomain string
+	var startedDuration, tick time.Duration
+	var verbose bool
+	flag.StringVar(&addr, "addr", "127.0.0.1:8090", "The address the simulated instance metadata service binds to.")
+	flag.StringVar(&vmName, "vm-name", "", "Simulated vm instance name, defaults to NODE_NAME or hostname.")
+	flag.StringVar(&faultDomain, "platform-fault-domain", "0", "Simulated platformFaultDomain of the vm.")
+	flag.StringVar(&updateDomain, "platform-update-domain", "0", "Simulated platformUpdateDomain of the vm.")
+	flag.StringVar(&eventType, "event-type", "", "Schedule an event of this type at startup, e.g. Reboot.")
+	flag.DurationVar(&startedDuration, "started-duration", 30*time.Second, "How long events stay Started before they are removed, 0 keeps them.")
+	flag.DurationVar(&tick, "tick", time.Second, "How often NotBefore and started durations are evaluated.")
+	flag.BoolVar(&verbose, "verbose", false, "verbose logging")
+	flag.Parse()
+
+	ctrl.SetLogger(zap.Logger(verbose))
+
+	if vmName == "" {
+		vmName = os.Getenv("NODE_NAME")
+	}
+	if vmName == "" {
+		vmName, _ = os.Hostname()
+	}
+
+	s := simulator.New(vmName)
+	s.StartedDuration = startedDuration
+	s.SetPlatformDomains(faultDomain, updateDomain)
+	if eventType != "" {
+		s.AddEvent(azure.ScheduledEvent{EventType: eventType})
+	}
+
+	go s.Run(tick, ctrl.SetupSignalHandler())
+
+	setupLog.Info("starting simulator", "Addr", addr, "VMName", vmName)
+	if err := http.ListenAndServe(addr, s); err != nil {
+		setupLog.Error(err, "problem running simulator")
+		os.Exit(1)
+	}
+}
@@ -4,14 +4,21 @@
 package kubectl
 
 import (
+	"context"
 	"fmt"
-	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
-	"k8s.io/cli-runtime/pkg/genericclioptions"
-	kubectldrain "k8s.io/kubectl/pkg/cmd/drain"
-	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/kubectl/pkg/drain"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 )
@@ -19,6 +26,7 @@ import (
 var log logr.Logger = ctrl.Log.WithName("kubectl")
 
 var _ Client = &client{}
+var _ ContextClient = &client{}
 
 // Client interface for kubernetes
 type Client interface {
@@ -27,74 +35,432 @@ type Client interface {
 	Uncordon(vmName string) error
 }
 
+// ContextClient cancellable interface for kubernetes, calls give up once ctx is done
+type ContextClient interface {
+	Client
+	CordonContext(ctx context.Context, vmName string) error
+	DrainContext(ctx context.Context, vmName string, options DrainOptions, progress ProgressFunc) (*DrainResult, error)
+	UncordonContext(ctx context.Context, vmName string) error
+}
+
+// DrainOptions options for draining a node
+type DrainOptions struct {
+	// GracePeriod seconds given to each pod to terminate gracefully
+	GracePeriod int
+	// Timeout to give up draining, zero waits forever
+	Timeout time.Duration
+	// IgnoreDaemonSets ignores daemonset managed pods
+	IgnoreDaemonSets bool
+	// Force deletes pods which are not managed by a controller
+	Force bool
+	// DeleteLocalData deletes pods using emptyDir volumes
+	DeleteLocalData bool
+	// PodPolicies drain policy of pods without drainsafe.azure.com/drain-policy annotation,
+	// the first selector matching pod labels applies
+	PodPolicies []PodPolicySelector
+	// WaveOrder splits pods of the same PodDrainPolicy into eviction waves
+	WaveOrder WaveOrder
+	// WaveTimeout how long to wait for pods of a wave to be running elsewhere before the next
+	// wave is evicted anyway, zero waits until Timeout
+	WaveTimeout time.Duration
+	// ForceDelete deletes pods whose eviction is refused by a pod disruption budget instead of
+	// retrying the eviction
+	ForceDelete bool
+}
+
+// PodResult outcome of evicting a pod
+type PodResult struct {
+	Namespace string
+	Name      string
+	// Policy pod was drained with
+	Policy PodDrainPolicy
+	// Wave index of the eviction wave of the pod, starting at 0
+	Wave int
+	// Owner controller of the pod, nil if the pod is not managed by a controller
+	Owner *PodOwner
+	// DisruptionBudgets namespace/name of pod disruption budgets selecting the pod, set if
+	// eviction of the pod was refused by a pod disruption budget
+	DisruptionBudgets []string
+	// Evicted pod was evicted or deleted and is gone from the node
+	Evicted bool
+	// Err why the pod could not be evicted
+	Err error
+}
+
+// DrainResult outcome of draining a node
+type DrainResult struct {
+	// Pods evicted or attempted to be evicted
+	Pods []PodResult
+	// Warnings about pods left on the node, e.g. daemonset managed pods
+	Warnings string
+}
+
+// Evicted returns namespace/name of evicted pods
+func (r *DrainResult) Evicted() []string {
+	evicted := []string{}
+	for _, pod := range r.Pods {
+		if pod.Evicted {
+			evicted = append(evicted, pod.Namespace+"/"+pod.Name)
+		}
+	}
+	return evicted
+}
+
+// Owners returns controllers of evicted pods, each listed once
+func (r *DrainResult) Owners() []PodOwner {
+	owners := []PodOwner{}
+	seen := map[PodOwner]bool{}
+	for _, pod := range r.Pods {
+		if pod.Evicted && pod.Owner != nil && !seen[*pod.Owner] {
+			seen[*pod.Owner] = true
+			owners = append(owners, *pod.Owner)
+		}
+	}
+	return owners
+}
+
+// Failed returns pods which could not be evicted
+func (r *DrainResult) Failed() []PodResult {
+	failed := []PodResult{}
+	for _, pod := range r.Pods {
+		if !pod.Evicted {
+			failed = append(failed, pod)
+		}
+	}
+	return failed
+}
+
+// Blocked returns pods which could not be evicted because pod disruption budgets refused the eviction
+func (r *DrainResult) Blocked() []PodResult {
+	blocked := []PodResult{}
+	for _, pod := range r.Pods {
+		if !pod.Evicted && pod.Err != nil && apierrors.IsTooManyRequests(errors.Cause(pod.Err)) {
+			blocked = append(blocked, pod)
+		}
+	}
+	return blocked
+}
+
+// Err returns an error listing pods which could not be evicted, nil if all were evicted
+func (r *DrainResult) Err() error {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	messages := []string{}
+	for _, pod := range failed {
+		messages = append(messages, fmt.Sprintf("%s/%s: %v", pod.Namespace, pod.Name, pod.Err))
+	}
+	return errors.Errorf("failed to evict %d pods, %s", len(failed), strings.Join(messages, ", "))
+}
+
+// DrainProgress reported each time a pod is evicted or fails to be evicted
+type DrainProgress struct {
+	Pod PodResult
+	// Done pods evicted or failed so far out of Total
+	Done  int
+	Total int
+}
+
+// ProgressFunc receives drain progress, calls are serialized
+type ProgressFunc func(progress DrainProgress)
+
+const (
+	// evictionRetryInterval wait before retrying an eviction refused by a pod disruption budget
+	evictionRetryInterval = 5 * time.Second
+	// deletePollInterval wait between checks whether an evicted pod is gone
+	deletePollInterval = 1 * time.Second
+)
+
 type client struct {
-	f       cmdutil.Factory
-	streams genericclioptions.IOStreams
+	clientset kubernetes.Interface
 }
 
 // New creates a new client
-func New() (Client, error) {
+func New() (ContextClient, error) {
 	cfg, err := config.GetConfig()
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to set up client config")
 	}
 
-	streams := genericclioptions.IOStreams{
-		Out:    os.Stdout,
-		ErrOut: os.Stderr,
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to create clientset")
 	}
 
+	return NewForClientset(clientset), nil
+}
+
+// NewForClientset creates a new client using clientset, the client is safe for concurrent use
+func NewForClientset(clientset kubernetes.Interface) ContextClient {
 	return &client{
-		f:       cmdutil.NewFactory(&RESTConfigClientGetter{Config: cfg}),
-		streams: streams,
-	}, nil
+		clientset: clientset,
+	}
 }
 
 // Cordon cordons  vmname from kubernetes
 func (c *client) Cordon(vmName string) error {
-	cordon := kubectldrain.NewCmdCordon(c.f, c.streams)
-	options := kubectldrain.NewDrainCmdOptions(c.f, c.streams)
-	if err := options.Complete(c.f, cordon, []string{vmName}); err != nil {
-		return errors.Wrapf(err, "error setting up cordon")
-	}
+	return c.CordonContext(context.Background(), vmName)
+}
 
+// CordonContext cordons vmname from kubernetes unless ctx is done
+func (c *client) CordonContext(ctx context.Context, vmName string) error {
 	log.Info("Cordon", "VMName", vmName)
-	if err := options.RunCordonOrUncordon(true); err != nil {
+	if err := c.cordonOrUncordon(ctx, vmName, true); err != nil {
 		return errors.Wrapf(err, "error cordoning node")
 	}
+	return nil
+}
+
+// Uncordon uncordons vmname from kubernetes
+func (c *client) Uncordon(vmName string) error {
+	return c.UncordonContext(context.Background(), vmName)
+}
 
+// UncordonContext uncordons vmname from kubernetes unless ctx is done
+func (c *client) UncordonContext(ctx context.Context, vmName string) error {
+	log.Info("Uncordon", "VMName", vmName)
+	if err := c.cordonOrUncordon(ctx, vmName, false); err != nil {
+		return errors.Wrapf(err, "error uncordoning node")
+	}
 	return nil
 }
 
-// Drain drains vmname from kubernetes
+func (c *client) cordonOrUncordon(ctx context.Context, vmName string, desired bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	node, err := c.clientset.CoreV1().Nodes().Get(vmName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	helper := drain.NewCordonHelper(node)
+	if !helper.UpdateIfRequired(desired) {
+		return nil
+	}
+	err, patchErr := helper.PatchOrReplace(c.clientset)
+	if patchErr != nil {
+		return patchErr
+	}
+	return err
+}
+
+// Drain drains vmname from kubernetes ignoring daemonsets, deleting unmanaged pods and pods
+// with local data, like kubectl drain --ignore-daemonsets --force --delete-local-data
 func (c *client) Drain(vmName string, gracePeriod int) error {
-	drain := kubectldrain.NewCmdDrain(c.f, c.streams)
-	drain.SetArgs([]string{vmName, "--ignore-daemonsets", "--force", "--delete-local-data", fmt.Sprintf("--grace-period=%d", gracePeriod)})
+	_, err := c.DrainContext(context.Background(), vmName, DrainOptions{
+		GracePeriod:      gracePeriod,
+		IgnoreDaemonSets: true,
+		Force:            true,
+		DeleteLocalData:  true,
+	}, nil)
+	return err
+}
 
-	var drainErr error
-	cmdutil.BehaviorOnFatal(func(msg string, code int) {
-		drainErr = errors.Errorf("returned code %d, %s", code, msg)
-	})
-	log.Info("Draining", "VMName", vmName)
-	if err := drain.Execute(); err != nil {
-		return errors.Wrapf(err, "error draining node")
+// DrainContext evicts pods from vmname, falling back to delete if eviction is not supported,
+// and waits for them to be gone. Pods are drained in waves according to their PodDrainPolicy
+// and WaveOrder, first pods are evicted before the others and last pods after all others, each
+// wave starts once controllers of the previous wave have all replicas ready again. The drain is
+// blocked if any pod is never evicted. Evictions refused by a pod disruption budget are retried
+// until Timeout or until ctx is done, or the pods are deleted if ForceDelete is set. Progress is
+// reported as each pod is done if not nil.
+func (c *client) DrainContext(ctx context.Context, vmName string, options DrainOptions, progress ProgressFunc) (*DrainResult, error) {
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrapf(err, "error draining node")
+	}
+	helper := &drain.Helper{
+		Client:              c.clientset,
+		Force:               options.Force,
+		GracePeriodSeconds:  options.GracePeriod,
+		IgnoreAllDaemonSets: options.IgnoreDaemonSets,
+		Timeout:             options.Timeout,
+		DeleteLocalData:     options.DeleteLocalData,
+	}
+
+	log.Info("Draining", "VMName", vmName, "GracePeriod", options.GracePeriod, "Timeout", options.Timeout)
+	list, errs := helper.GetPodsForDeletion(vmName)
+	if len(errs) != 0 {
+		messages := []string{}
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		return nil, errors.Errorf("error draining node, %s", strings.Join(messages, ", "))
+	}
+	result := &DrainResult{Warnings: list.Warnings()}
+	if result.Warnings != "" {
+		log.Info("Ignoring pods", "VMName", vmName, "Warnings", result.Warnings)
+	}
+
+	policyGroupVersion, err := drain.CheckEvictionSupport(c.clientset)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error checking eviction support")
+	}
+
+	// pods which are never evicted block the drain before anything is evicted
+	blocked := []string{}
+	pods := []corev1.Pod{}
+	policies := map[types.UID]PodDrainPolicy{}
+	for _, pod := range list.Pods() {
+		policy := GetPodDrainPolicy(&pod, options.PodPolicies)
+		if policy == PodDrainNever {
+			blocked = append(blocked, pod.Namespace+"/"+pod.Name)
+			result.Pods = append(result.Pods, PodResult{Namespace: pod.Namespace, Name: pod.Name, Policy: PodDrainNever, Err: ErrDrainBlocked})
+			continue
+		}
+		policies[pod.UID] = policy
+		pods = append(pods, pod)
+	}
+	if len(blocked) != 0 {
+		return result, errors.Wrapf(ErrDrainBlocked, "error draining node, %s", strings.Join(blocked, ", "))
 	}
 
-	return drainErr
+	var mu sync.Mutex
+	report := func(podResult PodResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		result.Pods = append(result.Pods, podResult)
+		if progress != nil {
+			progress(DrainProgress{Pod: podResult, Done: len(result.Pods), Total: len(pods)})
+		}
+	}
+	// each wave is evicted once pods of the previous wave are gone and running elsewhere
+	waves := drainWaves(pods, policies, options.WaveOrder)
+	for i, wave := range waves {
+		var skipErr error
+		if len(result.Failed()) != 0 {
+			skipErr = errors.New("not evicted, pods evicted before failed")
+		} else if i > 0 {
+			if err := c.waitRescheduled(ctx, vmName, waves[i-1], options.WaveTimeout); err != nil {
+				skipErr = errors.Wrapf(err, "not evicted, pods evicted before were not rescheduled")
+			}
+		}
+		if skipErr != nil {
+			for _, pod := range wave {
+				report(PodResult{Namespace: pod.Namespace, Name: pod.Name, Policy: policies[pod.UID], Wave: i, Owner: GetPodOwner(&pod), Err: skipErr})
+			}
+			continue
+		}
+
+		log.Info("Evicting wave", "VMName", vmName, "Wave", i, "Pods", len(wave))
+		var wg sync.WaitGroup
+		for j := range wave {
+			wg.Add(1)
+			go func(pod corev1.Pod) {
+				defer wg.Done()
+				evictionVersion := policyGroupVersion
+				if policies[pod.UID] == PodDrainDelete {
+					evictionVersion = ""
+				}
+				podResult := c.evictPod(ctx, helper, pod, evictionVersion, options.ForceDelete)
+				podResult.Policy = policies[pod.UID]
+				podResult.Wave = i
+				report(podResult)
+			}(wave[j])
+		}
+		wg.Wait()
+	}
+
+	for _, pod := range result.Pods {
+		if pod.Evicted {
+			log.Info("Evicted", "VMName", vmName, "Namespace", pod.Namespace, "Name", pod.Name)
+		} else {
+			log.Info("Failed to evict", "VMName", vmName, "Namespace", pod.Namespace, "Name", pod.Name, "Error", pod.Err.Error())
+		}
+	}
+	if err := result.Err(); err != nil {
+		return result, errors.Wrapf(err, "error draining node")
+	}
+	return result, nil
 }
 
-// Uncordon uncordons vmname from kubernetes
-func (c *client) Uncordon(vmName string) error {
-	cordon := kubectldrain.NewCmdCordon(c.f, c.streams)
-	options := kubectldrain.NewDrainCmdOptions(c.f, c.streams)
-	if err := options.Complete(c.f, cordon, []string{vmName}); err != nil {
-		return errors.Wrapf(err, "error setting up cordon")
+// evictPod evicts or deletes pod and waits until it is gone, gives up once ctx is done. Evictions
+// refused by a pod disruption budget are retried, or the pod is deleted if forceDelete is set.
+func (c *client) evictPod(ctx context.Context, helper *drain.Helper, pod corev1.Pod, policyGroupVersion string, forceDelete bool) PodResult {
+	result := PodResult{Namespace: pod.Namespace, Name: pod.Name, Owner: GetPodOwner(&pod)}
+
+	for {
+		var err error
+		if policyGroupVersion != "" {
+			err = helper.EvictPod(pod, policyGroupVersion)
+		} else {
+			err = helper.DeletePod(pod)
+		}
+		if err == nil || apierrors.IsNotFound(err) {
+			break
+		}
+		if !apierrors.IsTooManyRequests(err) {
+			result.Err = err
+			return result
+		}
+		// refused by pod disruption budget
+		if result.DisruptionBudgets == nil {
+			result.DisruptionBudgets = c.disruptionBudgets(&pod)
+			log.Info("Eviction refused by pod disruption budget", "Namespace", pod.Namespace, "Name", pod.Name, "DisruptionBudgets", strings.Join(result.DisruptionBudgets, ", "))
+		}
+		if forceDelete {
+			log.Info("Force deleting pod", "Namespace", pod.Namespace, "Name", pod.Name)
+			policyGroupVersion = ""
+			continue
+		}
+		if waitErr := wait(ctx, evictionRetryInterval); waitErr != nil {
+			result.Err = errors.Wrapf(err, "gave up evicting pod, %v", waitErr)
+			return result
+		}
 	}
 
-	log.Info("Uncordon", "VMName", vmName)
-	if err := options.RunCordonOrUncordon(false); err != nil {
-		return errors.Wrapf(err, "error cordoning node")
+	for {
+		current, err := c.clientset.CoreV1().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || (err == nil && current.UID != pod.UID) {
+			result.Evicted = true
+			return result
+		}
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		if waitErr := wait(ctx, deletePollInterval); waitErr != nil {
+			result.Err = errors.Wrapf(waitErr, "gave up waiting for pod to be deleted")
+			return result
+		}
 	}
+}
 
-	return nil
+// disruptionBudgets returns namespace/name of pod disruption budgets selecting pod
+func (c *client) disruptionBudgets(pod *corev1.Pod) []string {
+	budgets := []string{}
+	pdbs, err := c.clientset.PolicyV1beta1().PodDisruptionBudgets(pod.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		log.Error(err, "failed to list pod disruption budgets", "Namespace", pod.Namespace)
+		return budgets
+	}
+	for _, pdb := range pdbs.Items {
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil || selector.Empty() {
+			continue
+		}
+		if selector.Matches(labels.Set(pod.Labels)) {
+			budgets = append(budgets, pdb.Namespace+"/"+pdb.Name)
+		}
+	}
+	return budgets
+}
+
+// wait sleeps for interval, returns ctx error if ctx is done first
+func wait(ctx context.Context, interval time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,267 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package kubectl_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	"github.com/awesomenix/drainsafe/kubectl"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newPod(name, nodeName string, owner *metav1.OwnerReference) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			UID:       types.UID("uid-" + name),
+		},
+		Spec: corev1.PodSpec{NodeName: nodeName},
+	}
+	if owner != nil {
+		pod.OwnerReferences = []metav1.OwnerReference{*owner}
+	}
+	return pod
+}
+
+// newClientset returns clientset with eviction support which removes evicted pods,
+// evictions of pods in refused are rejected as by a pod disruption budget. Pods are
+// listed by node name, which the object tracker does not support.
+func newClientset(refused map[string]bool, objects ...runtime.Object) *fake.Clientset {
+	clientset := fake.NewSimpleClientset(objects...)
+	clientset.Resources = []*metav1.APIResourceList{
+		{GroupVersion: "policy/v1beta1"},
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{{Name: "pods/eviction", Kind: "Eviction"}},
+		},
+	}
+	clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj, err := clientset.Tracker().List(corev1.SchemeGroupVersion.WithResource("pods"), corev1.SchemeGroupVersion.WithKind("Pod"), action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		selector := action.(k8stesting.ListAction).GetListRestrictions().Fields
+		if selector == nil {
+			selector = fields.Everything()
+		}
+		list := obj.(*corev1.PodList)
+		pods := []corev1.Pod{}
+		for _, pod := range list.Items {
+			if selector.Matches(fields.Set{"spec.nodeName": pod.Spec.NodeName}) {
+				pods = append(pods, pod)
+			}
+		}
+		list.Items = pods
+		return true, list, nil
+	})
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(k8stesting.CreateAction).GetObject().(*policyv1beta1.Eviction)
+		if refused[eviction.Name] {
+			return true, nil, apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+		}
+		return true, nil, clientset.Tracker().Delete(corev1.SchemeGroupVersion.WithResource("pods"), eviction.Namespace, eviction.Name)
+	})
+	return clientset
+}
+
+func TestCordonUncordon(t *testing.T) {
+	assert := assert.New(t)
+	clientset := newClientset(nil, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "dummynode"}})
+	c := kubectl.NewForClientset(clientset)
+
+	assert.Nil(c.Cordon("dummynode"))
+	node, err := clientset.CoreV1().Nodes().Get("dummynode", metav1.GetOptions{})
+	assert.Nil(err)
+	assert.True(node.Spec.Unschedulable)
+	assert.Nil(c.Cordon("dummynode"))
+
+	assert.Nil(c.Uncordon("dummynode"))
+	node, err = clientset.CoreV1().Nodes().Get("dummynode", metav1.GetOptions{})
+	assert.Nil(err)
+	assert.False(node.Spec.Unschedulable)
+
+	assert.NotNil(c.Cordon("unknownnode"))
+}
+
+func TestDrain(t *testing.T) {
+	assert := assert.New(t)
+	clientset := newClientset(nil,
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "dummynode"}},
+		newPod("standalone", "dummynode", nil),
+		newPod("other", "othernode", nil),
+	)
+	c := kubectl.NewForClientset(clientset)
+
+	// unmanaged pods are deleted like kubectl drain --force
+	assert.Nil(c.Drain("dummynode", 30))
+	pods, err := clientset.CoreV1().Pods("default").List(metav1.ListOptions{})
+	assert.Nil(err)
+	assert.Len(pods.Items, 1)
+	assert.Equal("other", pods.Items[0].Name)
+}
+
+func TestDrainResult(t *testing.T) {
+	assert := assert.New(t)
+	controller := true
+	replicaSet := &metav1.OwnerReference{Kind: "ReplicaSet", Name: "web", Controller: &controller}
+	clientset := newClientset(nil,
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "dummynode"}},
+		newPod("web-1", "dummynode", replicaSet),
+		newPod("web-2", "dummynode", replicaSet),
+		newPod("web-3", "othernode", replicaSet),
+		newPod("standalone", "dummynode", nil),
+	)
+	c := kubectl.NewForClientset(clientset)
+
+	_, err := c.DrainContext(context.Background(), "dummynode", kubectl.DrainOptions{GracePeriod: 30}, nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "standalone")
+
+	result, err := c.DrainContext(context.Background(), "dummynode", kubectl.DrainOptions{GracePeriod: 30, Force: true}, nil)
+	assert.Nil(err)
+	assert.ElementsMatch([]string{"default/web-1", "default/web-2", "default/standalone"}, result.Evicted())
+	assert.Empty(result.Failed())
+	assert.Contains(result.Warnings, "standalone")
+
+	pods, err := clientset.CoreV1().Pods("default").List(metav1.ListOptions{})
+	assert.Nil(err)
+	assert.Len(pods.Items, 1)
+	assert.Equal("web-3", pods.Items[0].Name)
+}
+
+func TestDrainDisruptionBudget(t *testing.T) {
+	assert := assert.New(t)
+	controller := true
+	replicaSet := &metav1.OwnerReference{Kind: "ReplicaSet", Name: "web", Controller: &controller}
+	web2 := newPod("web-2", "dummynode", replicaSet)
+	web2.Labels = map[string]string{"app": "web"}
+	clientset := newClientset(map[string]bool{"web-2": true},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "dummynode"}},
+		newPod("web-1", "dummynode", replicaSet),
+		web2,
+		&policyv1beta1.PodDisruptionBudget{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-pdb", Namespace: "default"},
+			Spec:       policyv1beta1.PodDisruptionBudgetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+		},
+		&policyv1beta1.PodDisruptionBudget{
+			ObjectMeta: metav1.ObjectMeta{Name: "db-pdb", Namespace: "default"},
+			Spec:       policyv1beta1.PodDisruptionBudgetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}},
+		},
+	)
+	c := kubectl.NewForClientset(clientset)
+
+	result, err := c.DrainContext(context.Background(), "dummynode", kubectl.DrainOptions{GracePeriod: 30, Timeout: 100 * time.Millisecond}, nil)
+	assert.NotNil(err)
+	assert.Len(result.Failed(), 1)
+	assert.True(apierrors.IsTooManyRequests(errors.Cause(result.Failed()[0].Err)))
+	assert.Len(result.Blocked(), 1)
+	assert.Equal("web-2", result.Blocked()[0].Name)
+	assert.Equal([]string{"default/web-pdb"}, result.Blocked()[0].DisruptionBudgets)
+
+	result, err = c.DrainContext(context.Background(), "dummynode", kubectl.DrainOptions{GracePeriod: 30, ForceDelete: true}, nil)
+	assert.Nil(err)
+	assert.Equal([]string{"default/web-2"}, result.Evicted())
+	assert.Equal([]string{"default/web-pdb"}, result.Pods[0].DisruptionBudgets)
+	assert.Empty(result.Blocked())
+}
+
+func TestDrainContext(t *testing.T) {
+	assert := assert.New(t)
+	controller := true
+	replicaSet := &metav1.OwnerReference{Kind: "ReplicaSet", Name: "web", Controller: &controller}
+	clientset := newClientset(map[string]bool{"web-2": true},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "dummynode"}},
+		newPod("web-1", "dummynode", replicaSet),
+		newPod("web-2", "dummynode", replicaSet),
+	)
+	c := kubectl.NewForClientset(clientset)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	progress := []kubectl.DrainProgress{}
+	result, err := c.DrainContext(ctx, "dummynode", kubectl.DrainOptions{GracePeriod: 30}, func(p kubectl.DrainProgress) {
+		progress = append(progress, p)
+		if p.Pod.Evicted {
+			cancel()
+		}
+	})
+	assert.NotNil(err)
+	assert.Equal([]string{"default/web-1"}, result.Evicted())
+	assert.Len(progress, 2)
+	assert.Equal("web-1", progress[0].Pod.Name)
+	assert.Equal(kubectl.DrainProgress{Pod: result.Pods[1], Done: 2, Total: 2}, progress[1])
+	assert.Contains(result.Pods[1].Err.Error(), context.Canceled.Error())
+
+	assert.NotNil(c.CordonContext(ctx, "dummynode"))
+	_, err = c.DrainContext(ctx, "dummynode", kubectl.DrainOptions{}, nil)
+	assert.NotNil(err)
+}
+
+func TestDrainPodPolicies(t *testing.T) {
+	assert := assert.New(t)
+	controller := true
+	replicaSet := &metav1.OwnerReference{Kind: "ReplicaSet", Name: "web", Controller: &controller}
+	withPolicy := func(pod *corev1.Pod, policy string) *corev1.Pod {
+		pod.Annotations = map[string]string{annotations.DrainSafeDrainPolicy: policy}
+		return pod
+	}
+	db := newPod("db", "dummynode", replicaSet)
+	db.Labels = map[string]string{"app": "db"}
+	clientset := newClientset(map[string]bool{"pdb": true},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "dummynode"}},
+		withPolicy(newPod("frontend", "dummynode", replicaSet), "first"),
+		newPod("worker", "dummynode", replicaSet),
+		db,
+		withPolicy(newPod("pdb", "dummynode", replicaSet), "delete"),
+		withPolicy(newPod("critical", "dummynode", replicaSet), "never"),
+	)
+	c := kubectl.NewForClientset(clientset)
+	options := kubectl.DrainOptions{
+		GracePeriod: 30,
+		PodPolicies: []kubectl.PodPolicySelector{
+			{Selector: labels.SelectorFromSet(labels.Set{"app": "db"}), Policy: kubectl.PodDrainLast},
+		},
+	}
+
+	result, err := c.DrainContext(context.Background(), "dummynode", options, nil)
+	assert.True(kubectl.IsDrainBlocked(err))
+	assert.Contains(err.Error(), "default/critical")
+	assert.Empty(result.Evicted())
+	pods, err := clientset.CoreV1().Pods("default").List(metav1.ListOptions{})
+	assert.Nil(err)
+	assert.Len(pods.Items, 5)
+
+	err = clientset.CoreV1().Pods("default").Delete("critical", &metav1.DeleteOptions{})
+	assert.Nil(err)
+	evicted := []string{}
+	result, err = c.DrainContext(context.Background(), "dummynode", options, func(p kubectl.DrainProgress) {
+		evicted = append(evicted, p.Pod.Name)
+	})
+	assert.Nil(err)
+	assert.Len(evicted, 4)
+	assert.Equal("frontend", evicted[0])
+	assert.ElementsMatch([]string{"worker", "pdb"}, evicted[1:3])
+	assert.Equal("db", evicted[3])
+	for _, pod := range result.Pods {
+		if pod.Name == "db" {
+			assert.Equal(kubectl.PodDrainLast, pod.Policy)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package kubectl
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+var _ ReadinessProber = &client{}
+
+// ReadinessProber checks whether probe pods are ready on a node, implemented by clients of New
+type ReadinessProber interface {
+	ProbeReady(ctx context.Context, vmName, namespace string, selector labels.Selector) (bool, error)
+}
+
+// ProbeReady returns whether a pod in namespace matching selector, e.g. of a probe daemonset,
+// is running and ready on node vmName, all namespaces if namespace is empty
+func (c *client) ProbeReady(ctx context.Context, vmName, namespace string, selector labels.Selector) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	pods, err := c.clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{
+		LabelSelector: selector.String(),
+		FieldSelector: fields.SelectorFromSet(fields.Set{"spec.nodeName": vmName}).String(),
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "error listing probe pods")
+	}
+	for i := range pods.Items {
+		if pods.Items[i].Spec.NodeName == vmName && podReady(&pods.Items[i]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// podReady returns whether pod is running and its Ready condition is True
+func podReady(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package kubectl_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/awesomenix/drainsafe/kubectl"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestProbeReady(t *testing.T) {
+	assert := assert.New(t)
+	newProbe := func(name, nodeName string, ready corev1.ConditionStatus) *corev1.Pod {
+		pod := newPod(name, nodeName, nil)
+		pod.Namespace = "kube-system"
+		pod.Labels = map[string]string{"app": "node-probe"}
+		pod.Status.Phase = corev1.PodRunning
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: ready}}
+		return pod
+	}
+	clientset := newClientset(nil,
+		newProbe("probe-1", "dummynode", corev1.ConditionFalse),
+		newProbe("probe-2", "othernode", corev1.ConditionTrue),
+	)
+	c := kubectl.NewForClientset(clientset).(kubectl.ReadinessProber)
+	selector := labels.SelectorFromSet(labels.Set{"app": "node-probe"})
+
+	ready, err := c.ProbeReady(context.TODO(), "dummynode", "kube-system", selector)
+	assert.Nil(err)
+	assert.False(ready)
+
+	probe := newProbe("probe-1", "dummynode", corev1.ConditionTrue)
+	_, err = clientset.CoreV1().Pods("kube-system").UpdateStatus(probe)
+	assert.Nil(err)
+	ready, err = c.ProbeReady(context.TODO(), "dummynode", "", selector)
+	assert.Nil(err)
+	assert.True(ready)
+
+	ready, err = c.ProbeReady(context.TODO(), "dummynode", "default", selector)
+	assert.Nil(err)
+	assert.False(ready)
+
+	ready, err = c.ProbeReady(context.TODO(), "dummynode", "kube-system", labels.SelectorFromSet(labels.Set{"app": "other"}))
+	assert.Nil(err)
+	assert.False(ready)
+}
@@ -0,0 +1,72 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package kubectl
+
+import (
+	"strings"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// PodDrainPolicy how a pod is drained, set with drainsafe.azure.com/drain-policy pod annotation
+// or PodPolicySelector
+type PodDrainPolicy string
+
+const (
+	// PodDrainDefault pod is evicted after PodDrainFirst and before PodDrainLast pods
+	PodDrainDefault PodDrainPolicy = ""
+	// PodDrainFirst pod is evicted before all other pods
+	PodDrainFirst PodDrainPolicy = "first"
+	// PodDrainLast pod is evicted once all other pods are gone
+	PodDrainLast PodDrainPolicy = "last"
+	// PodDrainNever pod is never evicted, drain is blocked while such a pod runs on the node
+	PodDrainNever PodDrainPolicy = "never"
+	// PodDrainDelete pod is deleted without eviction, disruption budgets are not honored
+	PodDrainDelete PodDrainPolicy = "delete"
+)
+
+// ErrDrainBlocked drain is blocked by pods which are never evicted
+var ErrDrainBlocked = errors.New("drain blocked by pods which are never evicted")
+
+// IsDrainBlocked checks if err is caused by pods which are never evicted
+func IsDrainBlocked(err error) bool {
+	return errors.Cause(err) == ErrDrainBlocked
+}
+
+// ParsePodDrainPolicy parses policy, case insensitive
+func ParsePodDrainPolicy(value string) (PodDrainPolicy, error) {
+	for _, policy := range []PodDrainPolicy{PodDrainFirst, PodDrainLast, PodDrainNever, PodDrainDelete} {
+		if strings.EqualFold(string(policy), value) {
+			return policy, nil
+		}
+	}
+	return PodDrainDefault, errors.Errorf("unknown pod drain policy %s, expected one of first, last, never or delete", value)
+}
+
+// PodPolicySelector applies Policy to pods matching Selector
+type PodPolicySelector struct {
+	Selector labels.Selector
+	Policy   PodDrainPolicy
+}
+
+// GetPodDrainPolicy returns drain policy of pod, drainsafe.azure.com/drain-policy annotation takes
+// precedence over the first selector matching pod labels
+func GetPodDrainPolicy(pod *corev1.Pod, selectors []PodPolicySelector) PodDrainPolicy {
+	if value, ok := pod.Annotations[annotations.DrainSafeDrainPolicy]; ok {
+		policy, err := ParsePodDrainPolicy(value)
+		if err == nil {
+			return policy
+		}
+		log.Info("Ignoring invalid drain policy", "Namespace", pod.Namespace, "Name", pod.Name, "Policy", value)
+	}
+	for _, selector := range selectors {
+		if selector.Selector != nil && selector.Selector.Matches(labels.Set(pod.Labels)) {
+			return selector.Policy
+		}
+	}
+	return PodDrainDefault
+}
@@ -0,0 +1,37 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package kubectl_test
+
+import (
+	"testing"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	"github.com/awesomenix/drainsafe/kubectl"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestGetPodDrainPolicy(t *testing.T) {
+	assert := assert.New(t)
+	selectors := []kubectl.PodPolicySelector{
+		{Selector: labels.SelectorFromSet(labels.Set{"tier": "frontend"}), Policy: kubectl.PodDrainFirst},
+		{Selector: labels.SelectorFromSet(labels.Set{"app": "db"}), Policy: kubectl.PodDrainLast},
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web", Labels: map[string]string{"tier": "frontend"}}}
+	assert.Equal(kubectl.PodDrainFirst, kubectl.GetPodDrainPolicy(pod, selectors))
+	assert.Equal(kubectl.PodDrainDefault, kubectl.GetPodDrainPolicy(pod, nil))
+
+	pod.Annotations = map[string]string{annotations.DrainSafeDrainPolicy: "Never"}
+	assert.Equal(kubectl.PodDrainNever, kubectl.GetPodDrainPolicy(pod, selectors))
+
+	pod.Annotations[annotations.DrainSafeDrainPolicy] = "sometimes"
+	assert.Equal(kubectl.PodDrainFirst, kubectl.GetPodDrainPolicy(pod, selectors))
+
+	_, err := kubectl.ParsePodDrainPolicy("sometimes")
+	assert.NotNil(err)
+	assert.True(kubectl.IsDrainBlocked(errors.Wrapf(kubectl.ErrDrainBlocked, "default/db")))
+	assert.False(kubectl.IsDrainBlocked(errors.New("error")))
+}
@@ -0,0 +1,290 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package kubectl
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// WaveOrder how pods are split into eviction waves within each PodDrainPolicy
+type WaveOrder string
+
+const (
+	// WaveOrderNone pods of the same PodDrainPolicy are evicted in a single wave
+	WaveOrderNone WaveOrder = ""
+	// WaveOrderPriorityClass pods are evicted in waves of ascending pod priority, lowest priority first
+	WaveOrderPriorityClass WaveOrder = "PriorityClass"
+	// WaveOrderAnnotation pods are evicted in waves of ascending drainsafe.azure.com/drain-wave
+	// annotation, pods without the annotation are in wave 0
+	WaveOrderAnnotation WaveOrder = "Annotation"
+)
+
+// reschedulePollInterval wait between checks whether pods of a wave are running elsewhere
+const reschedulePollInterval = 1 * time.Second
+
+// ParseWaveOrder parses order, case insensitive, empty disables waves
+func ParseWaveOrder(value string) (WaveOrder, error) {
+	for _, order := range []WaveOrder{WaveOrderNone, WaveOrderPriorityClass, WaveOrderAnnotation} {
+		if strings.EqualFold(string(order), value) {
+			return order, nil
+		}
+	}
+	return WaveOrderNone, errors.Errorf("unknown wave order %s, expected one of PriorityClass or Annotation", value)
+}
+
+// GetPodWave returns the eviction wave of pod, lower waves are evicted first
+func GetPodWave(pod *corev1.Pod, order WaveOrder) int32 {
+	switch order {
+	case WaveOrderPriorityClass:
+		if pod.Spec.Priority != nil {
+			return *pod.Spec.Priority
+		}
+	case WaveOrderAnnotation:
+		value, ok := pod.Annotations[annotations.DrainSafeDrainWave]
+		if !ok {
+			return 0
+		}
+		wave, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			log.Info("Ignoring invalid drain wave", "Namespace", pod.Namespace, "Name", pod.Name, "Wave", value)
+			return 0
+		}
+		return int32(wave)
+	}
+	return 0
+}
+
+// policyRank orders pods by PodDrainPolicy, first pods before others and last pods after them
+func policyRank(policy PodDrainPolicy) int {
+	switch policy {
+	case PodDrainFirst:
+		return 0
+	case PodDrainLast:
+		return 2
+	}
+	return 1
+}
+
+// drainWaves splits pods into ordered waves by PodDrainPolicy and then by wave of order
+func drainWaves(pods []corev1.Pod, policies map[types.UID]PodDrainPolicy, order WaveOrder) [][]corev1.Pod {
+	type key struct {
+		rank int
+		wave int32
+	}
+	keys := map[types.UID]key{}
+	for i := range pods {
+		keys[pods[i].UID] = key{rank: policyRank(policies[pods[i].UID]), wave: GetPodWave(&pods[i], order)}
+	}
+	sorted := append([]corev1.Pod{}, pods...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ki, kj := keys[sorted[i].UID], keys[sorted[j].UID]
+		if ki.rank != kj.rank {
+			return ki.rank < kj.rank
+		}
+		return ki.wave < kj.wave
+	})
+
+	waves := [][]corev1.Pod{}
+	for i, pod := range sorted {
+		if i == 0 || keys[pod.UID] != keys[sorted[i-1].UID] {
+			waves = append(waves, []corev1.Pod{})
+		}
+		waves[len(waves)-1] = append(waves[len(waves)-1], pod)
+	}
+	return waves
+}
+
+// PodOwner controller of a pod which reschedules it once evicted
+type PodOwner struct {
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+}
+
+func (o PodOwner) String() string {
+	return o.Kind + " " + o.Namespace + "/" + o.Name
+}
+
+// GetPodOwner returns the controller of pod, nil if pod is not managed by a controller
+func GetPodOwner(pod *corev1.Pod) *PodOwner {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return nil
+	}
+	return &PodOwner{Namespace: pod.Namespace, Kind: ref.Kind, Name: ref.Name}
+}
+
+var _ RescheduleChecker = &client{}
+
+// RescheduleChecker checks whether controllers of pods evicted from a node have all their
+// replicas ready again elsewhere, implemented by clients of New
+type RescheduleChecker interface {
+	Rescheduled(ctx context.Context, vmName string, owners []PodOwner) ([]PodOwner, error)
+}
+
+// Rescheduled returns owners which do not have all their replicas ready on other nodes than
+// vmName yet, i.e. pods evicted from vmName are not running elsewhere yet
+func (c *client) Rescheduled(ctx context.Context, vmName string, owners []PodOwner) ([]PodOwner, error) {
+	pending := []PodOwner{}
+	for _, owner := range owners {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ready, err := c.ownerReady(vmName, owner)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error checking %s", owner)
+		}
+		if !ready {
+			pending = append(pending, owner)
+		}
+	}
+	return pending, nil
+}
+
+// waitRescheduled waits until controllers of pods have all their replicas ready again, i.e.
+// evicted pods are running elsewhere. Gives up once ctx is done, once timeout elapses waiting
+// stops without error so the next wave is not held back forever, zero waits until ctx is done.
+func (c *client) waitRescheduled(ctx context.Context, vmName string, pods []corev1.Pod, timeout time.Duration) error {
+	owners := []PodOwner{}
+	seen := map[PodOwner]bool{}
+	for i := range pods {
+		owner := GetPodOwner(&pods[i])
+		if owner != nil && !seen[*owner] {
+			seen[*owner] = true
+			owners = append(owners, *owner)
+		}
+	}
+	if len(owners) == 0 {
+		return nil
+	}
+
+	waitCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	for {
+		pending, err := c.Rescheduled(ctx, vmName, owners)
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		names := []string{}
+		for _, owner := range pending {
+			names = append(names, owner.String())
+		}
+		if err := wait(waitCtx, reschedulePollInterval); err != nil {
+			if ctx.Err() != nil {
+				return errors.Wrapf(err, "gave up waiting for %s to be rescheduled", strings.Join(names, ", "))
+			}
+			log.Info("Starting next wave before pods were rescheduled", "VMName", vmName, "Pending", strings.Join(names, ", "))
+			return nil
+		}
+	}
+}
+
+// ownerReady checks if owner observed its latest spec, all its replicas are ready and as many
+// of its pods are ready on other nodes than vmName, owners which are gone or do not reschedule
+// pods are ready. Ready replicas alone may still count pods evicted from vmName before the
+// controller saw them go.
+func (c *client) ownerReady(vmName string, owner PodOwner) (bool, error) {
+	var (
+		replicas *int32
+		selector *metav1.LabelSelector
+		current  bool
+	)
+	switch owner.Kind {
+	case "Deployment":
+		d, err := c.clientset.AppsV1().Deployments(owner.Namespace).Get(owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return apierrors.IsNotFound(err), ignoreNotFound(err)
+		}
+		replicas, selector = d.Spec.Replicas, d.Spec.Selector
+		current = d.Status.ObservedGeneration >= d.Generation && replicasReady(replicas, d.Status.ReadyReplicas)
+	case "ReplicaSet":
+		rs, err := c.clientset.AppsV1().ReplicaSets(owner.Namespace).Get(owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return apierrors.IsNotFound(err), ignoreNotFound(err)
+		}
+		// replica sets of a deployment may be scaled down by a rollout, check the deployment
+		if ref := metav1.GetControllerOf(rs); ref != nil && ref.Kind == "Deployment" {
+			return c.ownerReady(vmName, PodOwner{Namespace: owner.Namespace, Kind: ref.Kind, Name: ref.Name})
+		}
+		replicas, selector = rs.Spec.Replicas, rs.Spec.Selector
+		current = rs.Status.ObservedGeneration >= rs.Generation && replicasReady(replicas, rs.Status.ReadyReplicas)
+	case "StatefulSet":
+		ss, err := c.clientset.AppsV1().StatefulSets(owner.Namespace).Get(owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return apierrors.IsNotFound(err), ignoreNotFound(err)
+		}
+		replicas, selector = ss.Spec.Replicas, ss.Spec.Selector
+		current = ss.Status.ObservedGeneration >= ss.Generation && replicasReady(replicas, ss.Status.ReadyReplicas)
+	case "ReplicationController":
+		rc, err := c.clientset.CoreV1().ReplicationControllers(owner.Namespace).Get(owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return apierrors.IsNotFound(err), ignoreNotFound(err)
+		}
+		replicas = rc.Spec.Replicas
+		if rc.Spec.Selector != nil {
+			selector = &metav1.LabelSelector{MatchLabels: rc.Spec.Selector}
+		}
+		current = rc.Status.ObservedGeneration >= rc.Generation && replicasReady(replicas, rc.Status.ReadyReplicas)
+	default:
+		return true, nil
+	}
+	if !current || selector == nil {
+		return current, nil
+	}
+	return c.replacementsReady(owner.Namespace, vmName, selector, replicas)
+}
+
+// replacementsReady checks if desired pods matching selector, which default to 1, are ready on
+// other nodes than vmName
+func (c *client) replacementsReady(namespace, vmName string, selector *metav1.LabelSelector, desired *int32) (bool, error) {
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return false, err
+	}
+	pods, err := c.clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: s.String()})
+	if err != nil {
+		return false, err
+	}
+	ready := int32(0)
+	for i := range pods.Items {
+		if pods.Items[i].Spec.NodeName != vmName && podReady(&pods.Items[i]) {
+			ready++
+		}
+	}
+	return replicasReady(desired, ready), nil
+}
+
+// replicasReady checks if ready replicas reached desired replicas, which default to 1
+func replicasReady(desired *int32, ready int32) bool {
+	replicas := int32(1)
+	if desired != nil {
+		replicas = *desired
+	}
+	return ready >= replicas
+}
+
+func ignoreNotFound(err error) error {
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
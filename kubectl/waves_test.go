@@ -0,0 +1,215 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package kubectl_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	"github.com/awesomenix/drainsafe/kubectl"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newReplicaSet(name string, replicas, ready int32) *appsv1.ReplicaSet {
+	return &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: appsv1.ReplicaSetSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+		},
+		Status: appsv1.ReplicaSetStatus{ReadyReplicas: ready},
+	}
+}
+
+func newOwnedPod(name, owner string, priority int32) *corev1.Pod {
+	controller := true
+	pod := newPod(name, "dummynode", &metav1.OwnerReference{Kind: "ReplicaSet", Name: owner, Controller: &controller})
+	pod.Labels = map[string]string{"app": owner}
+	pod.Spec.Priority = &priority
+	return pod
+}
+
+// newReadyPod returns a ready pod of owner running on nodeName, e.g. replacing an evicted one
+func newReadyPod(name, owner, nodeName string) *corev1.Pod {
+	pod := newOwnedPod(name, owner, 0)
+	pod.Spec.NodeName = nodeName
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	return pod
+}
+
+func TestGetPodWave(t *testing.T) {
+	assert := assert.New(t)
+	pod := newOwnedPod("web", "web", 100)
+	assert.Equal(int32(100), kubectl.GetPodWave(pod, kubectl.WaveOrderPriorityClass))
+	assert.Equal(int32(0), kubectl.GetPodWave(pod, kubectl.WaveOrderAnnotation))
+	assert.Equal(int32(0), kubectl.GetPodWave(pod, kubectl.WaveOrderNone))
+
+	pod.Annotations = map[string]string{annotations.DrainSafeDrainWave: "-2"}
+	assert.Equal(int32(-2), kubectl.GetPodWave(pod, kubectl.WaveOrderAnnotation))
+	pod.Annotations[annotations.DrainSafeDrainWave] = "later"
+	assert.Equal(int32(0), kubectl.GetPodWave(pod, kubectl.WaveOrderAnnotation))
+
+	order, err := kubectl.ParseWaveOrder("priorityclass")
+	assert.Nil(err)
+	assert.Equal(kubectl.WaveOrderPriorityClass, order)
+	_, err = kubectl.ParseWaveOrder("Random")
+	assert.NotNil(err)
+}
+
+func TestDrainWaves(t *testing.T) {
+	assert := assert.New(t)
+	clientset := newClientset(nil,
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "dummynode"}},
+		newReplicaSet("frontend", 2, 2),
+		newReplicaSet("worker", 1, 1),
+		newReplicaSet("db", 1, 1),
+		newOwnedPod("db-0", "db", 1000),
+		newOwnedPod("worker-0", "worker", 100),
+		newOwnedPod("frontend-0", "frontend", 0),
+		newOwnedPod("frontend-1", "frontend", 0),
+		newReadyPod("frontend-2", "frontend", "othernode"),
+		newReadyPod("frontend-3", "frontend", "othernode"),
+		newReadyPod("worker-1", "worker", "othernode"),
+	)
+	c := kubectl.NewForClientset(clientset)
+
+	evicted := []string{}
+	result, err := c.DrainContext(context.Background(), "dummynode", kubectl.DrainOptions{GracePeriod: 30, WaveOrder: kubectl.WaveOrderPriorityClass}, func(p kubectl.DrainProgress) {
+		evicted = append(evicted, p.Pod.Name)
+	})
+	assert.Nil(err)
+	assert.Len(evicted, 4)
+	assert.ElementsMatch([]string{"frontend-0", "frontend-1"}, evicted[:2])
+	assert.Equal([]string{"worker-0", "db-0"}, evicted[2:])
+	for _, pod := range result.Pods {
+		switch pod.Name {
+		case "worker-0":
+			assert.Equal(1, pod.Wave)
+		case "db-0":
+			assert.Equal(2, pod.Wave)
+		}
+	}
+}
+
+func TestDrainWavesNotRescheduled(t *testing.T) {
+	assert := assert.New(t)
+	newClient := func() kubectl.ContextClient {
+		return kubectl.NewForClientset(newClientset(nil,
+			&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "dummynode"}},
+			newReplicaSet("frontend", 1, 0),
+			newOwnedPod("frontend-0", "frontend", 0),
+			newOwnedPod("db-0", "db", 1000),
+		))
+	}
+
+	// next wave starts once wave timeout elapses
+	result, err := newClient().DrainContext(context.Background(), "dummynode", kubectl.DrainOptions{
+		GracePeriod: 30,
+		WaveOrder:   kubectl.WaveOrderPriorityClass,
+		WaveTimeout: 100 * time.Millisecond,
+	}, nil)
+	assert.Nil(err)
+	assert.ElementsMatch([]string{"default/frontend-0", "default/db-0"}, result.Evicted())
+
+	// drain fails if pods are not rescheduled before the drain times out
+	result, err = newClient().DrainContext(context.Background(), "dummynode", kubectl.DrainOptions{
+		GracePeriod: 30,
+		Timeout:     100 * time.Millisecond,
+		WaveOrder:   kubectl.WaveOrderPriorityClass,
+	}, nil)
+	assert.NotNil(err)
+	assert.Equal([]string{"default/frontend-0"}, result.Evicted())
+	assert.Len(result.Failed(), 1)
+	assert.Contains(result.Failed()[0].Err.Error(), "ReplicaSet default/frontend")
+}
+
+func TestRescheduled(t *testing.T) {
+	assert := assert.New(t)
+	controller := true
+	replicas := int32(2)
+	rs := newReplicaSet("web-5d8f", 2, 0)
+	rs.OwnerReferences = []metav1.OwnerReference{{Kind: "Deployment", Name: "web", Controller: &controller}}
+	clientset := newClientset(nil,
+		rs,
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			},
+			Status: appsv1.DeploymentStatus{ReadyReplicas: 2},
+		},
+		newReadyPod("web-5d8f-1", "web", "othernode"),
+		newReadyPod("web-5d8f-2", "web", "othernode"),
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+			Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+			Status:     appsv1.StatefulSetStatus{ReadyReplicas: 1},
+		},
+	)
+	c := kubectl.NewForClientset(clientset).(kubectl.RescheduleChecker)
+
+	owners := []kubectl.PodOwner{
+		{Namespace: "default", Kind: "ReplicaSet", Name: "web-5d8f"},
+		{Namespace: "default", Kind: "StatefulSet", Name: "db"},
+		{Namespace: "default", Kind: "ReplicaSet", Name: "gone"},
+		{Namespace: "default", Kind: "Job", Name: "batch"},
+	}
+	pending, err := c.Rescheduled(context.Background(), "dummynode", owners)
+	assert.Nil(err)
+	assert.Equal([]kubectl.PodOwner{{Namespace: "default", Kind: "StatefulSet", Name: "db"}}, pending)
+
+	pod := newOwnedPod("db-0", "db", 0)
+	pod.OwnerReferences[0].Kind = "StatefulSet"
+	assert.Equal(&kubectl.PodOwner{Namespace: "default", Kind: "StatefulSet", Name: "db"}, kubectl.GetPodOwner(pod))
+	assert.Nil(kubectl.GetPodOwner(newPod("standalone", "dummynode", nil)))
+}
+
+func TestRescheduledStaleStatus(t *testing.T) {
+	assert := assert.New(t)
+	owners := []kubectl.PodOwner{{Namespace: "default", Kind: "ReplicaSet", Name: "web"}}
+
+	// ready replicas still count the pod evicted from the node, its replacement is not ready yet
+	clientset := newClientset(nil,
+		newReplicaSet("web", 2, 2),
+		newReadyPod("web-1", "web", "othernode"),
+		newOwnedPod("web-2", "web", 0),
+	)
+	replacement := newOwnedPod("web-3", "web", 0)
+	replacement.Spec.NodeName = "othernode"
+	_, err := clientset.CoreV1().Pods("default").Create(replacement)
+	assert.Nil(err)
+	c := kubectl.NewForClientset(clientset).(kubectl.RescheduleChecker)
+	pending, err := c.Rescheduled(context.Background(), "dummynode", owners)
+	assert.Nil(err)
+	assert.Equal(owners, pending)
+
+	// ready pods left on the draining node do not count
+	_, err = clientset.CoreV1().Pods("default").UpdateStatus(newReadyPod("web-2", "web", "dummynode"))
+	assert.Nil(err)
+	pending, err = c.Rescheduled(context.Background(), "dummynode", owners)
+	assert.Nil(err)
+	assert.Equal(owners, pending)
+
+	_, err = clientset.CoreV1().Pods("default").UpdateStatus(newReadyPod("web-3", "web", "othernode"))
+	assert.Nil(err)
+	pending, err = c.Rescheduled(context.Background(), "dummynode", owners)
+	assert.Nil(err)
+	assert.Empty(pending)
+
+	// status of a spec the controller did not observe yet is stale
+	rs := newReplicaSet("web", 2, 2)
+	rs.Generation = 2
+	rs.Status.ObservedGeneration = 1
+	_, err = clientset.AppsV1().ReplicaSets("default").Update(rs)
+	assert.Nil(err)
+	pending, err = c.Rescheduled(context.Background(), "dummynode", owners)
+	assert.Nil(err)
+	assert.Equal(owners, pending)
+}
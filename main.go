@@ -5,12 +5,19 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
 
+	drainsafev1 "github.com/awesomenix/drainsafe/api/v1"
 	"github.com/awesomenix/drainsafe/controllers"
+	"github.com/awesomenix/drainsafe/coordinator"
+	"github.com/awesomenix/drainsafe/metrics"
+	"github.com/awesomenix/drainsafe/policy"
+	"github.com/awesomenix/drainsafe/webhook"
 	repairmanv1 "github.com/awesomenix/repairman/pkg/api/v1"
 	corev1 "k8s.io/api/core/v1"
 	apiextensions "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	// +kubebuilder:scaffold:imports
@@ -23,6 +30,7 @@ var (
 
 func init() {
 	corev1.AddToScheme(scheme)
+	drainsafev1.AddToScheme(scheme)
 	repairmanv1.AddToScheme(scheme)
 	apiextensions.AddToScheme(scheme)
 	// +kubebuilder:scaffold:scheme
@@ -34,6 +42,19 @@ func main() {
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
+	eventPolicy := policy.DefaultEventPolicy()
+	flag.Var(eventPolicy, "event-policy", "Comma separated EventType=Action pairs, actions are Ignore, AnnotateOnly, CordonOnly, Drain or ExpressDrain, overridden per node by DrainSafePolicy.")
+	var maxConcurrent, groupLabel string
+	flag.StringVar(&maxConcurrent, "max-concurrent-maintenance", "1", "Nodes in maintenance at the same time when repairman is not installed, a count or a percentage of nodes, e.g. 10%.")
+	flag.StringVar(&groupLabel, "maintenance-group-label", "", "Node label, e.g. topology.kubernetes.io/zone or agentpool, --max-concurrent-maintenance applies per label value, all nodes if empty.")
+	var maxZones, maxFaultDomains, maxUpdateDomains int
+	flag.IntVar(&maxZones, "max-maintenance-zones", 0, "Zones which may have nodes in maintenance at the same time when repairman is not installed, unlimited if 0.")
+	flag.IntVar(&maxFaultDomains, "max-maintenance-fault-domains", 0, "Azure fault domains which may have nodes in maintenance at the same time when repairman is not installed, unlimited if 0.")
+	flag.IntVar(&maxUpdateDomains, "max-maintenance-update-domains", 0, "Azure update domains which may have nodes in maintenance at the same time when repairman is not installed, unlimited if 0.")
+	var enableNodeWebhook bool
+	var webhookServiceAccounts string
+	flag.BoolVar(&enableNodeWebhook, "enable-node-webhook", false, "Serve the validating webhook for node maintenance annotations, requires the webhook serving certificate.")
+	flag.StringVar(&webhookServiceAccounts, "webhook-service-accounts", "", "Comma separated namespace:name of service accounts which may change the maintenance owner and reset maintenance states, all service accounts of the drainsafe namespace if empty.")
 	flag.BoolVar(&verbose, "verbose", false, "verbose logging")
 	flag.Parse()
 
@@ -49,17 +70,45 @@ func main() {
 		os.Exit(1)
 	}
 
+	c := coordinator.New(mgr.GetClient(), mgr.GetAPIReader(), os.Getenv("POD_NAMESPACE"), intstr.Parse(maxConcurrent), groupLabel)
+	c.MaxDomains = map[coordinator.Domain]int{
+		coordinator.Zone:         maxZones,
+		coordinator.FaultDomain:  maxFaultDomains,
+		coordinator.UpdateDomain: maxUpdateDomains,
+	}
+	if err := c.Validate(); err != nil {
+		setupLog.Error(err, "invalid --max-concurrent-maintenance")
+		os.Exit(1)
+	}
+
 	err = (&controllers.DrainSafeReconciler{
-		Client:   mgr.GetClient(),
-		Log:      ctrl.Log.WithName("controllers").WithName("DrainSafe"),
-		Recorder: mgr.GetEventRecorderFor("drainsafe"),
+		Client:      mgr.GetClient(),
+		Log:         ctrl.Log.WithName("controllers").WithName("DrainSafe"),
+		Recorder:    mgr.GetEventRecorderFor("drainsafe"),
+		EventPolicy: eventPolicy,
+		Coordinator: c,
 	}).SetupWithManager(mgr)
 	if err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "DrainSafe")
 		os.Exit(1)
 	}
+	if enableNodeWebhook {
+		v := &webhook.NodeValidator{Namespace: os.Getenv("POD_NAMESPACE")}
+		if webhookServiceAccounts != "" {
+			v.ServiceAccounts = strings.Split(webhookServiceAccounts, ",")
+		}
+		if err := v.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Node")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
+	if err := metrics.RegisterNodeCollector(mgr.GetClient()); err != nil {
+		setupLog.Error(err, "unable to register node metrics")
+		os.Exit(1)
+	}
+
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "problem running manager")
@@ -0,0 +1,203 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const namespace = "drainsafe"
+
+// Operations whose failures are counted
+const (
+	Cordon   = "cordon"
+	Drain    = "drain"
+	Uncordon = "uncordon"
+)
+
+// Failure reasons
+const (
+	// ReasonError operation failed with an error
+	ReasonError = "Error"
+	// ReasonTimeout operation was aborted once its timeout elapsed
+	ReasonTimeout = "Timeout"
+	// ReasonBlocked drain is blocked by pods which are never evicted
+	ReasonBlocked = "Blocked"
+	// ReasonDisruptionBudget evictions are refused by pod disruption budgets
+	ReasonDisruptionBudget = "DisruptionBudget"
+	// ReasonHealthGate node failed health checks before uncordon
+	ReasonHealthGate = "HealthGate"
+)
+
+// states maintenance states reported even if no node is in them
+var states = []string{
+	annotations.Scheduled,
+	annotations.MaintenancePending,
+	annotations.MaintenanceApproved,
+	annotations.Cordoning,
+	annotations.Cordoned,
+	annotations.PreDrain,
+	annotations.Draining,
+	annotations.ExpressDraining,
+	annotations.Verifying,
+	annotations.Drained,
+	annotations.Started,
+	annotations.Running,
+	annotations.PostMaintenance,
+}
+
+// durationBuckets one second to about nine hours
+var durationBuckets = prometheus.ExponentialBuckets(1, 2, 16)
+
+// approvalBuckets late approvals up to the fifteen minutes notice of redeploy events
+var approvalBuckets = []float64{0, 30, 60, 120, 300, 600, 900}
+
+var (
+	// StateDuration seconds nodes spent in a maintenance state before moving to the next one
+	StateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "state_duration_seconds",
+		Help:      "Seconds nodes spent in a maintenance state before moving to the next one.",
+		Buckets:   durationBuckets,
+	}, []string{"state"})
+
+	// ScheduledToDrained seconds from a maintenance being scheduled to the node being drained
+	ScheduledToDrained = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scheduled_to_drained_seconds",
+		Help:      "Seconds from a maintenance being scheduled to the node being drained.",
+		Buckets:   durationBuckets,
+	})
+
+	// DrainDuration seconds from the start of a drain to the node being drained, by whether all pods were evicted
+	DrainDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "drain_duration_seconds",
+		Help:      "Seconds from the start of a drain to the node being drained.",
+		Buckets:   durationBuckets,
+	}, []string{"succeeded"})
+
+	// Failures of cordon, drain and uncordon by reason
+	Failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "operation_failures_total",
+		Help:      "Failed cordon, drain and uncordon attempts by reason.",
+	}, []string{"operation", "reason"})
+
+	// IMDSRequestDuration latency of azure instance metadata service requests
+	IMDSRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "imds_request_duration_seconds",
+		Help:      "Latency of azure instance metadata service requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "path"})
+
+	// IMDSRequestErrors failed azure instance metadata service requests
+	IMDSRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "imds_request_errors_total",
+		Help:      "Failed azure instance metadata service requests.",
+	}, []string{"method", "path"})
+
+	// ApprovalRemaining seconds left before NotBefore when scheduled events were approved, by event type
+	ApprovalRemaining = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "approval_notbefore_remaining_seconds",
+		Help:      "Seconds left before NotBefore when scheduled events were approved, events approved late fall in the 0 bucket.",
+		Buckets:   approvalBuckets,
+	}, []string{"type"})
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(
+		StateDuration,
+		ScheduledToDrained,
+		DrainDuration,
+		Failures,
+		IMDSRequestDuration,
+		IMDSRequestErrors,
+		ApprovalRemaining,
+	)
+}
+
+// RegisterNodeCollector registers reporting of nodes per maintenance state and time left before
+// NotBefore of nodes in maintenance, read from reader on every scrape. Only one binary of a
+// cluster should register it, as it reports all nodes.
+func RegisterNodeCollector(reader client.Reader) error {
+	return ctrlmetrics.Registry.Register(NewNodeCollector(reader))
+}
+
+// NewNodeCollector creates a collector of maintenance states of nodes listed from reader
+func NewNodeCollector(reader client.Reader) prometheus.Collector {
+	return &nodeCollector{
+		reader: reader,
+		nodes: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "nodes"),
+			"Nodes per maintenance state.", []string{"state"}, nil),
+		remaining: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "notbefore_remaining_seconds"),
+			"Seconds left before NotBefore of nodes which are not yet drained, negative once NotBefore passed.", []string{"node", "state"}, nil),
+		now: time.Now,
+	}
+}
+
+type nodeCollector struct {
+	reader    client.Reader
+	nodes     *prometheus.Desc
+	remaining *prometheus.Desc
+	now       func() time.Time
+}
+
+// Describe implements prometheus.Collector
+func (c *nodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.nodes
+	ch <- c.remaining
+}
+
+// Collect implements prometheus.Collector
+func (c *nodeCollector) Collect(ch chan<- prometheus.Metric) {
+	nodes := &corev1.NodeList{}
+	if err := c.reader.List(context.Background(), nodes); err != nil {
+		ch <- prometheus.NewInvalidMetric(c.nodes, err)
+		return
+	}
+	counts := map[string]int{}
+	for _, state := range states {
+		counts[state] = 0
+	}
+	for _, node := range nodes.Items {
+		state := node.Annotations[annotations.DrainSafeMaintenance]
+		if state == "" {
+			continue
+		}
+		counts[state]++
+		if !awaitingDrain(state) {
+			continue
+		}
+		notBefore, err := time.Parse(time.RFC1123, node.Annotations[annotations.DrainSafeNotBefore])
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.remaining, prometheus.GaugeValue, notBefore.Sub(c.now()).Seconds(), node.Name, state)
+	}
+	for state, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.nodes, prometheus.GaugeValue, float64(count), state)
+	}
+}
+
+// awaitingDrain returns whether a node in state is scheduled for maintenance but not yet drained
+func awaitingDrain(state string) bool {
+	switch state {
+	case annotations.Scheduled, annotations.MaintenancePending, annotations.MaintenanceApproved,
+		annotations.Cordoning, annotations.Cordoned, annotations.PreDrain, annotations.Draining,
+		annotations.ExpressDraining, annotations.Verifying:
+		return true
+	}
+	return false
+}
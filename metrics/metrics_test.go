@@ -0,0 +1,88 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	"github.com/awesomenix/drainsafe/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newNode(name, state, notBefore string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				annotations.DrainSafeMaintenance: state,
+				annotations.DrainSafeNotBefore:   notBefore,
+			},
+		},
+	}
+}
+
+func TestNodeCollector(t *testing.T) {
+	assert := assert.New(t)
+	notBefore := time.Now().Add(10 * time.Minute).UTC().Format(time.RFC1123)
+	f := fake.NewFakeClient(
+		newNode("drainingnode", annotations.Draining, notBefore),
+		newNode("drainednode", annotations.Drained, notBefore),
+		newNode("runningnode1", annotations.Running, ""),
+		newNode("runningnode2", annotations.Running, ""),
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "newnode"}},
+	)
+	registry := prometheus.NewPedanticRegistry()
+	assert.Nil(registry.Register(metrics.NewNodeCollector(f)))
+
+	err := testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP drainsafe_nodes Nodes per maintenance state.
+# TYPE drainsafe_nodes gauge
+drainsafe_nodes{state="MaintenanceApproved"} 0
+drainsafe_nodes{state="MaintenancePending"} 0
+drainsafe_nodes{state="MaintenanceScheduled"} 0
+drainsafe_nodes{state="MaintenanceStarted"} 0
+drainsafe_nodes{state="NodeCordoned"} 0
+drainsafe_nodes{state="NodeCordoning"} 0
+drainsafe_nodes{state="NodeDrained"} 1
+drainsafe_nodes{state="NodeDraining"} 1
+drainsafe_nodes{state="NodeExpressDraining"} 0
+drainsafe_nodes{state="NodePostMaintenance"} 0
+drainsafe_nodes{state="NodePreDrain"} 0
+drainsafe_nodes{state="NodeRunning"} 2
+drainsafe_nodes{state="NodeVerifying"} 0
+`), "drainsafe_nodes")
+	assert.Nil(err)
+
+	families, err := registry.Gather()
+	assert.Nil(err)
+	remaining := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "drainsafe_notbefore_remaining_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "node" {
+					remaining[label.GetValue()] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	assert.Len(remaining, 1)
+	assert.InDelta(600, remaining["drainingnode"], 5)
+}
+
+func TestFailures(t *testing.T) {
+	assert := assert.New(t)
+	before := testutil.ToFloat64(metrics.Failures.WithLabelValues(metrics.Drain, metrics.ReasonTimeout))
+	metrics.Failures.WithLabelValues(metrics.Drain, metrics.ReasonTimeout).Inc()
+	assert.Equal(before+1, testutil.ToFloat64(metrics.Failures.WithLabelValues(metrics.Drain, metrics.ReasonTimeout)))
+}
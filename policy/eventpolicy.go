@@ -0,0 +1,118 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package policy
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Action taken by drainsafe for a scheduled event type
+type Action string
+
+const (
+	// Ignore scheduled event is not tracked on the node
+	Ignore Action = "Ignore"
+	// AnnotateOnly scheduled event is recorded on the node, node is neither cordoned nor drained
+	AnnotateOnly Action = "AnnotateOnly"
+	// CordonOnly node is cordoned but workload is not drained before approving the scheduled event
+	CordonOnly Action = "CordonOnly"
+	// Drain node is cordoned and drained before approving the scheduled event
+	Drain Action = "Drain"
+	// ExpressDrain node is cordoned and drained right away by the scheduled event controller on the
+	// node, without repairman approval, for events which give little notice such as Preempt
+	ExpressDrain Action = "ExpressDrain"
+)
+
+var actions = []Action{Ignore, AnnotateOnly, CordonOnly, Drain, ExpressDrain}
+
+// EventPolicy maps scheduled event types, e.g. Reboot, Freeze, to actions
+type EventPolicy map[string]Action
+
+// DefaultEventPolicy drains on Reboot and Redeploy, express drains on Preempt and Terminate and ignores Freeze
+func DefaultEventPolicy() EventPolicy {
+	return EventPolicy{
+		"Reboot":    Drain,
+		"Redeploy":  Drain,
+		"Preempt":   ExpressDrain,
+		"Terminate": ExpressDrain,
+		"Freeze":    Ignore,
+	}
+}
+
+// ParseAction parses action, case insensitive
+func ParseAction(value string) (Action, error) {
+	for _, action := range actions {
+		if strings.EqualFold(string(action), value) {
+			return action, nil
+		}
+	}
+	return "", errors.Errorf("unknown action %s, expected one of %v", value, actions)
+}
+
+// ParseEventPolicy parses comma separated EventType=Action pairs, e.g. "Freeze=CordonOnly,Reboot=Drain",
+// event types which are not specified keep their default action
+func ParseEventPolicy(value string) (EventPolicy, error) {
+	p := DefaultEventPolicy()
+	if err := p.Set(value); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Cordons returns whether action cordons the node, Ignore, AnnotateOnly and unknown actions never do
+func (a Action) Cordons() bool {
+	return a == CordonOnly || a == Drain || a == ExpressDrain
+}
+
+// ActionFor returns action for event type, Ignore for unknown event types
+func (p EventPolicy) ActionFor(eventType string) Action {
+	if p == nil {
+		p = DefaultEventPolicy()
+	}
+	for t, action := range p {
+		if strings.EqualFold(t, eventType) {
+			return action
+		}
+	}
+	return Ignore
+}
+
+// String formats policy as sorted comma separated EventType=Action pairs
+func (p EventPolicy) String() string {
+	pairs := []string{}
+	for t, action := range p {
+		pairs = append(pairs, t+"="+string(action))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set merges comma separated EventType=Action pairs into policy, implements flag.Value
+func (p EventPolicy) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return errors.Errorf("invalid event policy %s, expected EventType=Action", pair)
+		}
+		action, err := ParseAction(kv[1])
+		if err != nil {
+			return err
+		}
+		eventType := kv[0]
+		for t := range p {
+			if strings.EqualFold(t, eventType) {
+				eventType = t
+			}
+		}
+		p[eventType] = action
+	}
+	return nil
+}
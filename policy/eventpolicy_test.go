@@ -0,0 +1,48 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package policy_test
+
+import (
+	"testing"
+
+	"github.com/awesomenix/drainsafe/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultEventPolicy(t *testing.T) {
+	assert := assert.New(t)
+	p := policy.DefaultEventPolicy()
+	assert.Equal(policy.Drain, p.ActionFor("reboot"))
+	assert.Equal(policy.ExpressDrain, p.ActionFor("Terminate"))
+	assert.Equal(policy.Ignore, p.ActionFor("Freeze"))
+	assert.Equal(policy.Ignore, p.ActionFor("Unknown"))
+
+	var empty policy.EventPolicy
+	assert.Equal(policy.Drain, empty.ActionFor("Redeploy"))
+
+	assert.True(policy.Drain.Cordons())
+	assert.True(policy.CordonOnly.Cordons())
+	assert.True(policy.ExpressDrain.Cordons())
+	assert.False(policy.AnnotateOnly.Cordons())
+	assert.False(policy.Ignore.Cordons())
+	assert.False(policy.Action("Unknown").Cordons())
+}
+
+func TestParseEventPolicy(t *testing.T) {
+	assert := assert.New(t)
+	p, err := policy.ParseEventPolicy("freeze=cordononly, Reboot=AnnotateOnly")
+	assert.Nil(err)
+	assert.Equal(policy.CordonOnly, p.ActionFor("Freeze"))
+	assert.Equal(policy.AnnotateOnly, p.ActionFor("Reboot"))
+	assert.Equal(policy.Drain, p.ActionFor("Redeploy"))
+	assert.Equal("Freeze=CordonOnly,Preempt=ExpressDrain,Reboot=AnnotateOnly,Redeploy=Drain,Terminate=ExpressDrain", p.String())
+
+	p, err = policy.ParseEventPolicy("")
+	assert.Nil(err)
+	assert.Equal(policy.DefaultEventPolicy(), p)
+
+	_, err = policy.ParseEventPolicy("Freeze")
+	assert.NotNil(err)
+	_, err = policy.ParseEventPolicy("Freeze=Evacuate")
+	assert.NotNil(err)
+}
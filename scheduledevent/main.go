@@ -4,9 +4,15 @@ package main
 
 import (
 	"flag"
+	"net/http"
+	"net/url"
 	"os"
+	"time"
 
+	drainsafev1 "github.com/awesomenix/drainsafe/api/v1"
+	"github.com/awesomenix/drainsafe/azure"
 	"github.com/awesomenix/drainsafe/controllers"
+	"github.com/awesomenix/drainsafe/policy"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -22,18 +28,42 @@ var (
 func init() {
 
 	corev1.AddToScheme(scheme)
+	drainsafev1.AddToScheme(scheme)
 	// +kubebuilder:scaffold:scheme
 }
 
 func main() {
-	var metricsAddr string
+	var metricsAddr, imdsEndpoint, imdsAPIVersion, imdsProxy string
+	var imdsTimeout, resyncPeriod time.Duration
 	var verbose bool
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
+	flag.StringVar(&imdsEndpoint, "imds-endpoint", azure.DefaultEndpoint, "Azure instance metadata service endpoint.")
+	flag.StringVar(&imdsAPIVersion, "imds-api-version", azure.DefaultAPIVersion, "Azure scheduled events api version.")
+	flag.DurationVar(&imdsTimeout, "imds-timeout", azure.DefaultTimeout, "Timeout for each azure instance metadata service request.")
+	flag.StringVar(&imdsProxy, "imds-proxy", "", "Proxy url for azure instance metadata service requests, direct if empty.")
+	flag.DurationVar(&resyncPeriod, "resync-period", controllers.DefaultResyncPeriod, "How often scheduled events are processed even if they did not change.")
+	eventPolicy := policy.DefaultEventPolicy()
+	flag.Var(eventPolicy, "event-policy", "Comma separated EventType=Action pairs, event types mapped to Ignore are not tracked, overridden per node by DrainSafePolicy.")
 	flag.BoolVar(&verbose, "verbose", false, "verbose logging")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.Logger(verbose))
 
+	azOptions := []azure.Option{
+		azure.WithEndpoint(imdsEndpoint),
+		azure.WithAPIVersion(imdsAPIVersion),
+		azure.WithTimeout(imdsTimeout),
+		azure.WithEventPolicy(eventPolicy),
+	}
+	if imdsProxy != "" {
+		proxyURL, err := url.Parse(imdsProxy)
+		if err != nil {
+			setupLog.Error(err, "invalid imds proxy", "Proxy", imdsProxy)
+			os.Exit(1)
+		}
+		azOptions = append(azOptions, azure.WithTransport(&http.Transport{Proxy: http.ProxyURL(proxyURL)}))
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
@@ -46,10 +76,13 @@ func main() {
 	stopch := ctrl.SetupSignalHandler()
 
 	err = (&controllers.ScheduledEventReconciler{
-		Client:   mgr.GetClient(),
-		Log:      ctrl.Log.WithName("controllers").WithName("ScheduledEvent"),
-		Recorder: mgr.GetEventRecorderFor("scheduledevent"),
-		StopCh:   stopch,
+		Client:       mgr.GetClient(),
+		Log:          ctrl.Log.WithName("controllers").WithName("ScheduledEvent"),
+		Recorder:     mgr.GetEventRecorderFor("scheduledevent"),
+		StopCh:       stopch,
+		AzClient:     azure.New(azOptions...),
+		ResyncPeriod: resyncPeriod,
+		EventPolicy:  eventPolicy,
 	}).SetupWithManager(mgr)
 	if err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ScheduledEvent")
@@ -0,0 +1,142 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package statemachine
+
+import (
+	"time"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	"github.com/pkg/errors"
+)
+
+// DefaultStuckTimeout how long a node may stay in a maintenance state before it is considered stuck
+const DefaultStuckTimeout = 2 * time.Hour
+
+// ErrUnknownState maintenance state is not one of the drainsafe.azure.com/maintenancestate values
+var ErrUnknownState = errors.New("unknown maintenance state")
+
+// ErrIllegalTransition maintenance state may not move to the requested state
+var ErrIllegalTransition = errors.New("illegal maintenance state transition")
+
+// transitions maintenance states each state may move to. Every state may move to Running, the
+// scheduled event controller completes the maintenance once azure no longer reports events.
+var transitions = map[string][]string{
+	"":                              {annotations.Scheduled, annotations.ExpressDraining},
+	annotations.Scheduled:           {annotations.MaintenancePending, annotations.MaintenanceApproved, annotations.ExpressDraining},
+	annotations.MaintenancePending:  {annotations.MaintenanceApproved, annotations.ExpressDraining},
+	annotations.MaintenanceApproved: {annotations.Cordoning, annotations.ExpressDraining},
+	annotations.Cordoning:           {annotations.Cordoned},
+	annotations.Cordoned:            {annotations.PreDrain, annotations.Draining, annotations.Drained},
+	annotations.PreDrain:            {annotations.Draining},
+	annotations.Draining:            {annotations.Verifying, annotations.Drained},
+	annotations.ExpressDraining:     {annotations.Drained},
+	annotations.Verifying:           {annotations.Drained},
+	annotations.Drained:             {annotations.Started},
+	annotations.Started:             {},
+	annotations.Running:             {annotations.Scheduled, annotations.ExpressDraining, annotations.PostMaintenance},
+	annotations.PostMaintenance:     {annotations.Scheduled, annotations.ExpressDraining},
+}
+
+// unbounded states a node may stay in indefinitely, waiting for a scheduled event, for approval
+// of the maintenance, which azure starts at NotBefore regardless, for the maintenance to end or
+// for post maintenance hooks, which hold the node on purpose when they fail
+var unbounded = map[string]bool{
+	"":                             true,
+	annotations.Scheduled:          true,
+	annotations.MaintenancePending: true,
+	annotations.Started:            true,
+	annotations.Running:            true,
+	annotations.PostMaintenance:    true,
+}
+
+// cordoned states a node stays cordoned in, from being cordoned until the maintenance started.
+// Express draining cordons within the same step and leaves it in Drained.
+var cordoned = map[string]bool{
+	annotations.Cordoned:  true,
+	annotations.PreDrain:  true,
+	annotations.Draining:  true,
+	annotations.Verifying: true,
+	annotations.Drained:   true,
+	annotations.Started:   true,
+}
+
+// Known returns whether state is a maintenance state, empty if the node never had a maintenance
+func Known(state string) bool {
+	_, ok := transitions[state]
+	return ok
+}
+
+// Validate returns an error if a node in maintenance state from may not move to state to,
+// staying in the same state is always valid
+func Validate(from, to string) error {
+	if !Known(to) || to == "" {
+		return errors.Wrapf(ErrUnknownState, "%q", to)
+	}
+	if from == to {
+		return nil
+	}
+	if !Known(from) {
+		return errors.Wrapf(ErrUnknownState, "%q", from)
+	}
+	if to == annotations.Running {
+		return nil
+	}
+	for _, state := range transitions[from] {
+		if state == to {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrIllegalTransition, "%s to %s", from, to)
+}
+
+// IsUnknownState checks if err is caused by an unknown maintenance state
+func IsUnknownState(err error) bool {
+	return errors.Cause(err) == ErrUnknownState
+}
+
+// IsIllegalTransition checks if err is caused by an illegal maintenance state transition
+func IsIllegalTransition(err error) bool {
+	return errors.Cause(err) == ErrIllegalTransition
+}
+
+// Bounded returns whether a node is expected to leave state within a bounded time, nodes
+// staying longer in such a state are stuck
+func Bounded(state string) bool {
+	return Known(state) && !unbounded[state]
+}
+
+// KeepsCordoned returns whether a node in state must not be uncordoned, workload scheduled on it
+// would land on a virtual machine about to go down
+func KeepsCordoned(state string) bool {
+	return cordoned[state]
+}
+
+// StuckAt returns when a node which entered state at since becomes stuck, zero if it never does
+func StuckAt(state string, since time.Time, timeout time.Duration) time.Time {
+	if !Bounded(state) || since.IsZero() || timeout <= 0 {
+		return time.Time{}
+	}
+	return since.Add(timeout)
+}
+
+// Stuck returns whether a node which entered state at since is stuck at now
+func Stuck(state string, since time.Time, timeout time.Duration, now time.Time) bool {
+	stuckAt := StuckAt(state, since, timeout)
+	return !stuckAt.IsZero() && !now.Before(stuckAt)
+}
+
+// SafeState returns state a stuck node or a node in an unknown state is reset to. Maintenance of
+// a pending scheduled event restarts from Scheduled, cordoning and draining again as needed,
+// otherwise the maintenance is completed with Running, which uncordons the node.
+func SafeState(pending bool) string {
+	if pending {
+		return annotations.Scheduled
+	}
+	return annotations.Running
+}
+
+// Safe returns whether state is one stuck nodes are reset to
+func Safe(state string) bool {
+	return state == SafeState(true) || state == SafeState(false)
+}
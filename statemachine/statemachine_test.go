@@ -0,0 +1,94 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package statemachine_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	"github.com/awesomenix/drainsafe/statemachine"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+	valid := [][2]string{
+		{"", annotations.Scheduled},
+		{annotations.Scheduled, annotations.MaintenanceApproved},
+		{annotations.MaintenancePending, annotations.MaintenanceApproved},
+		{annotations.MaintenanceApproved, annotations.Cordoning},
+		{annotations.Cordoning, annotations.Cordoned},
+		{annotations.Cordoned, annotations.PreDrain},
+		{annotations.Cordoned, annotations.Drained},
+		{annotations.PreDrain, annotations.Draining},
+		{annotations.Draining, annotations.Verifying},
+		{annotations.Verifying, annotations.Drained},
+		{annotations.ExpressDraining, annotations.Drained},
+		{annotations.Drained, annotations.Started},
+		{annotations.Started, annotations.Running},
+		{annotations.Draining, annotations.Running},
+		{annotations.Running, annotations.PostMaintenance},
+		{annotations.PostMaintenance, annotations.Running},
+		{annotations.Running, annotations.ExpressDraining},
+		{annotations.Draining, annotations.Draining},
+	}
+	for _, transition := range valid {
+		assert.Nil(statemachine.Validate(transition[0], transition[1]), "%s to %s", transition[0], transition[1])
+	}
+
+	illegal := [][2]string{
+		{annotations.Scheduled, annotations.Draining},
+		{annotations.Cordoning, annotations.Drained},
+		{annotations.Drained, annotations.Draining},
+		{annotations.Started, annotations.Scheduled},
+		{annotations.Running, annotations.Drained},
+	}
+	for _, transition := range illegal {
+		err := statemachine.Validate(transition[0], transition[1])
+		assert.True(statemachine.IsIllegalTransition(err), "%s to %s", transition[0], transition[1])
+	}
+
+	err := statemachine.Validate("NodeDrainnig", annotations.Running)
+	assert.True(statemachine.IsUnknownState(err))
+	assert.Contains(err.Error(), "NodeDrainnig")
+	assert.True(statemachine.IsUnknownState(statemachine.Validate(annotations.Running, "")))
+	assert.True(statemachine.IsUnknownState(statemachine.Validate(annotations.Running, annotations.Uncordoned)))
+	assert.False(statemachine.Known(annotations.Uncordoned))
+	assert.True(statemachine.Known(""))
+}
+
+func TestStuck(t *testing.T) {
+	assert := assert.New(t)
+	since := time.Date(2019, 6, 30, 16, 0, 0, 0, time.UTC)
+
+	assert.True(statemachine.Bounded(annotations.Draining))
+	assert.True(statemachine.Bounded(annotations.Drained))
+	assert.False(statemachine.Bounded(annotations.Started))
+	assert.False(statemachine.Bounded(annotations.PostMaintenance))
+	assert.False(statemachine.Bounded(annotations.Scheduled))
+	assert.False(statemachine.Bounded(annotations.MaintenancePending))
+	assert.False(statemachine.Bounded(annotations.Running))
+	assert.False(statemachine.Bounded("NodeDrainnig"))
+
+	assert.True(statemachine.KeepsCordoned(annotations.Cordoned))
+	assert.True(statemachine.KeepsCordoned(annotations.Drained))
+	assert.True(statemachine.KeepsCordoned(annotations.Started))
+	assert.False(statemachine.KeepsCordoned(annotations.Cordoning))
+	assert.False(statemachine.KeepsCordoned(annotations.Running))
+	assert.False(statemachine.KeepsCordoned("NodeDrainnig"))
+
+	assert.Equal(since.Add(time.Hour), statemachine.StuckAt(annotations.Draining, since, time.Hour))
+	assert.True(statemachine.StuckAt(annotations.Running, since, time.Hour).IsZero())
+	assert.True(statemachine.StuckAt(annotations.Draining, time.Time{}, time.Hour).IsZero())
+	assert.True(statemachine.StuckAt(annotations.Draining, since, 0).IsZero())
+
+	assert.False(statemachine.Stuck(annotations.Draining, since, time.Hour, since.Add(59*time.Minute)))
+	assert.True(statemachine.Stuck(annotations.Draining, since, time.Hour, since.Add(time.Hour)))
+	assert.False(statemachine.Stuck(annotations.Scheduled, since, time.Hour, since.Add(24*time.Hour)))
+
+	assert.Equal(annotations.Scheduled, statemachine.SafeState(true))
+	assert.Equal(annotations.Running, statemachine.SafeState(false))
+	assert.True(statemachine.Safe(annotations.Running))
+	assert.False(statemachine.Safe(annotations.Drained))
+}
@@ -0,0 +1,131 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	"github.com/awesomenix/drainsafe/statemachine"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var log logr.Logger = ctrl.Log.WithName("webhook")
+
+// NodeValidatorPath path the node validator is served on
+const NodeValidatorPath = "/validate-v1-node"
+
+// +kubebuilder:webhook:path=/validate-v1-node,mutating=false,failurePolicy=ignore,groups="",resources=nodes,verbs=update,versions=v1,name=vnode.drainsafe.azure.com
+
+// NodeValidator rejects node updates which corrupt the maintenance state machine, unknown
+// maintenance states, illegal state transitions, changes of the maintenance owner by anyone
+// but drainsafe and uncordoning a node drainsafe keeps cordoned. Removing the maintenance
+// state is allowed.
+type NodeValidator struct {
+	// Namespace drainsafe runs in, all of its service accounts are drainsafe if ServiceAccounts is empty
+	Namespace string
+	// ServiceAccounts namespace:name of drainsafe service accounts
+	ServiceAccounts []string
+
+	decoder *admission.Decoder
+}
+
+// SetupWithManager registers the validator with the webhook server of mgr
+func (v *NodeValidator) SetupWithManager(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register(NodeValidatorPath, &admission.Webhook{Handler: v})
+	return nil
+}
+
+// InjectDecoder implements admission.DecoderInjector
+func (v *NodeValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// Handle implements admission.Handler
+func (v *NodeValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1beta1.Update {
+		return admission.Allowed("")
+	}
+	node := &corev1.Node{}
+	if err := v.decoder.Decode(req, node); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	old := &corev1.Node{}
+	if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if err := v.validate(old, node, req.UserInfo.Username); err != nil {
+		log.Info("denied node update", "Node", node.Name, "User", req.UserInfo.Username, "Reason", err.Error())
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
+
+// validate returns why the update of old to node by user is denied, nil if it is allowed
+func (v *NodeValidator) validate(old, node *corev1.Node, user string) error {
+	privileged := v.isDrainsafe(user)
+	ownerKey := annotations.DrainSafeMaintenanceOwner
+	if old.Annotations[ownerKey] != node.Annotations[ownerKey] && !privileged {
+		return errors.Errorf("%s may only be changed by drainsafe", ownerKey)
+	}
+
+	from := old.Annotations[annotations.DrainSafeMaintenance]
+	to := node.Annotations[annotations.DrainSafeMaintenance]
+	if old.Spec.Unschedulable && !node.Spec.Unschedulable && !uncordonAllowed(node) &&
+		node.Annotations[ownerKey] == annotations.Drainsafe {
+		// removing the maintenance state does not release the node
+		state := to
+		if state == "" {
+			state = from
+		}
+		if statemachine.KeepsCordoned(state) {
+			return errors.Errorf("node may not be uncordoned in %s, set %s=true to override", state, annotations.DrainSafeAllowUncordon)
+		}
+	}
+
+	// anyone may remove the maintenance state, e.g. when uninstalling drainsafe
+	if from == to || to == "" {
+		return nil
+	}
+	err := statemachine.Validate(from, to)
+	if err == nil {
+		return nil
+	}
+	// drainsafe resets stuck nodes, anyone may reset nodes in an unknown state
+	if statemachine.Safe(to) && (privileged || !statemachine.Known(from)) {
+		return nil
+	}
+	return errors.Wrapf(err, "%s", annotations.DrainSafeMaintenance)
+}
+
+// uncordonAllowed returns whether the break glass override to uncordon node is set
+func uncordonAllowed(node *corev1.Node) bool {
+	return node.Annotations[annotations.DrainSafeAllowUncordon] == "true"
+}
+
+// isDrainsafe returns whether user is a drainsafe service account
+func (v *NodeValidator) isDrainsafe(user string) bool {
+	const prefix = "system:serviceaccount:"
+	if !strings.HasPrefix(user, prefix) {
+		return false
+	}
+	account := strings.TrimPrefix(user, prefix)
+	if len(v.ServiceAccounts) == 0 {
+		return v.Namespace != "" && strings.HasPrefix(account, v.Namespace+":")
+	}
+	for _, serviceAccount := range v.ServiceAccounts {
+		if account == serviceAccount {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/awesomenix/drainsafe/annotations"
+	"github.com/awesomenix/drainsafe/webhook"
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newNode(state, owner string) runtime.RawExtension {
+	return newCordonedNode(state, owner, false, false)
+}
+
+func newCordonedNode(state, owner string, unschedulable, allowUncordon bool) runtime.RawExtension {
+	node := &corev1.Node{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Node"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummynode",
+			Annotations: map[string]string{},
+		},
+		Spec: corev1.NodeSpec{Unschedulable: unschedulable},
+	}
+	if allowUncordon {
+		node.Annotations[annotations.DrainSafeAllowUncordon] = "true"
+	}
+	if state != "" {
+		node.Annotations[annotations.DrainSafeMaintenance] = state
+	}
+	if owner != "" {
+		node.Annotations[annotations.DrainSafeMaintenanceOwner] = owner
+	}
+	raw, _ := json.Marshal(node)
+	return runtime.RawExtension{Raw: raw}
+}
+
+func newRequest(user string, old, node runtime.RawExtension) admission.Request {
+	return admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+		Operation: admissionv1beta1.Update,
+		UserInfo:  authenticationv1.UserInfo{Username: user},
+		OldObject: old,
+		Object:    node,
+	}}
+}
+
+func TestNodeValidator(t *testing.T) {
+	assert := assert.New(t)
+	corev1.AddToScheme(scheme.Scheme)
+	decoder, err := admission.NewDecoder(scheme.Scheme)
+	assert.Nil(err)
+	v := &webhook.NodeValidator{Namespace: "drainsafe-system"}
+	assert.Nil(v.InjectDecoder(decoder))
+
+	drainsafe := "system:serviceaccount:drainsafe-system:default"
+	admin := "kubernetes-admin"
+	tests := []struct {
+		user    string
+		old     runtime.RawExtension
+		node    runtime.RawExtension
+		allowed bool
+	}{
+		{admin, newNode("", ""), newNode("", ""), true},
+		{admin, newNode(annotations.Running, ""), newNode(annotations.Running, ""), true},
+		{drainsafe, newNode(annotations.Scheduled, ""), newNode(annotations.MaintenanceApproved, ""), true},
+		{admin, newNode(annotations.Cordoned, ""), newNode(annotations.Draining, ""), true},
+		{admin, newNode(annotations.Draining, ""), newNode(annotations.Running, ""), true},
+		// illegal transitions
+		{admin, newNode(annotations.Scheduled, ""), newNode(annotations.Drained, ""), false},
+		{drainsafe, newNode(annotations.Scheduled, ""), newNode(annotations.Drained, ""), false},
+		{admin, newNode(annotations.Started, ""), newNode(annotations.Scheduled, ""), false},
+		// unknown states
+		{admin, newNode(annotations.Running, ""), newNode("NodeDrainnig", ""), false},
+		{drainsafe, newNode(annotations.Running, ""), newNode("NodeDrainnig", ""), false},
+		// removal
+		{admin, newNode(annotations.Running, ""), newNode("", ""), true},
+		{admin, newNode(annotations.Drained, ""), newNode("", ""), true},
+		{admin, newNode("NodeDrainnig", ""), newNode("", ""), true},
+		// resets
+		{drainsafe, newNode(annotations.Started, ""), newNode(annotations.Scheduled, ""), true},
+		{admin, newNode("NodeDrainnig", ""), newNode(annotations.Scheduled, ""), true},
+		{admin, newNode("NodeDrainnig", ""), newNode(annotations.Cordoned, ""), false},
+		// maintenance owner
+		{drainsafe, newNode(annotations.Cordoning, ""), newNode(annotations.Cordoning, annotations.Drainsafe), true},
+		{admin, newNode(annotations.Cordoning, ""), newNode(annotations.Cordoning, annotations.Drainsafe), false},
+		{admin, newNode(annotations.Cordoning, annotations.Drainsafe), newNode(annotations.Cordoning, ""), false},
+		{"system:serviceaccount:kube-system:default", newNode(annotations.Cordoning, annotations.Drainsafe), newNode(annotations.Cordoning, ""), false},
+		// uncordon
+		{admin, newCordonedNode(annotations.Drained, annotations.Drainsafe, true, false), newCordonedNode(annotations.Drained, annotations.Drainsafe, false, false), false},
+		{drainsafe, newCordonedNode(annotations.Cordoned, annotations.Drainsafe, true, false), newCordonedNode(annotations.Cordoned, annotations.Drainsafe, false, false), false},
+		{admin, newCordonedNode(annotations.Started, annotations.Drainsafe, true, false), newCordonedNode(annotations.Started, annotations.Drainsafe, false, false), false},
+		{admin, newCordonedNode(annotations.Drained, annotations.Drainsafe, true, false), newCordonedNode("", annotations.Drainsafe, false, false), false},
+		{admin, newCordonedNode(annotations.Drained, annotations.Drainsafe, true, false), newCordonedNode(annotations.Drained, annotations.Drainsafe, false, true), true},
+		{admin, newCordonedNode(annotations.Drained, annotations.Drainsafe, true, false), newCordonedNode("", annotations.Drainsafe, false, true), true},
+		{admin, newCordonedNode(annotations.Cordoning, annotations.Drainsafe, true, false), newCordonedNode(annotations.Cordoning, annotations.Drainsafe, false, false), true},
+		{admin, newCordonedNode(annotations.Running, annotations.Drainsafe, true, false), newCordonedNode(annotations.Running, annotations.Drainsafe, false, false), true},
+		{drainsafe, newCordonedNode(annotations.Started, annotations.Drainsafe, true, false), newCordonedNode(annotations.Running, annotations.Drainsafe, false, false), true},
+		{admin, newCordonedNode(annotations.Drained, annotations.Drainsafe, false, false), newCordonedNode(annotations.Drained, annotations.Drainsafe, true, false), true},
+		// cordoned by someone else
+		{admin, newCordonedNode(annotations.Drained, "", true, false), newCordonedNode(annotations.Drained, "", false, false), true},
+	}
+	for _, test := range tests {
+		res := v.Handle(context.TODO(), newRequest(test.user, test.old, test.node))
+		assert.Equal(test.allowed, res.Allowed, "%s %s to %s", test.user, test.old.Raw, test.node.Raw)
+	}
+
+	res := v.Handle(context.TODO(), newRequest(admin, newNode(annotations.Scheduled, ""), newNode(annotations.Drained, "")))
+	assert.Contains(res.Result.Reason, "drainsafe.azure.com/maintenancestate: MaintenanceScheduled to NodeDrained: illegal maintenance state transition")
+	res = v.Handle(context.TODO(), newRequest(admin, newNode("", ""), newNode("", annotations.Drainsafe)))
+	assert.Contains(res.Result.Reason, "drainsafe.azure.com/maintenanceowner may only be changed by drainsafe")
+
+	res = v.Handle(context.TODO(), newRequest(admin, newCordonedNode(annotations.Draining, annotations.Drainsafe, true, false), newCordonedNode(annotations.Draining, annotations.Drainsafe, false, false)))
+	assert.Contains(res.Result.Reason, "node may not be uncordoned in NodeDraining, set drainsafe.azure.com/allowuncordon=true to override")
+
+	v.ServiceAccounts = []string{"drainsafe-system:drainsafe"}
+	res = v.Handle(context.TODO(), newRequest(drainsafe, newNode("", ""), newNode("", annotations.Drainsafe)))
+	assert.False(res.Allowed)
+	res = v.Handle(context.TODO(), newRequest("system:serviceaccount:drainsafe-system:drainsafe", newNode("", ""), newNode("", annotations.Drainsafe)))
+	assert.True(res.Allowed)
+}